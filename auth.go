@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	homedir "github.com/mitchellh/go-homedir"
+)
+
+// Fetching private repositories relies on the credentials git and the go
+// tool already know about: ~/.netrc for https, GIT_SSH_COMMAND and the ssh
+// config for ssh, and git's url.<base>.insteadOf rewrites to switch between
+// the two. These are all picked up from the environment of the commands we
+// spawn, gx-go only needs to use the netrc for its own https requests.
+
+// authErrorRE matches the messages git, ssh and the go tool print when a
+// repository needs credentials or refuses the ones given.
+var authErrorRE = regexp.MustCompile(`(?i)(terminal prompts disabled|could not read (username|password)|authentication failed|invalid username or password|permission denied \(publickey|host key verification failed|401 unauthorized|403 forbidden|repository not found)`)
+
+// fetchError builds the error for a failed fetch of `what`, given the output
+// of the failed command (or its error if there is none), calling out
+// authentication failures.
+func fetchError(what, out string, err error) error {
+	out = strings.TrimSpace(out)
+	msg := out
+	if out == "" {
+		msg = err.Error()
+	}
+	if authErrorRE.MatchString(msg) {
+		return fmt.Errorf("authentication failed fetching %s (set up credentials in ~/.netrc, GIT_SSH_COMMAND or a git url.<base>.insteadOf rewrite): %s", what, msg)
+	}
+	if out == "" {
+		return fmt.Errorf("fetching %s failed: %s", what, err)
+	}
+	return fmt.Errorf("fetching %s failed: %s - %s", what, out, err)
+}
+
+// netrcAuth returns the login and password for `host` from the netrc file
+// at $NETRC or ~/.netrc, if any.
+func netrcAuth(host string) (string, string, bool) {
+	p := os.Getenv("NETRC")
+	if p == "" {
+		var err error
+		p, err = homedir.Expand("~/.netrc")
+		if err != nil {
+			return "", "", false
+		}
+	}
+
+	fi, err := os.Open(p)
+	if err != nil {
+		return "", "", false
+	}
+	defer fi.Close()
+
+	// entries are whitespace separated tokens, "machine" starting each one
+	// and "default" matching any host
+	var words []string
+	scan := bufio.NewScanner(fi)
+	for scan.Scan() {
+		words = append(words, strings.Fields(scan.Text())...)
+	}
+
+	var match bool
+	var login, password string
+	for n := 0; n < len(words); n++ {
+		switch words[n] {
+		case "machine", "default":
+			if match && login != "" {
+				return login, password, true
+			}
+			match = words[n] == "default"
+			if !match && n+1 < len(words) {
+				n++
+				match = words[n] == host
+			}
+			login, password = "", ""
+		case "login", "password":
+			if n+1 >= len(words) {
+				break
+			}
+			if words[n] == "login" {
+				login = words[n+1]
+			} else {
+				password = words[n+1]
+			}
+			n++
+		}
+	}
+	if match && login != "" {
+		return login, password, true
+	}
+	return "", "", false
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	cli "github.com/urfave/cli"
+	gx "github.com/whyrusleeping/gx/gxutil"
+)
+
+var BisectCommand = cli.Command{
+	Name:      "bisect",
+	Usage:     "find the dependency version that introduced a regression",
+	ArgsUsage: "[dep] [good hash] [bad hash] -- [test command]",
+	Description: `bisect collects every version of 'dep' that the current package has
+depended on between 'good hash' and 'bad hash' (according to the git
+history of its package.json) and binary searches them, swapping each
+candidate in and running the test command. A zero exit status marks a
+version as good. Each candidate is installed where the dependency is, in
+the vendor directory or globally, and the vendored packages importing the
+dependency are pointed at it too.
+
+The original dependency version is restored once bisection finishes.`,
+	Action: func(c *cli.Context) error {
+		args := c.Args()
+		if len(args) < 4 {
+			return fmt.Errorf("must specify a dependency, a good and a bad hash, and a test command")
+		}
+		name, good, bad, testcmd := args[0], args[1], args[2], args[3:]
+		// the command may be separated with --, which cli passes on
+		if testcmd[0] == "--" {
+			testcmd = testcmd[1:]
+		}
+		if len(testcmd) == 0 {
+			return fmt.Errorf("must specify a test command")
+		}
+
+		root, err := gx.GetPackageRoot()
+		if err != nil {
+			return err
+		}
+
+		pkgfile := filepath.Join(root, gx.PkgFileName)
+		pkg, err := LoadPackageFile(pkgfile)
+		if err != nil {
+			return err
+		}
+
+		dep := pkg.FindDep(name)
+		if dep == nil {
+			return fmt.Errorf("%s not found", name)
+		}
+		orig := dep.Hash
+
+		versions, err := depHistory(root, dep.Name)
+		if err != nil {
+			return err
+		}
+
+		candidates := versionsBetween(versions, good, bad)
+		if candidates == nil {
+			return fmt.Errorf("%s and %s are not both in the history of %s in %s, in that order, nothing to bisect", good, bad, dep.Name, gx.PkgFileName)
+		}
+		Log("bisecting %d versions of %s", len(candidates), dep.Name)
+
+		// candidates are installed where the dependency is
+		vdir := filepath.Join(root, packageVendorRoot(root), "gx", "ipfs")
+		_, err = os.Stat(hashDir(vdir, orig))
+		global := err != nil
+
+		// the test command prints while the versions are swapped, so the
+		// rewrites don't report progress
+		ctx, stop := interruptContext()
+		defer stop()
+		op := &rewriteOp{ctx: ctx}
+
+		cur := orig
+		swap := func(op *rewriteOp, hash string) error {
+			dep.Hash = hash
+			if err := gx.SavePackageFile(pkg, pkgfile); err != nil {
+				return err
+			}
+			if err := gxInstall(root, global); err != nil {
+				return err
+			}
+
+			oldimp := "gx/ipfs/" + cur + "/" + dep.Name
+			newimp := "gx/ipfs/" + hash + "/" + dep.Name
+			if err := doUpdate(op, root, oldimp, newimp); err != nil {
+				return err
+			}
+			if !global {
+				// the vendored packages importing it, which are restored
+				// along with the package
+				if err := doUpdate(op, vdir, oldimp, newimp); err != nil {
+					return err
+				}
+			}
+
+			cur = hash
+			return nil
+		}
+
+		defer func() {
+			// restored even once interrupted
+			if err := swap(nil, orig); err != nil {
+				Error("failed to restore %s to %s: %s", dep.Name, orig, err)
+			}
+		}()
+
+		var tested []bisectStep
+
+		// candidates[lo] is known good, candidates[hi] is known bad
+		lo, hi := 0, len(candidates)-1
+		for hi-lo > 1 {
+			mid := (lo + hi) / 2
+			hash := candidates[mid]
+			Log("testing %s (%d versions left)", hash, hi-lo-1)
+
+			if err := swap(op, hash); err != nil {
+				return err
+			}
+
+			cmd := exec.Command(testcmd[0], testcmd[1:]...)
+			cmd.Dir = root
+			cmd.Stdout = commandOut()
+			cmd.Stderr = os.Stderr
+			good := cmd.Run() == nil
+			if good {
+				Log("%s is good", hash)
+				lo = mid
+			} else {
+				Log("%s is bad", hash)
+				hi = mid
+			}
+			tested = append(tested, bisectStep{Hash: hash, Good: good})
+		}
+
+		if jsonOutput {
+			return printJSON(map[string]interface{}{
+				"dependency": dep.Name,
+				"firstBad":   candidates[hi],
+				"tested":     tested,
+			})
+		}
+		Log("first bad version of %s: %s", dep.Name, candidates[hi])
+		return nil
+	},
+}
+
+// bisectStep is a version bisect tested, as printed with --json.
+type bisectStep struct {
+	Hash string `json:"hash"`
+	Good bool   `json:"good"`
+}
+
+// depHistory returns, oldest first, the distinct hashes the dependency
+// `name` has had in the git history of the package.json in `root`.
+func depHistory(root, name string) ([]string, error) {
+	out, err := gitOutput(root, "log", "--reverse", "--format=%H", "--", gx.PkgFileName)
+	if err != nil {
+		return nil, err
+	}
+
+	var hashes []string
+	seen := make(map[string]bool)
+	for _, commit := range strings.Fields(out) {
+		data, err := gitOutput(root, "show", commit+":./"+gx.PkgFileName)
+		if err != nil {
+			VLog("skipping commit %s: %s", commit, err)
+			continue
+		}
+
+		var pkg Package
+		if err := json.Unmarshal([]byte(data), &pkg); err != nil {
+			VLog("skipping commit %s: %s", commit, err)
+			continue
+		}
+
+		dep := pkg.FindDep(name)
+		if dep == nil || seen[dep.Hash] {
+			continue
+		}
+		seen[dep.Hash] = true
+		hashes = append(hashes, dep.Hash)
+	}
+
+	return hashes, nil
+}
+
+// versionsBetween returns the slice of `versions` from `good` to `bad`
+// inclusive, or nil if either of them is missing or out of order.
+func versionsBetween(versions []string, good, bad string) []string {
+	gi, bi := -1, -1
+	for i, v := range versions {
+		switch v {
+		case good:
+			gi = i
+		case bad:
+			bi = i
+		}
+	}
+
+	if gi < 0 || bi < 0 || gi >= bi {
+		return nil
+	}
+	return versions[gi : bi+1]
+}
+
+func gitOutput(dir string, args ...string) (string, error) {
+	cmd := command("git", args...)
+	cmd.Dir = dir
+	out, err := cmd.Output()
+	if err != nil {
+		if ee, ok := err.(*exec.ExitError); ok && len(ee.Stderr) > 0 {
+			return "", fmt.Errorf("git %s failed: %s - %s", args[0], strings.TrimSpace(string(ee.Stderr)), err)
+		}
+		return "", fmt.Errorf("git %s failed: %s", args[0], err)
+	}
+	return string(out), nil
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	cli "github.com/urfave/cli"
+	gx "github.com/whyrusleeping/gx/gxutil"
+)
+
+const bundleManifestName = "gx-bundle.json"
+
+// BundleManifest describes the contents of a dependency bundle.
+type BundleManifest struct {
+	Package  string           `json:"package"`
+	Version  string           `json:"version"`
+	Packages []*gx.Dependency `json:"packages"`
+}
+
+var BundleCommand = cli.Command{
+	Name:      "bundle",
+	Usage:     "pack all dependencies of the current package into a tarball",
+	ArgsUsage: "[output file]",
+	Action: func(c *cli.Context) error {
+		root, err := gx.GetPackageRoot()
+		if err != nil {
+			return err
+		}
+
+		pkg, err := LoadPackageFile(filepath.Join(root, gx.PkgFileName))
+		if err != nil {
+			return err
+		}
+
+		out := c.Args().First()
+		if out == "" {
+			out = pkg.Name + "-deps.tar.gz"
+		}
+
+		pkgdir := filepath.Join(root, vendorDir)
+		dirs := make(map[string]string)
+		for _, dep := range pkg.Dependencies {
+			if err := depClosure(dep, pkgdir, dirs); err != nil {
+				return err
+			}
+		}
+
+		manifest := BundleManifest{
+			Package: pkg.Name,
+			Version: pkg.Version,
+		}
+
+		var hashes []string
+		for h := range dirs {
+			hashes = append(hashes, h)
+		}
+		sort.Strings(hashes)
+
+		for _, h := range hashes {
+			var cpkg Package
+			if err := gx.FindPackageInDir(&cpkg, dirs[h]); err != nil {
+				return err
+			}
+			manifest.Packages = append(manifest.Packages, &gx.Dependency{
+				Name:    cpkg.Name,
+				Hash:    h,
+				Version: cpkg.Version,
+			})
+		}
+
+		fi, err := os.Create(out)
+		if err != nil {
+			return err
+		}
+		defer fi.Close()
+
+		gzw := gzip.NewWriter(fi)
+		tw := tar.NewWriter(gzw)
+
+		mdata, err := json.MarshalIndent(manifest, "", "  ")
+		if err != nil {
+			return err
+		}
+		err = tw.WriteHeader(&tar.Header{
+			Name:    bundleManifestName,
+			Mode:    0644,
+			Size:    int64(len(mdata)),
+			ModTime: reproducibleTime(),
+		})
+		if err != nil {
+			return err
+		}
+		if _, err := tw.Write(mdata); err != nil {
+			return err
+		}
+
+		for _, h := range hashes {
+			VLog("  - adding %s", h)
+			if err := tarDir(tw, dirs[h], h); err != nil {
+				return fmt.Errorf("adding %s to bundle: %s", h, err)
+			}
+		}
+
+		if err := tw.Close(); err != nil {
+			return err
+		}
+		if err := gzw.Close(); err != nil {
+			return err
+		}
+
+		if jsonOutput {
+			return printJSON(map[string]interface{}{"file": out, "packages": manifest.Packages})
+		}
+		Log("bundled %d packages into %s", len(hashes), out)
+		return nil
+	},
+}
+
+var UnbundleCommand = cli.Command{
+	Name:      "unbundle",
+	Usage:     "restore a dependency bundle into the vendor directory",
+	ArgsUsage: "[bundle file]",
+	Action: func(c *cli.Context) error {
+		if !c.Args().Present() {
+			return fmt.Errorf("must specify a bundle file")
+		}
+
+		root, err := gx.GetPackageRoot()
+		if err != nil {
+			return err
+		}
+
+		fi, err := os.Open(c.Args().First())
+		if err != nil {
+			return err
+		}
+		defer fi.Close()
+
+		gzr, err := gzip.NewReader(fi)
+		if err != nil {
+			return err
+		}
+
+		outdir := filepath.Join(root, vendorDir)
+		var manifest BundleManifest
+		tr := tar.NewReader(gzr)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return err
+			}
+
+			if hdr.Name == bundleManifestName {
+				if err := json.NewDecoder(tr).Decode(&manifest); err != nil {
+					return fmt.Errorf("reading bundle manifest: %s", err)
+				}
+				continue
+			}
+
+			if err := untarEntry(tr, hdr, outdir); err != nil {
+				return err
+			}
+		}
+
+		for _, dep := range manifest.Packages {
+			if _, err := os.Stat(filepath.Join(outdir, dep.Hash, dep.Name)); err != nil {
+				return fmt.Errorf("bundle is missing %s (%s)", dep.Name, dep.Hash)
+			}
+		}
+
+		if jsonOutput {
+			return printJSON(map[string]interface{}{"dir": outdir, "packages": manifest.Packages})
+		}
+		Log("restored %d packages into %s", len(manifest.Packages), outdir)
+		return nil
+	},
+}
+
+// tarDir writes the contents of `dir` to `tw` under the name `prefix`.
+// Symlinks are followed so linked packages are bundled by content.
+func tarDir(tw *tar.Writer, dir, prefix string) error {
+	return filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(filepath.Join(prefix, rel))
+
+		if fi.Mode()&os.ModeSymlink != 0 {
+			target, err := filepath.EvalSymlinks(p)
+			if err != nil {
+				return err
+			}
+			return tarDir(tw, target, name)
+		}
+
+		hdr, err := tar.FileInfoHeader(fi, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = name
+		if fi.IsDir() {
+			hdr.Name += "/"
+		}
+		normalizeHeader(hdr, fi)
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		_, err = io.Copy(tw, f)
+		return err
+	})
+}
+
+// normalizeHeader clears what tells where and when the file of `hdr` was
+// installed, so that bundles of the same packages are identical.
+func normalizeHeader(hdr *tar.Header, fi os.FileInfo) {
+	hdr.Mode = int64(canonicalMode(fi))
+	hdr.ModTime = reproducibleTime()
+	hdr.AccessTime = time.Time{}
+	hdr.ChangeTime = time.Time{}
+	hdr.Uid, hdr.Gid = 0, 0
+	hdr.Uname, hdr.Gname = "", ""
+}
+
+func untarEntry(tr *tar.Reader, hdr *tar.Header, outdir string) error {
+	p := filepath.Join(outdir, filepath.FromSlash(hdr.Name))
+	if !strings.HasPrefix(p, filepath.Clean(outdir)+string(os.PathSeparator)) {
+		return fmt.Errorf("invalid path in bundle: %s", hdr.Name)
+	}
+
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		return os.MkdirAll(p, 0755)
+	case tar.TypeReg:
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			return err
+		}
+
+		f, err := os.OpenFile(p, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, os.FileMode(hdr.Mode)|0200)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		_, err = io.Copy(f, tr)
+		return err
+	default:
+		VLog("skipping unsupported bundle entry %s", hdr.Name)
+		return nil
+	}
+}
@@ -0,0 +1,409 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	mh "github.com/multiformats/go-multihash"
+)
+
+// Packages fetched from gateways are downloaded as CAR archives, whose
+// blocks are each checked against their cid, and whose unixfs tree is
+// then extracted from the hash requested. A gateway can withhold content
+// but not alter it.
+
+const (
+	codecRaw    = 0x55
+	codecDagPb  = 0x70
+	maxCARBlock = 4 << 20
+
+	unixfsRaw       = 0
+	unixfsDirectory = 1
+	unixfsFile      = 2
+	unixfsSymlink   = 4
+)
+
+// cidBytes returns the binary form of the cid `s`, as CAR archives and
+// dag-pb links hold them.
+func cidBytes(s string) ([]byte, error) {
+	if strings.HasPrefix(s, "Qm") {
+		h, err := mh.FromB58String(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid hash %q: %s", s, err)
+		}
+		return h, nil
+	}
+	if !strings.HasPrefix(s, "b") {
+		return nil, fmt.Errorf("invalid hash %q", s)
+	}
+	data, err := cidBase32.DecodeString(s[1:])
+	if err != nil {
+		return nil, fmt.Errorf("invalid hash %q: %s", s, err)
+	}
+	return data, nil
+}
+
+// splitCid returns the codec and the multihash of the binary cid `c`, and
+// its length.
+func splitCid(c []byte) (uint64, mh.Multihash, int, error) {
+	// v0 cids are bare sha2-256 multihashes of dag-pb blocks
+	if len(c) >= 34 && c[0] == mh.SHA2_256 && c[1] == 32 {
+		return codecDagPb, mh.Multihash(c[:34]), 34, nil
+	}
+
+	version, n := binary.Uvarint(c)
+	if n <= 0 || version != 1 {
+		return 0, nil, 0, fmt.Errorf("unsupported cid version")
+	}
+	codec, m := binary.Uvarint(c[n:])
+	if m <= 0 {
+		return 0, nil, 0, fmt.Errorf("invalid cid codec")
+	}
+	start := n + m
+	_, k := binary.Uvarint(c[start:])
+	if k <= 0 {
+		return 0, nil, 0, fmt.Errorf("invalid cid multihash")
+	}
+	length, l := binary.Uvarint(c[start+k:])
+	if l <= 0 || uint64(len(c)-start-k-l) < length {
+		return 0, nil, 0, fmt.Errorf("truncated cid multihash")
+	}
+	end := start + k + l + int(length)
+	return codec, mh.Multihash(c[start:end]), end, nil
+}
+
+// verifyBlock checks that `data` is the content addressed by the multihash
+// `h`.
+func verifyBlock(h mh.Multihash, data []byte) error {
+	dh, err := mh.Decode(h)
+	if err != nil {
+		return err
+	}
+	sum, err := mh.Sum(data, dh.Code, dh.Length)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(sum, h) {
+		return fmt.Errorf("block doesn't match its hash %s", h.B58String())
+	}
+	return nil
+}
+
+// readCAR reads the blocks of the CAR archive `r`, by binary cid, checking
+// each of them against its cid.
+func readCAR(r io.Reader) (map[string][]byte, error) {
+	br := bufio.NewReader(r)
+
+	// the header only lists the roots, the content is walked from the
+	// hash requested instead
+	hlen, err := binary.ReadUvarint(br)
+	if err != nil {
+		return nil, fmt.Errorf("reading the car header: %s", err)
+	}
+	if hlen > maxCARBlock {
+		return nil, fmt.Errorf("car header too large")
+	}
+	if _, err := io.CopyN(ioutil.Discard, br, int64(hlen)); err != nil {
+		return nil, fmt.Errorf("reading the car header: %s", err)
+	}
+
+	blocks := make(map[string][]byte)
+	for {
+		slen, err := binary.ReadUvarint(br)
+		if err == io.EOF {
+			return blocks, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if slen > maxCARBlock {
+			return nil, fmt.Errorf("car block too large")
+		}
+
+		section := make([]byte, slen)
+		if _, err := io.ReadFull(br, section); err != nil {
+			return nil, fmt.Errorf("truncated car: %s", err)
+		}
+		_, h, n, err := splitCid(section)
+		if err != nil {
+			return nil, err
+		}
+		if err := verifyBlock(h, section[n:]); err != nil {
+			return nil, err
+		}
+		blocks[string(section[:n])] = section[n:]
+	}
+}
+
+// pbLink is a link of a dag-pb node.
+type pbLink struct {
+	Hash []byte
+	Name string
+}
+
+// protoFields calls `fn` on the fields of the protobuf message `b`, with
+// the value of varint fields and the content of length-delimited ones.
+func protoFields(b []byte, fn func(field int, v uint64, data []byte) error) error {
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			return fmt.Errorf("invalid protobuf key")
+		}
+		b = b[n:]
+
+		var v uint64
+		var data []byte
+		switch key & 7 {
+		case 0:
+			v, n = binary.Uvarint(b)
+			if n <= 0 {
+				return fmt.Errorf("invalid protobuf varint")
+			}
+			b = b[n:]
+		case 2:
+			l, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < l {
+				return fmt.Errorf("invalid protobuf length")
+			}
+			data = b[n : n+int(l)]
+			b = b[n+int(l):]
+		default:
+			return fmt.Errorf("unsupported protobuf wire type %d", key&7)
+		}
+		if err := fn(int(key>>3), v, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// decodeDagPb returns the links and the data of the dag-pb node `b`.
+func decodeDagPb(b []byte) ([]pbLink, []byte, error) {
+	var links []pbLink
+	var data []byte
+	err := protoFields(b, func(field int, _ uint64, v []byte) error {
+		switch field {
+		case 1:
+			data = v
+		case 2:
+			var l pbLink
+			err := protoFields(v, func(field int, _ uint64, v []byte) error {
+				switch field {
+				case 1:
+					l.Hash = v
+				case 2:
+					l.Name = string(v)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			links = append(links, l)
+		}
+		return nil
+	})
+	return links, data, err
+}
+
+// unixfsNode is the unixfs data of a dag-pb node.
+type unixfsNode struct {
+	Type uint64
+	Data []byte
+	Mode uint64
+}
+
+func decodeUnixfs(b []byte) (*unixfsNode, error) {
+	n := new(unixfsNode)
+	err := protoFields(b, func(field int, v uint64, data []byte) error {
+		switch field {
+		case 1:
+			n.Type = v
+		case 2:
+			n.Data = data
+		case 7:
+			n.Mode = v
+		}
+		return nil
+	})
+	return n, err
+}
+
+// carExtractor writes the unixfs tree of verified blocks to `root`.
+type carExtractor struct {
+	blocks map[string][]byte
+	root   string
+}
+
+// extractCAR extracts the content `hash` from the CAR archive `r` into
+// `dir`, which must not exist.
+func extractCAR(r io.Reader, hash, dir string) error {
+	c, err := cidBytes(hash)
+	if err != nil {
+		return err
+	}
+	blocks, err := readCAR(r)
+	if err != nil {
+		return err
+	}
+
+	x := &carExtractor{blocks: blocks, root: dir}
+	if err := x.extract(c, dir); err != nil {
+		return err
+	}
+	return checkSymlinks(dir)
+}
+
+// checkSymlinks checks that the symlinks under `root` resolve under it, as
+// the lexical check of each target misses links through other links.
+func checkSymlinks(root string) error {
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return err
+	}
+	return filepath.Walk(root, func(p string, fi os.FileInfo, err error) error {
+		if err != nil || fi.Mode()&os.ModeSymlink == 0 {
+			return err
+		}
+		resolved, err := filepath.EvalSymlinks(p)
+		if err != nil {
+			// dangling, its target was checked lexically, but may go
+			// through other links
+			target, _ := os.Readlink(p)
+			if strings.Contains(target, "..") {
+				return fmt.Errorf("dangling symlink %s points to %s", p, target)
+			}
+			return nil
+		}
+		rel, err := filepath.Rel(realRoot, resolved)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("symlink %s points out of the package", p)
+		}
+		return nil
+	})
+}
+
+// block returns the codec and the content of the block `c`.
+func (x *carExtractor) block(c []byte) (uint64, []byte, error) {
+	codec, h, _, err := splitCid(c)
+	if err != nil {
+		return 0, nil, err
+	}
+	if data, ok := x.blocks[string(c)]; ok {
+		return codec, data, nil
+	}
+	if dh, err := mh.Decode(h); err == nil && dh.Code == mh.IDENTITY {
+		return codec, dh.Digest, nil
+	}
+	return 0, nil, fmt.Errorf("block %s missing from the car", h.B58String())
+}
+
+// node returns the links and unixfs data of the dag-pb block `c`, or the
+// content of the raw block `c` as a file.
+func (x *carExtractor) node(c []byte) ([]pbLink, *unixfsNode, error) {
+	codec, data, err := x.block(c)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch codec {
+	case codecRaw:
+		return nil, &unixfsNode{Type: unixfsRaw, Data: data}, nil
+	case codecDagPb:
+		links, pbdata, err := decodeDagPb(data)
+		if err != nil {
+			return nil, nil, err
+		}
+		fsn, err := decodeUnixfs(pbdata)
+		if err != nil {
+			return nil, nil, err
+		}
+		return links, fsn, nil
+	default:
+		return nil, nil, fmt.Errorf("unsupported codec 0x%x", codec)
+	}
+}
+
+func (x *carExtractor) extract(c []byte, p string) error {
+	links, fsn, err := x.node(c)
+	if err != nil {
+		return err
+	}
+
+	switch fsn.Type {
+	case unixfsDirectory:
+		if err := os.Mkdir(p, 0755); err != nil {
+			return err
+		}
+		for _, l := range links {
+			if l.Name == "" || l.Name == "." || l.Name == ".." || strings.ContainsAny(l.Name, `/\`) {
+				return fmt.Errorf("invalid name %q in the package", l.Name)
+			}
+			if err := x.extract(l.Hash, filepath.Join(p, l.Name)); err != nil {
+				return err
+			}
+		}
+		return nil
+	case unixfsRaw, unixfsFile:
+		mode := os.FileMode(0644)
+		if fsn.Mode&0111 != 0 {
+			mode = 0755
+		}
+		// exclusive, never writing through an existing path
+		f, err := os.OpenFile(p, os.O_CREATE|os.O_EXCL|os.O_WRONLY, mode)
+		if err != nil {
+			return err
+		}
+		err = x.writeFile(f, links, fsn)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		return err
+	case unixfsSymlink:
+		target := string(fsn.Data)
+		if !symlinkInside(x.root, p, target) {
+			return fmt.Errorf("symlink %s points out of the package: %s", p, target)
+		}
+		return os.Symlink(target, p)
+	default:
+		return fmt.Errorf("unsupported unixfs node type %d at %s", fsn.Type, p)
+	}
+}
+
+// writeFile writes the content of the file node `fsn` to `w`, followed by
+// that of its chunks.
+func (x *carExtractor) writeFile(w io.Writer, links []pbLink, fsn *unixfsNode) error {
+	if _, err := w.Write(fsn.Data); err != nil {
+		return err
+	}
+	for _, l := range links {
+		clinks, cfsn, err := x.node(l.Hash)
+		if err != nil {
+			return err
+		}
+		if cfsn.Type != unixfsRaw && cfsn.Type != unixfsFile {
+			return fmt.Errorf("invalid file chunk of type %d", cfsn.Type)
+		}
+		if err := x.writeFile(w, clinks, cfsn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// symlinkInside returns whether the symlink `p` to `target` resolves to a
+// path under `root`.
+func symlinkInside(root, p, target string) bool {
+	if target == "" || filepath.IsAbs(target) || filepath.VolumeName(target) != "" {
+		return false
+	}
+	resolved := filepath.Join(filepath.Dir(p), target)
+	rel, err := filepath.Rel(root, resolved)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
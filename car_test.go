@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	mh "github.com/multiformats/go-multihash"
+)
+
+func protoVarint(buf *bytes.Buffer, field int, v uint64) {
+	var b [binary.MaxVarintLen64]byte
+	buf.Write(b[:binary.PutUvarint(b[:], uint64(field<<3))])
+	buf.Write(b[:binary.PutUvarint(b[:], v)])
+}
+
+func protoBytes(buf *bytes.Buffer, field int, data []byte) {
+	var b [binary.MaxVarintLen64]byte
+	buf.Write(b[:binary.PutUvarint(b[:], uint64(field<<3|2))])
+	buf.Write(b[:binary.PutUvarint(b[:], uint64(len(data)))])
+	buf.Write(data)
+}
+
+// testDag builds dag-pb blocks as ipfs add would, by v0 cid.
+type testDag struct {
+	blocks [][]byte
+	cids   [][]byte
+}
+
+func (d *testDag) add(typ uint64, data []byte, mode uint64, links ...pbLink) []byte {
+	var fsn bytes.Buffer
+	protoVarint(&fsn, 1, typ)
+	if data != nil {
+		protoBytes(&fsn, 2, data)
+	}
+	if mode != 0 {
+		protoVarint(&fsn, 7, mode)
+	}
+
+	var node bytes.Buffer
+	for _, l := range links {
+		var lb bytes.Buffer
+		protoBytes(&lb, 1, l.Hash)
+		protoBytes(&lb, 2, []byte(l.Name))
+		protoBytes(&node, 2, lb.Bytes())
+	}
+	protoBytes(&node, 1, fsn.Bytes())
+
+	c, err := mh.Sum(node.Bytes(), mh.SHA2_256, -1)
+	if err != nil {
+		panic(err)
+	}
+	d.blocks = append(d.blocks, node.Bytes())
+	d.cids = append(d.cids, c)
+	return c
+}
+
+func (d *testDag) car() []byte {
+	var car bytes.Buffer
+	var b [binary.MaxVarintLen64]byte
+	header := []byte("header")
+	car.Write(b[:binary.PutUvarint(b[:], uint64(len(header)))])
+	car.Write(header)
+	for i, block := range d.blocks {
+		car.Write(b[:binary.PutUvarint(b[:], uint64(len(d.cids[i])+len(block)))])
+		car.Write(d.cids[i])
+		car.Write(block)
+	}
+	return car.Bytes()
+}
+
+// testPackage builds the dag of a package holding a chunked package.json,
+// an executable script and a link named `link` to `target`.
+func testPackage(target string) (*testDag, string) {
+	d := new(testDag)
+	c1 := d.add(unixfsFile, []byte(`{"name":`), 0)
+	c2 := d.add(unixfsFile, []byte(`"pkg"}`), 0)
+	pj := d.add(unixfsFile, nil, 0, pbLink{Hash: c1}, pbLink{Hash: c2})
+	run := d.add(unixfsFile, []byte("#!/bin/sh\n"), 0755)
+	link := d.add(unixfsSymlink, []byte(target), 0)
+	pkg := d.add(unixfsDirectory, nil, 0,
+		pbLink{Hash: link, Name: "link"},
+		pbLink{Hash: pj, Name: "package.json"},
+		pbLink{Hash: run, Name: "run.sh"})
+	root := d.add(unixfsDirectory, nil, 0, pbLink{Hash: pkg, Name: "pkg"})
+	return d, mh.Multihash(root).B58String()
+}
+
+func TestExtractCAR(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "gx-go-car")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	d, hash := testPackage("package.json")
+	dir := filepath.Join(tmp, "out")
+	if err := extractCAR(bytes.NewReader(d.car()), hash, dir); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "pkg", "link"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != `{"name":"pkg"}` {
+		t.Errorf("package.json is %q", data)
+	}
+	fi, err := os.Stat(filepath.Join(dir, "pkg", "run.sh"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode()&0100 == 0 {
+		t.Errorf("run.sh lost its executable bit: %s", fi.Mode())
+	}
+}
+
+func TestExtractCARRejects(t *testing.T) {
+	tampered, hash := testPackage("package.json")
+	tampered.blocks[0] = []byte("not the content hashed")
+
+	missing, missingHash := testPackage("package.json")
+	missing.blocks = missing.blocks[1:]
+	missing.cids = missing.cids[1:]
+
+	escaping, escapingHash := testPackage("../../outside")
+	absolute, absoluteHash := testPackage("/etc/passwd")
+
+	cases := []struct {
+		name string
+		dag  *testDag
+		hash string
+		err  string
+	}{
+		{"tampered block", tampered, hash, "doesn't match its hash"},
+		{"missing block", missing, missingHash, "missing from the car"},
+		{"escaping symlink", escaping, escapingHash, "points out of the package"},
+		{"absolute symlink", absolute, absoluteHash, "points out of the package"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			tmp, err := ioutil.TempDir("", "gx-go-car")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(tmp)
+
+			err = extractCAR(bytes.NewReader(c.dag.car()), c.hash, filepath.Join(tmp, "out"))
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Fatalf("got error %v, want %q", err, c.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	cli "github.com/urfave/cli"
+	gx "github.com/whyrusleeping/gx/gxutil"
+)
+
+var ChangelogCommand = cli.Command{
+	Name:      "changelog",
+	Usage:     "print the upstream commit log between two versions of a dependency",
+	ArgsUsage: "[dep] [candidate hash]",
+	Description: `changelog looks up the upstream commits recorded in the package.json
+of the current version of 'dep' and of the candidate version, and prints
+the git log between the two from the upstream repository in GOPATH.
+
+Both versions must have been published with their upstream commit
+recorded under 'gx.dvcscommit'.`,
+	Action: func(c *cli.Context) error {
+		if len(c.Args()) < 2 {
+			return fmt.Errorf("must specify a dependency and a candidate hash")
+		}
+
+		pkg, err := LoadPackageFile(gx.PkgFileName)
+		if err != nil {
+			return err
+		}
+
+		dep := pkg.FindDep(c.Args()[0])
+		if dep == nil {
+			return fmt.Errorf("%s not found", c.Args()[0])
+		}
+
+		cur, _, err := fetchPackageByHash(dep.Hash)
+		if err != nil {
+			return err
+		}
+
+		next, _, err := fetchPackageByHash(c.Args()[1])
+		if err != nil {
+			return err
+		}
+
+		if cur.Gx.DvcsCommit == "" {
+			return fmt.Errorf("no upstream commit recorded for %s (%s)", dep.Name, dep.Hash)
+		}
+		if next.Gx.DvcsCommit == "" {
+			return fmt.Errorf("no upstream commit recorded for %s (%s)", next.Name, c.Args()[1])
+		}
+
+		repo, err := upstreamRepo(next.Gx.DvcsImport)
+		if err != nil {
+			return err
+		}
+
+		VLog("  - running git log in %s", repo)
+		revs := cur.Gx.DvcsCommit + ".." + next.Gx.DvcsCommit
+		if jsonOutput {
+			out, err := gitOutput(repo, "log", "--no-merges", "--format=%H%x09%s", revs)
+			if err != nil {
+				return err
+			}
+
+			commits := []changelogCommit{}
+			for _, line := range strings.Split(out, "\n") {
+				if parts := strings.SplitN(line, "\t", 2); len(parts) == 2 {
+					commits = append(commits, changelogCommit{Commit: parts[0], Subject: parts[1]})
+				}
+			}
+			return printJSON(commits)
+		}
+
+		cmd := exec.Command("git", "log", "--oneline", "--no-merges", revs)
+		cmd.Dir = repo
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("git log failed: %s", err)
+		}
+
+		return nil
+	},
+}
+
+// changelogCommit is an upstream commit, as changelog prints it with
+// --json.
+type changelogCommit struct {
+	Commit  string `json:"commit"`
+	Subject string `json:"subject"`
+}
+
+// upstreamRepo returns the directory of the upstream checkout of `dvcsimp`
+// in GOPATH, fetching it if needed.
+func upstreamRepo(dvcsimp string) (string, error) {
+	if dvcsimp == "" {
+		return "", fmt.Errorf("package has no dvcs import set")
+	}
+
+	repo := goPathSrc(dvcsimp)
+	if _, err := os.Stat(repo); os.IsNotExist(err) {
+		if err := goGetPackage(dvcsimp); err != nil {
+			return "", err
+		}
+	}
+
+	fetch := command("git", "fetch", "--quiet", "--tags")
+	fetch.Dir = repo
+	fetch.Stderr = os.Stderr
+	if err := fetch.Run(); err != nil {
+		VLog("git fetch in %s failed: %s", repo, err)
+	}
+
+	return repo, nil
+}
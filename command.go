@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	gx "github.com/whyrusleeping/gx/gxutil"
+)
+
+// cmdTimeout is how long the go, gx and gx-go commands we spawn may run
+// before they are killed, set by the global --timeout flag. Zero means no
+// limit.
+var cmdTimeout time.Duration
+
+// timedCmd is a command killed if it runs for longer than cmdTimeout.
+type timedCmd struct {
+	*exec.Cmd
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// command returns a timedCmd running `name` with `args`. One of its Run,
+// Output or CombinedOutput methods must be called to release its timer.
+func command(name string, args ...string) *timedCmd {
+	ctx, cancel := context.Background(), context.CancelFunc(func() {})
+	if cmdTimeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, cmdTimeout)
+	}
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Env = childEnv()
+	return &timedCmd{
+		Cmd:    cmd,
+		ctx:    ctx,
+		cancel: cancel,
+	}
+}
+
+// forceMinimal is set by import --minimal, for the packages the commands it
+// spawns install to be stripped too.
+var forceMinimal bool
+
+// childSettings are the settings of this gx-go passed to the gx-go
+// commands the commands it spawns may run, as environment variables.
+func childSettings() [][2]string {
+	s := [][2]string{
+		{"GX_GO_RETRIES", strconv.Itoa(retries)},
+		{"GX_GO_TIMEOUT", cmdTimeout.String()},
+	}
+	if quiet {
+		s = append(s, [2]string{"GX_GO_QUIET", "1"})
+	}
+	if forceMinimal {
+		s = append(s, [2]string{"GX_GO_MINIMAL", "1"})
+	}
+	return s
+}
+
+// childEnv returns the environment of the commands we spawn.
+func childEnv() []string {
+	env := os.Environ()
+	for _, kv := range childSettings() {
+		env = withEnv(env, kv[0], kv[1])
+	}
+	return env
+}
+
+var (
+	hookEnvMu    sync.Mutex
+	hookEnvUsers int
+	hookEnvPrev  map[string]*string
+)
+
+// hookEnv sets the child settings, and the version of the gx library, in
+// the environment until the returned function is called. The gx library
+// runs hooks in-process, so they can't be given an environment as the
+// commands we spawn are. Overlapping callers share the same settings.
+func hookEnv() func() {
+	hookEnvMu.Lock()
+	defer hookEnvMu.Unlock()
+
+	if hookEnvUsers == 0 {
+		hookEnvPrev = make(map[string]*string)
+		set := append(childSettings(), [2]string{gxVersionEnv, gx.GxVersion})
+		for _, kv := range set {
+			if prev, ok := os.LookupEnv(kv[0]); ok {
+				hookEnvPrev[kv[0]] = &prev
+			} else {
+				hookEnvPrev[kv[0]] = nil
+			}
+			os.Setenv(kv[0], kv[1])
+		}
+	}
+	hookEnvUsers++
+
+	return func() {
+		hookEnvMu.Lock()
+		defer hookEnvMu.Unlock()
+
+		hookEnvUsers--
+		if hookEnvUsers > 0 {
+			return
+		}
+		for key, prev := range hookEnvPrev {
+			if prev != nil {
+				os.Setenv(key, *prev)
+			} else {
+				os.Unsetenv(key)
+			}
+		}
+	}
+}
+
+func (c *timedCmd) Run() error {
+	defer c.cancel()
+	return c.check(c.Cmd.Run())
+}
+
+func (c *timedCmd) Output() ([]byte, error) {
+	defer c.cancel()
+	out, err := c.Cmd.Output()
+	return out, c.check(err)
+}
+
+func (c *timedCmd) CombinedOutput() ([]byte, error) {
+	defer c.cancel()
+	out, err := c.Cmd.CombinedOutput()
+	return out, c.check(err)
+}
+
+// check replaces the error of a command that was killed for running too
+// long with one saying so.
+func (c *timedCmd) check(err error) error {
+	if err != nil && c.ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("%s timed out after %s and was killed", strings.Join(c.Args, " "), cmdTimeout)
+	}
+	return err
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"time"
+
+	homedir "github.com/mitchellh/go-homedir"
+	cli "github.com/urfave/cli"
+	gx "github.com/whyrusleeping/gx/gxutil"
+)
+
+// gxCompatRange are the versions of gx whose hooks (install-path,
+// post-install --global, req-check, test...) and package.json fields this
+// gx-go supports, as a constraint for goVersionMatches.
+const gxCompatRange = ">=0.12 <0.15"
+
+// gxVersionEnv is set to the version of the gx library installing
+// packages in-process, for the hooks it runs not to look for gx.
+const gxVersionEnv = "GX_GO_GX_VERSION"
+
+// gxVersionCache remembers the version of the gx binary, as it is run for
+// every hook.
+const gxVersionCache = "~/.cache/gx-go/gx-version.json"
+
+type cachedGxVersion struct {
+	Path    string    `json:"path"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+	Version string    `json:"version"`
+}
+
+// installedGxVersion returns the version of the gx binary found in PATH,
+// or the one running gx-go's hooks in-process.
+func installedGxVersion() (string, error) {
+	if v := os.Getenv(gxVersionEnv); v != "" {
+		return v, nil
+	}
+
+	bin, err := exec.LookPath("gx")
+	if err != nil {
+		return "", fmt.Errorf("gx is not installed")
+	}
+	fi, err := os.Stat(bin)
+	if err != nil {
+		return "", err
+	}
+
+	cachePath, err := homedir.Expand(gxVersionCache)
+	if err != nil {
+		return "", err
+	}
+	var cached cachedGxVersion
+	if data, err := ioutil.ReadFile(cachePath); err == nil {
+		if json.Unmarshal(data, &cached) == nil && cached.Path == bin &&
+			cached.Size == fi.Size() && cached.ModTime.Equal(fi.ModTime()) {
+			return cached.Version, nil
+		}
+	}
+
+	out, err := command(bin, "--version").Output()
+	if err != nil {
+		return "", fmt.Errorf("running gx --version: %s", err)
+	}
+	v := toolVersionRE.FindString(string(out))
+	if v == "" {
+		return "", fmt.Errorf("unrecognized output from gx --version: %q", out)
+	}
+
+	cached = cachedGxVersion{Path: bin, Size: fi.Size(), ModTime: fi.ModTime(), Version: v}
+	if data, err := json.Marshal(cached); err == nil {
+		if os.MkdirAll(filepath.Dir(cachePath), 0755) == nil {
+			ioutil.WriteFile(cachePath, data, 0644)
+		}
+	}
+	return v, nil
+}
+
+// checkGxCompat checks that the installed gx is one gx-go works with and,
+// if `pkg` is set, that it wasn't written by a gx newer than the gx
+// library gx-go is built with.
+func checkGxCompat(pkg *Package) ([]reqResult, error) {
+	have, err := installedGxVersion()
+	if err != nil {
+		return nil, err
+	}
+	ok, err := goVersionMatches(have, gxCompatRange)
+	if err != nil {
+		return nil, err
+	}
+	r := reqResult{Requirement: "gx " + gxCompatRange, Found: have, Satisfied: ok}
+	if !ok {
+		r.Message = fmt.Sprintf("gx-go %s works with gx %s, you have gx %s installed: update gx-go or install a matching gx", gxGoVersion, gxCompatRange, have)
+	}
+	results := []reqResult{r}
+
+	if pkg != nil && pkg.GxVersion != "" {
+		newer, err := goVersionMatches(pkg.GxVersion, ">"+gx.GxVersion)
+		if err != nil {
+			return nil, fmt.Errorf("package.json gxVersion: %s", err)
+		}
+		r := reqResult{Requirement: "package.json from gx <=" + gx.GxVersion, Found: pkg.GxVersion, Satisfied: !newer}
+		if newer {
+			r.Message = fmt.Sprintf("package '%s' was written by gx %s, newer than the gx %s gx-go is built with, so some of its fields may be ignored: update gx-go", pkg.Name, pkg.GxVersion, gx.GxVersion)
+		}
+		results = append(results, r)
+	}
+	return results, nil
+}
+
+// warnGxCompat warns about the incompatibilities checkGxCompat finds, for
+// hooks run by a gx that may not call them as expected.
+func warnGxCompat() {
+	var pkg *Package
+	if root, err := gx.GetPackageRoot(); err == nil {
+		pkg, _ = LoadPackageFile(filepath.Join(root, gx.PkgFileName))
+	}
+
+	results, err := checkGxCompat(pkg)
+	if err != nil {
+		VLog("checking the gx version: %s", err)
+		return
+	}
+	for _, r := range results {
+		if !r.Satisfied {
+			Warn("%s", r.Message)
+		}
+	}
+}
+
+var VersionCommand = cli.Command{
+	Name:  "version",
+	Usage: "print the versions of gx-go and of the gx it works with",
+	Description: `version prints the version of gx-go, of go and of the gx library it was
+built with, and the versions of gx it works with.
+
+With --check, it also checks that the installed gx is one of those, and
+that the current package wasn't written by a newer gx, exiting with an
+error otherwise. Hooks warn about the same problems when gx runs them.`,
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "check",
+			Usage: "check that the installed gx and the current package are compatible",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		out := struct {
+			GxGo      string      `json:"gxGo"`
+			Go        string      `json:"go"`
+			GxLibrary string      `json:"gxLibrary"`
+			Gx        string      `json:"gx"`
+			Checks    []reqResult `json:"checks,omitempty"`
+		}{
+			GxGo:      gxGoVersion,
+			Go:        runtime.Version(),
+			GxLibrary: gx.GxVersion,
+			Gx:        gxCompatRange,
+		}
+
+		if c.Bool("check") {
+			var pkg *Package
+			if root, err := gx.GetPackageRoot(); err == nil {
+				pkg, err = LoadPackageFile(filepath.Join(root, gx.PkgFileName))
+				if err != nil {
+					return err
+				}
+			}
+			checks, err := checkGxCompat(pkg)
+			if err != nil {
+				return err
+			}
+			out.Checks = checks
+		}
+
+		if jsonOutput {
+			if err := printJSON(out); err != nil {
+				return err
+			}
+		} else {
+			fmt.Printf("gx-go %s\n", out.GxGo)
+			fmt.Printf("built with %s and the gx %s library\n", out.Go, out.GxLibrary)
+			fmt.Printf("works with gx %s\n", out.Gx)
+			for _, r := range out.Checks {
+				status := "ok"
+				if !r.Satisfied {
+					status = "FAILED"
+				}
+				fmt.Printf("%s: %s (found %s)\n", r.Requirement, status, r.Found)
+			}
+		}
+
+		for _, r := range out.Checks {
+			if !r.Satisfied {
+				return fmt.Errorf("%s", r.Message)
+			}
+		}
+		return nil
+	},
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	homedir "github.com/mitchellh/go-homedir"
+	gx "github.com/whyrusleeping/gx/gxutil"
+)
+
+const (
+	userConfigPath = "~/.config/gx-go.json"
+	repoConfigName = ".gx-go.json"
+)
+
+// Config holds defaults for settings otherwise given by flags or env vars.
+// The per-user config is loaded first, and the fields set in the config at
+// the root of the current package override it, except for the ones that
+// are only read from the user config.
+type Config struct {
+	// VendorDir is the directory packages are installed into locally,
+	// relative to the package root.
+	VendorDir string `json:"vendorDir,omitempty"`
+
+	// RewriteExcludes are patterns of paths, relative to the package root,
+	// whose imports are never rewritten.
+	RewriteExcludes []string `json:"rewriteExcludes,omitempty"`
+
+	// Concurrency bounds the number of packages processed in parallel.
+	Concurrency int `json:"concurrency,omitempty"`
+
+	// IpfsAPI is the ipfs api endpoint to use if IPFS_API is not set. Only
+	// read from the user config.
+	IpfsAPI string `json:"ipfsApi,omitempty"`
+
+	// Gateways are the ipfs http gateways packages are fetched from, in
+	// order, when fetching them through gx fails. Only read from the user
+	// config.
+	Gateways []string `json:"gateways,omitempty"`
+
+	NonInteractive bool `json:"nonInteractive,omitempty"`
+
+	// ModCache fetches dvcs sources through the go module cache.
+	ModCache bool `json:"modCache,omitempty"`
+
+	// ImportExcludes are patterns of import paths never imported into gx.
+	ImportExcludes []string `json:"importExcludes,omitempty"`
+
+	// RepoRoots maps import path prefixes to the number of path elements
+	// of the repositories under them, e.g. {"example.com/go": 3}.
+	RepoRoots map[string]int `json:"repoRoots,omitempty"`
+
+	// GxIgnore are patterns added to the .gxignore of packages published by
+	// import, on top of Godeps/*.
+	GxIgnore []string `json:"gxIgnore,omitempty"`
+
+	// Overrides maps the repository import paths of dependencies to the
+	// metadata they get published with by import.
+	Overrides map[string]*PackageOverride `json:"overrides,omitempty"`
+
+	// HashFunction is the multihash function import and release publish
+	// packages with, such as blake2b-256.
+	HashFunction string `json:"hashFunction,omitempty"`
+
+	// Hooks maps gx hook events, such as post-install or pre-test, to shell
+	// commands run after gx-go's own handling of the event. They get the
+	// event as json on stdin. Only read from the user config.
+	Hooks map[string][]string `json:"hooks,omitempty"`
+
+	// PackageStore is the store packages are fetched into and installed
+	// from, and dedup links the files of installed packages to. Only read
+	// from the user config.
+	PackageStore string `json:"packageStore,omitempty"`
+
+	// MinimalVendor strips tests and test data from the packages installed
+	// locally.
+	MinimalVendor bool `json:"minimalVendor,omitempty"`
+
+	// Reproducible normalizes the modes and times of the packages
+	// installed locally.
+	Reproducible bool `json:"reproducible,omitempty"`
+}
+
+// PackageOverride is the metadata to publish an imported package with,
+// instead of prompting for it or taking it from upstream.
+type PackageOverride struct {
+	Name    string `json:"name,omitempty"`
+	Version string `json:"version,omitempty"`
+	License string `json:"license,omitempty"`
+}
+
+var config Config
+
+func loadConfig() error {
+	upath, err := homedir.Expand(userConfigPath)
+	if err != nil {
+		return err
+	}
+
+	root, err := gx.GetPackageRoot()
+	if err != nil {
+		root = cwd
+	}
+
+	var uc, rc Config
+	if err := loadConfigFile(upath, &uc); err != nil {
+		return err
+	}
+	rpath := filepath.Join(root, repoConfigName)
+	if err := loadConfigFile(rpath, &rc); err != nil {
+		return err
+	}
+	rc.dropUserOnly(rpath)
+
+	config.merge(&uc)
+	config.merge(&rc)
+
+	setVendorRoot(root)
+
+	if config.IpfsAPI != "" && os.Getenv("IPFS_API") == "" {
+		// picked up by gx.NewShell
+		os.Setenv("IPFS_API", config.IpfsAPI)
+	}
+	return nil
+}
+
+func loadConfigFile(p string, c *Config) error {
+	data, err := ioutil.ReadFile(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	VLog("loading config %s", p)
+	if err := json.Unmarshal(data, c); err != nil {
+		return fmt.Errorf("parsing config %s: %s", p, err)
+	}
+	return nil
+}
+
+// dropUserOnly clears the settings only read from the user config, as the
+// config of a package, which may have just been cloned, must not be able to
+// run commands or redirect where packages are fetched from and written to.
+func (c *Config) dropUserOnly(p string) {
+	var ignored []string
+	if c.Hooks != nil {
+		ignored = append(ignored, "hooks")
+		c.Hooks = nil
+	}
+	if c.PackageStore != "" {
+		ignored = append(ignored, "packageStore")
+		c.PackageStore = ""
+	}
+	if c.IpfsAPI != "" {
+		ignored = append(ignored, "ipfsApi")
+		c.IpfsAPI = ""
+	}
+	if c.Gateways != nil {
+		ignored = append(ignored, "gateways")
+		c.Gateways = nil
+	}
+	if len(ignored) > 0 {
+		Warn("ignoring %s in %s, set them in %s instead", strings.Join(ignored, ", "), p, userConfigPath)
+	}
+}
+
+// merge overrides the fields of `c` with the ones set in `o`.
+func (c *Config) merge(o *Config) {
+	if o.VendorDir != "" {
+		c.VendorDir = o.VendorDir
+	}
+	if o.RewriteExcludes != nil {
+		c.RewriteExcludes = o.RewriteExcludes
+	}
+	if o.Concurrency != 0 {
+		c.Concurrency = o.Concurrency
+	}
+	if o.IpfsAPI != "" {
+		c.IpfsAPI = o.IpfsAPI
+	}
+	if o.Gateways != nil {
+		c.Gateways = o.Gateways
+	}
+	if o.NonInteractive {
+		c.NonInteractive = true
+	}
+	if o.ModCache {
+		c.ModCache = true
+	}
+	if o.ImportExcludes != nil {
+		c.ImportExcludes = o.ImportExcludes
+	}
+	for prefix, depth := range o.RepoRoots {
+		if c.RepoRoots == nil {
+			c.RepoRoots = make(map[string]int)
+		}
+		c.RepoRoots[prefix] = depth
+	}
+	if o.GxIgnore != nil {
+		c.GxIgnore = o.GxIgnore
+	}
+	for imp, ov := range o.Overrides {
+		if c.Overrides == nil {
+			c.Overrides = make(map[string]*PackageOverride)
+		}
+		c.Overrides[imp] = ov
+	}
+	if o.HashFunction != "" {
+		c.HashFunction = o.HashFunction
+	}
+	if o.PackageStore != "" {
+		c.PackageStore = o.PackageStore
+	}
+	if o.MinimalVendor {
+		c.MinimalVendor = true
+	}
+	if o.Reproducible {
+		c.Reproducible = true
+	}
+	for event, cmds := range o.Hooks {
+		if c.Hooks == nil {
+			c.Hooks = make(map[string][]string)
+		}
+		c.Hooks[event] = cmds
+	}
+}
+
+// concurrency returns the configured concurrency, or the number of CPUs if
+// unset.
+func (c *Config) concurrency() int {
+	if c.Concurrency > 0 {
+		return c.Concurrency
+	}
+	return runtime.NumCPU()
+}
+
+// rewriteExcluded returns whether the file at `rel` (relative to the
+// package root) matches one of the configured rewrite excludes.
+func rewriteExcluded(rel string) bool {
+	rel = filepath.ToSlash(rel)
+	for _, pat := range config.RewriteExcludes {
+		if matchPathPattern(pat, rel) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchPathPattern returns whether the slash separated path `p`, or one of
+// its parent directories, matches the glob pattern `pat`.
+func matchPathPattern(pat, p string) bool {
+	pat = strings.TrimSuffix(pat, "/")
+	parts := strings.Split(p, "/")
+	for n := len(parts); n > 0; n-- {
+		if ok, _ := path.Match(pat, strings.Join(parts[:n], "/")); ok {
+			return true
+		}
+	}
+	return false
+}
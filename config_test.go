@@ -0,0 +1,32 @@
+package main
+
+import "testing"
+
+func TestMatchPathPattern(t *testing.T) {
+	matches := map[string][]string{
+		"testdata":      {"testdata", "testdata/a.go", "testdata/sub/a.go"},
+		"testdata/":     {"testdata/a.go"},
+		"examples/*.go": {"examples/a.go"},
+		"*/internal":    {"pkg/internal/a.go"},
+	}
+	misses := map[string][]string{
+		"testdata":      {"pkg/testdata/a.go", "testdata2/a.go"},
+		"examples/*.go": {"examples/sub/a.go"},
+		"vendor":        {"vendored/a.go"},
+	}
+
+	for pat, paths := range matches {
+		for _, p := range paths {
+			if !matchPathPattern(pat, p) {
+				t.Errorf("%q should match %q", pat, p)
+			}
+		}
+	}
+	for pat, paths := range misses {
+		for _, p := range paths {
+			if matchPathPattern(pat, p) {
+				t.Errorf("%q should not match %q", pat, p)
+			}
+		}
+	}
+}
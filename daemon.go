@@ -0,0 +1,299 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	cli "github.com/urfave/cli"
+	gx "github.com/whyrusleeping/gx/gxutil"
+)
+
+var DaemonCommand = cli.Command{
+	Name:  "daemon",
+	Usage: "serve the gx metadata of the package over a local http api",
+	Description: `daemon serves the gx metadata of the current package as json over http,
+on a local tcp address or a unix socket, so that editors and other tools
+can query it without walking the vendored packages each time:
+
+  GET /package              the package root and its package.json
+  GET /resolve?hash=<hash>  the dvcs import of the package with that hash
+  GET /resolve?import=<p>   the gx import path the import p is rewritten to
+  GET /rewrite-map          the rewrite map, dvcs imports to gx import paths
+  GET /rewrite-map?undo=1   the reverse rewrite map
+  GET /links                the packages linked with gx-go link, by hash
+  POST /reload              rebuild the rewrite maps
+
+The rewrite maps are built once and rebuilt when package.json or the lock
+file change.`,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "addr",
+			Usage: "tcp address to listen on",
+			Value: "127.0.0.1:7420",
+		},
+		cli.StringFlag{
+			Name:  "socket",
+			Usage: "unix socket to listen on instead of a tcp address",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		root, err := gx.GetPackageRoot()
+		if err != nil {
+			return err
+		}
+
+		d := &daemon{root: root}
+		if err := d.reload(); err != nil {
+			return err
+		}
+
+		var l net.Listener
+		if sock := c.String("socket"); sock != "" {
+			// a socket left behind by a daemon that didn't exit cleanly,
+			// anything else at that path is left alone
+			if fi, err := os.Lstat(sock); err == nil {
+				if fi.Mode()&os.ModeSocket == 0 {
+					return fmt.Errorf("%s exists and is not a socket", sock)
+				}
+				if err := os.Remove(sock); err != nil {
+					return err
+				}
+			}
+			l, err = net.Listen("unix", sock)
+		} else {
+			l, err = net.Listen("tcp", c.String("addr"))
+		}
+		if err != nil {
+			return err
+		}
+
+		srv := &http.Server{Handler: d.handler()}
+
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			<-sigs
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			srv.Shutdown(ctx)
+		}()
+
+		Log("serving %s on %s", root, l.Addr())
+		if err := srv.Serve(l); err != nil && err != http.ErrServerClosed {
+			return err
+		}
+		return nil
+	},
+}
+
+// daemon holds the gx metadata of the package at `root` served by the
+// daemon command.
+type daemon struct {
+	root string
+
+	mu      sync.Mutex
+	pkg     *Package
+	rwmap   map[string]string
+	undomap map[string]string
+	mtimes  map[string]time.Time
+}
+
+// reload loads package.json and rebuilds the rewrite maps.
+func (d *daemon) reload() error {
+	pkg, err := LoadPackageFile(filepath.Join(d.root, gx.PkgFileName))
+	if err != nil {
+		return err
+	}
+
+	pkgdir := filepath.Join(d.root, vendorDir)
+	rwmap := make(map[string]string)
+	if err := buildPackageRewriteMapping(pkg, d.root, pkgdir, rwmap, false); err != nil {
+		return fmt.Errorf("building the rewrite map: %s", err)
+	}
+	undomap := make(map[string]string)
+	if err := buildPackageRewriteMapping(pkg, d.root, pkgdir, undomap, true); err != nil {
+		return fmt.Errorf("building the rewrite map: %s", err)
+	}
+
+	d.pkg, d.rwmap, d.undomap = pkg, rwmap, undomap
+	d.mtimes = d.watchedMtimes()
+	VLog("loaded the rewrite map of %s: %d entries", pkg.Name, len(rwmap))
+	return nil
+}
+
+// watchedMtimes returns the modification times of the files whose changes
+// invalidate the rewrite maps.
+func (d *daemon) watchedMtimes() map[string]time.Time {
+	m := make(map[string]time.Time)
+	for _, name := range []string{gx.PkgFileName, gx.LckFileName} {
+		if fi, err := os.Stat(filepath.Join(d.root, name)); err == nil {
+			m[name] = fi.ModTime()
+		}
+	}
+	return m
+}
+
+// current reloads the metadata if it changed since it was loaded.
+func (d *daemon) current() error {
+	mtimes := d.watchedMtimes()
+	if len(mtimes) == len(d.mtimes) {
+		changed := false
+		for name, t := range mtimes {
+			if !d.mtimes[name].Equal(t) {
+				changed = true
+			}
+		}
+		if !changed {
+			return nil
+		}
+	}
+	VLog("package metadata changed, reloading")
+	return d.reload()
+}
+
+// daemonResolution is the response of the resolve endpoint.
+type daemonResolution struct {
+	Hash       string `json:"hash,omitempty"`
+	Name       string `json:"name,omitempty"`
+	DvcsImport string `json:"dvcsImport,omitempty"`
+	GxImport   string `json:"gxImport,omitempty"`
+}
+
+func (d *daemon) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/package", d.get(func(r *http.Request) (interface{}, int, error) {
+		return map[string]interface{}{
+			"root":    d.root,
+			"package": d.pkg,
+		}, http.StatusOK, nil
+	}))
+	mux.HandleFunc("/resolve", d.get(d.resolve))
+	mux.HandleFunc("/rewrite-map", d.get(func(r *http.Request) (interface{}, int, error) {
+		if undo := r.URL.Query().Get("undo"); undo != "" && undo != "0" && undo != "false" {
+			return d.undomap, http.StatusOK, nil
+		}
+		return d.rwmap, http.StatusOK, nil
+	}))
+	mux.HandleFunc("/links", d.get(func(r *http.Request) (interface{}, int, error) {
+		links, err := listLinkedPackages()
+		if err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+		out := make(map[string]string)
+		for _, link := range links {
+			out[link[0]] = link[1]
+		}
+		return out, http.StatusOK, nil
+	}))
+	mux.HandleFunc("/reload", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeDaemonError(w, http.StatusMethodNotAllowed, fmt.Errorf("reload must be posted"))
+			return
+		}
+		d.mu.Lock()
+		err := d.reload()
+		entries := len(d.rwmap)
+		d.mu.Unlock()
+		if err != nil {
+			writeDaemonError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeDaemonJSON(w, http.StatusOK, map[string]int{"entries": entries})
+	})
+	return mux
+}
+
+// get wraps the query `f` into a handler of GET requests, run on metadata
+// reloaded if it changed.
+func (d *daemon) get(f func(*http.Request) (interface{}, int, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeDaemonError(w, http.StatusMethodNotAllowed, fmt.Errorf("only GET is supported"))
+			return
+		}
+
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		if err := d.current(); err != nil {
+			writeDaemonError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		v, status, err := f(r)
+		if err != nil {
+			writeDaemonError(w, status, err)
+			return
+		}
+		writeDaemonJSON(w, status, v)
+	}
+}
+
+// resolve maps a package hash to its dvcs import, or a dvcs import path to
+// the gx import path it is rewritten to.
+func (d *daemon) resolve(r *http.Request) (interface{}, int, error) {
+	q := r.URL.Query()
+	switch {
+	case q.Get("hash") != "":
+		hash := q.Get("hash")
+		for gxImport, dvcs := range d.undomap {
+			parts := strings.SplitN(gxImport, "/", 4)
+			if len(parts) == 4 && sameHash(parts[2], hash) {
+				return daemonResolution{
+					Hash:       parts[2],
+					Name:       parts[3],
+					DvcsImport: dvcs,
+					GxImport:   gxImport,
+				}, http.StatusOK, nil
+			}
+		}
+		return nil, http.StatusNotFound, fmt.Errorf("no dependency with hash %s", hash)
+	case q.Get("import") != "":
+		imp := q.Get("import")
+		// the longest dvcs import the path is within
+		var best string
+		for dvcs := range d.rwmap {
+			if (imp == dvcs || strings.HasPrefix(imp, dvcs+"/")) && len(dvcs) > len(best) {
+				best = dvcs
+			}
+		}
+		if best == "" {
+			return nil, http.StatusNotFound, fmt.Errorf("no dependency provides %s", imp)
+		}
+
+		gxImport := d.rwmap[best]
+		parts := strings.SplitN(gxImport, "/", 4)
+		return daemonResolution{
+			Hash:       parts[2],
+			Name:       parts[3],
+			DvcsImport: best,
+			GxImport:   gxImport + strings.TrimPrefix(imp, best),
+		}, http.StatusOK, nil
+	default:
+		return nil, http.StatusBadRequest, fmt.Errorf("must specify a hash or an import")
+	}
+}
+
+func writeDaemonJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		VLog("writing the daemon response: %s", err)
+	}
+}
+
+func writeDaemonError(w http.ResponseWriter, status int, err error) {
+	writeDaemonJSON(w, status, map[string]string{"error": err.Error()})
+}
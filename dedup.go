@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	cli "github.com/urfave/cli"
+	gx "github.com/whyrusleeping/gx/gxutil"
+)
+
+var DedupCommand = cli.Command{
+	Name:      "dedup",
+	Usage:     "hardlink identical files of installed packages to save space",
+	ArgsUsage: "[package dir]...",
+	Description: `dedup replaces the files of the packages installed in the vendor
+directories of the given packages (the current one by default) with
+hardlinks to a shared content store, so that a dependency vendored by many
+projects only takes space once.
+
+The files are kept in the files directory of the package store (see gx-go
+store), which must be on the same filesystem as the packages. Installed
+packages are never modified in place, gx-go rewrites files by replacing
+them, so the links stay safe to share. The directory can be deleted at any
+time.`,
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "global",
+			Usage: "also deduplicate the globally installed packages",
+		},
+		cli.BoolFlag{
+			Name:  "dry-run",
+			Usage: "only report the space that would be saved",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		roots := []string(c.Args())
+		if len(roots) == 0 {
+			root, err := gx.GetPackageRoot()
+			if err != nil {
+				return err
+			}
+			roots = append(roots, root)
+		}
+
+		var dirs []string
+		for _, root := range roots {
+			dirs = append(dirs, filepath.Join(root, packageVendorRoot(root), "gx", "ipfs"))
+		}
+		if c.Bool("global") {
+			dirs = append(dirs, globalPath())
+		}
+
+		store, err := packageStore()
+		if err != nil {
+			return err
+		}
+
+		d := &deduper{store: filepath.Join(store, storeFilesDir), dryRun: c.Bool("dry-run"), seen: make(map[string]string)}
+		for _, dir := range dirs {
+			if err := d.dedupDir(dir); err != nil {
+				return err
+			}
+		}
+
+		if c.Bool("dry-run") {
+			Log("%d files could be linked, saving %s", d.linked, humanSize(d.saved))
+		} else {
+			Log("linked %d files, saving %s", d.linked, humanSize(d.saved))
+		}
+		return nil
+	},
+}
+
+// deduper links identical files to the entries of a content store.
+type deduper struct {
+	store  string
+	dryRun bool
+
+	// seen maps the keys of the files met in a dry run that are not in
+	// the store yet to the first one
+	seen map[string]string
+
+	linked int
+	saved  int64
+}
+
+// dedupDir links the regular files under `dir` to the store.
+func (d *deduper) dedupDir(dir string) error {
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		VLog("%s doesn't exist, skipping", dir)
+		return nil
+	}
+
+	VLog("deduplicating %s", dir)
+	return filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() || fi.Size() == 0 {
+			return nil
+		}
+		return d.dedupFile(p, fi)
+	})
+}
+
+// dedupFile replaces the file `p` with a link to the store entry of its
+// content, making it the entry if there is none yet.
+func (d *deduper) dedupFile(p string, fi os.FileInfo) error {
+	key, err := storeKey(p, fi)
+	if err != nil {
+		return err
+	}
+
+	entry := filepath.Join(d.store, key[:2], key)
+	efi, err := os.Stat(entry)
+
+	if d.dryRun {
+		first, ok := d.seen[key]
+		if err == nil {
+			first, ok = entry, true
+		}
+		if !ok {
+			d.seen[key] = p
+			return nil
+		}
+		if ffi, err := os.Stat(first); err == nil && !os.SameFile(fi, ffi) {
+			d.linked++
+			d.saved += fi.Size()
+		}
+		return nil
+	}
+
+	switch {
+	case os.IsNotExist(err):
+		if err := os.MkdirAll(filepath.Dir(entry), 0755); err != nil {
+			return err
+		}
+		if err := os.Link(p, entry); err != nil {
+			return fmt.Errorf("adding %s to the store (it must be on the same filesystem): %s", p, err)
+		}
+		return nil
+	case err != nil:
+		return err
+	case os.SameFile(fi, efi):
+		return nil
+	}
+
+	// link next to the file and rename over it, so it is never missing
+	tmp := p + ".gx-go-dedup"
+	if err := os.Link(entry, tmp); err != nil {
+		return fmt.Errorf("linking %s (the store must be on the same filesystem): %s", p, err)
+	}
+	if err := os.Rename(tmp, p); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	d.linked++
+	d.saved += fi.Size()
+	return nil
+}
+
+// storeKey returns the key of the file `p` in the store: the sha256 of its
+// content, marked for executables as links share their mode.
+func storeKey(p string, fi os.FileInfo) (string, error) {
+	key, err := fileSha256(p)
+	if err != nil {
+		return "", err
+	}
+	if fi.Mode()&0111 != 0 {
+		key += "-x"
+	}
+	return key, nil
+}
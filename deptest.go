@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	cli "github.com/urfave/cli"
+	rw "github.com/whyrusleeping/gx-go/rewrite"
+	gx "github.com/whyrusleeping/gx/gxutil"
+)
+
+var TestCommand = cli.Command{
+	Name:  "test",
+	Usage: "run the tests of the package, or of its dependencies",
+	Description: `Without --deps, runs go test on a copy of the package with its imports
+rewritten, as 'gx test' does. The arguments are those of go test.
+
+With --deps, runs the tests of the dependencies named in the arguments (all
+of them if none are given) with their imports rewritten to the dependency
+versions the package resolves to. This catches dependencies broken by the
+versions other packages pull in, or by overrides, before a release.`,
+	ArgsUsage:       "[go test args | dependency names]",
+	SkipFlagParsing: true,
+	Action: func(c *cli.Context) error {
+		args := []string(c.Args())
+		if len(args) > 0 && (args[0] == "--deps" || args[0] == "-deps") {
+			return testDeps(args[1:])
+		}
+
+		if err := preTest(); err != nil {
+			return err
+		}
+		defer postTest()
+		return runTests(args)
+	},
+}
+
+// testDeps runs the tests of the dependencies of the current package named
+// in `names`, or of all of them, against the resolved dependency set.
+func testDeps(names []string) error {
+	root, err := gx.GetPackageRoot()
+	if err != nil {
+		return err
+	}
+
+	pkg, err := LoadPackageFile(filepath.Join(root, gx.PkgFileName))
+	if err != nil {
+		return err
+	}
+
+	vdir := filepath.Join(root, vendorDir)
+	mapping := make(map[string]string)
+	if err := buildPackageRewriteMapping(pkg, root, vdir, mapping, false); err != nil {
+		return fmt.Errorf("build of rewrite mapping failed:\n%s", err)
+	}
+
+	known := make(map[string]bool)
+	var deps []string
+	for dvcs, gxpath := range mapping {
+		parts := strings.Split(gxpath, "/")
+		if len(parts) != 4 {
+			continue
+		}
+		known[parts[3]] = true
+		if len(names) == 0 || containsString(names, parts[3]) || containsString(names, dvcs) {
+			deps = append(deps, dvcs)
+		}
+	}
+	sort.Strings(deps)
+
+	for _, n := range names {
+		if !known[n] && mapping[n] == "" {
+			return fmt.Errorf("%s is not a dependency of %s", n, pkg.Name)
+		}
+	}
+
+	shadow, err := ioutil.TempDir("", "gx-go-deptest")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(shadow)
+
+	// gx paths resolve to the installed packages, locally or globally
+	gopaths, err := getGoPaths()
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(vdir); err == nil {
+		if err := os.MkdirAll(filepath.Join(shadow, "src", "gx"), 0755); err != nil {
+			return err
+		}
+		if err := os.Symlink(vdir, filepath.Join(shadow, "src", "gx", "ipfs")); err != nil {
+			return err
+		}
+	}
+	gopath := strings.Join(append([]string{shadow}, gopaths...), string(filepath.ListSeparator))
+	env := withEnv(os.Environ(), "GOPATH", gopath)
+
+	var failed []string
+	for _, dvcs := range deps {
+		gxpath := mapping[dvcs]
+		Log("testing %s (%s)", dvcs, gxpath)
+		if err := testDep(root, shadow, env, dvcs, gxpath, mapping); err != nil {
+			Error("%s: %s", dvcs, err)
+			failed = append(failed, dvcs)
+		}
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("%d of %d dependencies failed their tests: %s", len(failed), len(deps), strings.Join(failed, ", "))
+	}
+	Log("the tests of %d dependencies passed", len(deps))
+	return nil
+}
+
+// testDep copies the dependency `dvcs`, installed as `gxpath` for the
+// package at `root`, to its import path in the GOPATH `shadow`, rewrites its
+// imports of gx packages to the versions `mapping` resolves their dvcs
+// imports to and runs its tests.
+func testDep(root, shadow string, env []string, dvcs, gxpath string, mapping map[string]string) error {
+	hash := strings.Split(gxpath, "/")[2]
+
+	var dpkg Package
+	src := filepath.Join(root, vendorDir, hash)
+	if err := gx.FindPackageInDir(&dpkg, src); err != nil {
+		src = globalPkgDir(hash)
+		if err := gx.FindPackageInDir(&dpkg, src); err != nil {
+			return fmt.Errorf("package not installed (run gx install)")
+		}
+	}
+
+	dst := filepath.Join(shadow, "src", filepath.FromSlash(dvcs))
+	if err := copyPackageSource(filepath.Join(src, dpkg.Name), dst); err != nil {
+		return err
+	}
+
+	// packages are told apart by dvcs import, not by name
+	dvcsOf := make(map[string]string)
+	rwf := func(in string) string {
+		h, canon := splitGxImport(in)
+		if h == "" {
+			return in
+		}
+
+		var to string
+		if h == hash {
+			to = dvcs
+		} else {
+			dep, ok := dvcsOf[h]
+			if !ok {
+				var err error
+				dep, err = resolveGxImport(h, canon)
+				if err != nil {
+					VLog("resolving %s: %s", canon, err)
+				}
+				dvcsOf[h] = dep
+			}
+			to = mapping[dep]
+		}
+		if to == "" {
+			return in
+		}
+		return to + strings.TrimPrefix(in, canon)
+	}
+	filter := func(s string) bool {
+		return strings.HasSuffix(s, ".go")
+	}
+	if err := rw.RewriteImportsContext(context.Background(), dst, packageVendorRoot(dst), rwf, filter, nil); err != nil {
+		return fmt.Errorf("rewrite failed: %s", err)
+	}
+
+	return goTest(dst, env, []string{"test", "./..."})
+}
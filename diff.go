@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+
+	cli "github.com/urfave/cli"
+	gx "github.com/whyrusleeping/gx/gxutil"
+)
+
+var DiffCommand = cli.Command{
+	Name:      "diff",
+	Usage:     "summarize the changes between two published package versions",
+	ArgsUsage: "[hashA] [hashB]",
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "full",
+			Usage: "also print a full source diff",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		if len(c.Args()) < 2 {
+			return fmt.Errorf("must specify two package hashes")
+		}
+
+		a, adir, err := fetchPackageByHash(c.Args()[0])
+		if err != nil {
+			return err
+		}
+
+		b, bdir, err := fetchPackageByHash(c.Args()[1])
+		if err != nil {
+			return err
+		}
+
+		if jsonOutput {
+			files, err := diffTrees(adir, bdir)
+			if err != nil {
+				return err
+			}
+
+			return printJSON(map[string]interface{}{
+				"name":         [2]string{a.Name, b.Name},
+				"version":      [2]string{a.Version, b.Version},
+				"dependencies": depChanges(a, b),
+				"files":        files,
+			})
+		}
+
+		if a.Name != b.Name {
+			fmt.Printf("name: %s -> %s\n", a.Name, b.Name)
+		}
+		if a.Version != b.Version {
+			fmt.Printf("version: %s -> %s\n", a.Version, b.Version)
+		}
+
+		fmt.Println("\ndependencies:")
+		printDepChanges(a, b)
+
+		files, err := diffTrees(adir, bdir)
+		if err != nil {
+			return err
+		}
+
+		fmt.Println("\nfiles:")
+		tabPrintSortedMap(nil, files)
+
+		if c.Bool("full") {
+			fmt.Println()
+			cmd := exec.Command("diff", "-ruN", adir, bdir)
+			cmd.Stdout = os.Stdout
+			cmd.Stderr = os.Stderr
+			// diff exits non-zero when the inputs differ
+			cmd.Run()
+		}
+
+		return nil
+	},
+}
+
+// fetchPackageByHash makes sure the package `hash` is in the global gx
+// store and returns it along with its directory.
+func fetchPackageByHash(hash string) (*Package, string, error) {
+	p := globalPkgDir(hash)
+
+	var pkg Package
+	if err := gx.FindPackageInDir(&pkg, p); err != nil {
+		if err := gxGetPackage(hash); err != nil {
+			return nil, "", err
+		}
+
+		if err := gx.FindPackageInDir(&pkg, p); err != nil {
+			return nil, "", fmt.Errorf("failed to find package %s: %s", hash, err)
+		}
+	}
+
+	return &pkg, filepath.Join(p, pkg.Name), nil
+}
+
+func printDepChanges(a, b *Package) {
+	changes := depChanges(a, b)
+	if len(changes) == 0 {
+		fmt.Println("  (no changes)")
+		return
+	}
+	tabPrintSortedMap(nil, changes)
+}
+
+// depChanges maps the names of the dependencies that differ between `a`
+// and `b` to a description of the change.
+func depChanges(a, b *Package) map[string]string {
+	before := make(map[string]*gx.Dependency)
+	for _, d := range a.Dependencies {
+		before[d.Name] = d
+	}
+
+	changes := make(map[string]string)
+	for _, d := range b.Dependencies {
+		old, ok := before[d.Name]
+		delete(before, d.Name)
+		switch {
+		case !ok:
+			changes[d.Name] = fmt.Sprintf("added %s (%s)", d.Version, d.Hash)
+		case old.Hash != d.Hash:
+			changes[d.Name] = fmt.Sprintf("%s -> %s (%s -> %s)", old.Version, d.Version, old.Hash, d.Hash)
+		}
+	}
+
+	for name, d := range before {
+		changes[name] = fmt.Sprintf("removed %s (%s)", d.Version, d.Hash)
+	}
+	return changes
+}
+
+// diffTrees compares the regular files under two directories and returns
+// a map of relative path to one of "added", "removed" or "modified".
+func diffTrees(a, b string) (map[string]string, error) {
+	afiles, err := listFiles(a)
+	if err != nil {
+		return nil, err
+	}
+
+	bfiles, err := listFiles(b)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make(map[string]string)
+	for _, f := range bfiles {
+		if !contains(afiles, f) {
+			out[f] = "added"
+			continue
+		}
+
+		ab, err := ioutil.ReadFile(filepath.Join(a, f))
+		if err != nil {
+			return nil, err
+		}
+		bb, err := ioutil.ReadFile(filepath.Join(b, f))
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(ab, bb) {
+			out[f] = "modified"
+		}
+	}
+
+	for _, f := range afiles {
+		if !contains(bfiles, f) {
+			out[f] = "removed"
+		}
+	}
+
+	return out, nil
+}
+
+func listFiles(dir string) ([]string, error) {
+	var out []string
+	err := filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		out = append(out, rel)
+		return nil
+	})
+	sort.Strings(out)
+	return out, err
+}
+
+// contains reports whether the sorted slice `l` contains `s`.
+func contains(l []string, s string) bool {
+	i := sort.SearchStrings(l, s)
+	return i < len(l) && l[i] == s
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"text/tabwriter"
+
+	cli "github.com/urfave/cli"
+	gx "github.com/whyrusleeping/gx/gxutil"
+)
+
+var DuCommand = cli.Command{
+	Name:  "du",
+	Usage: "report the disk usage of each direct dependency",
+	Description: `du prints, for each direct dependency of the current package, the size
+of the dependency itself plus all of its transitive dependencies that
+are not also pulled in by another direct dependency.
+
+Packages are looked up in the local vendor directory first, falling
+back to the global gx store.`,
+	Action: func(c *cli.Context) error {
+		root, err := gx.GetPackageRoot()
+		if err != nil {
+			return err
+		}
+
+		pkg, err := LoadPackageFile(filepath.Join(root, gx.PkgFileName))
+		if err != nil {
+			return err
+		}
+
+		pkgdir := filepath.Join(root, vendorDir)
+
+		// closures[i] holds every hash reachable from the i'th direct dep,
+		// refs counts how many direct deps reach a given hash.
+		closures := make([]map[string]string, len(pkg.Dependencies))
+		refs := make(map[string]int)
+		for i, dep := range pkg.Dependencies {
+			closures[i] = make(map[string]string)
+			if err := depClosure(dep, pkgdir, closures[i]); err != nil {
+				return err
+			}
+
+			for h := range closures[i] {
+				refs[h]++
+			}
+		}
+
+		type usage struct {
+			dep    *gx.Dependency
+			own    int64
+			excl   int64
+			nexcl  int
+			shared int
+		}
+
+		var out []usage
+		var total int64
+		for i, dep := range pkg.Dependencies {
+			u := usage{dep: dep}
+			for h, dir := range closures[i] {
+				size, err := dirSize(dir)
+				if err != nil {
+					return err
+				}
+
+				switch {
+				case h == dep.Hash:
+					u.own = size
+				case refs[h] == 1:
+					u.excl += size
+					u.nexcl++
+				default:
+					u.shared++
+				}
+			}
+			total += u.own + u.excl
+			out = append(out, u)
+		}
+
+		sort.Slice(out, func(i, j int) bool {
+			return out[i].own+out[i].excl > out[j].own+out[j].excl
+		})
+
+		if jsonOutput {
+			var entries []map[string]interface{}
+			for _, u := range out {
+				entries = append(entries, map[string]interface{}{
+					"name":      u.dep.Name,
+					"hash":      u.dep.Hash,
+					"self":      u.own,
+					"exclusive": u.excl,
+					"shared":    u.shared,
+				})
+			}
+			return printJSON(entries)
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 12, 4, 1, ' ', 0)
+		fmt.Fprintf(w, "NAME\tTOTAL\tSELF\tEXCLUSIVE DEPS\tSHARED DEPS\n")
+		for _, u := range out {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%d (%s)\t%d\n", u.dep.Name,
+				humanSize(u.own+u.excl), humanSize(u.own), u.nexcl, humanSize(u.excl), u.shared)
+		}
+		w.Flush()
+
+		fmt.Printf("\nexclusive total: %s\n", humanSize(total))
+		return nil
+	},
+}
+
+// findDepDir returns the directory holding the package for `hash`, looking
+// in `pkgdir` first and then in the global gx store.
+func findDepDir(hash, pkgdir string) (string, error) {
+	if pkgdir != "" {
+		p := filepath.Join(pkgdir, hash)
+		if _, err := os.Stat(p); err == nil {
+			return p, nil
+		}
+	}
+
+	p := globalPkgDir(hash)
+	if _, err := os.Stat(p); err != nil {
+		return "", fmt.Errorf("package %s not found locally, try 'gx install'", hash)
+	}
+	return p, nil
+}
+
+// depClosure fills `set` with the hash and directory of `dep` and all of its
+// transitive dependencies.
+func depClosure(dep *gx.Dependency, pkgdir string, set map[string]string) error {
+	if _, ok := set[dep.Hash]; ok {
+		return nil
+	}
+
+	dir, err := findDepDir(dep.Hash, pkgdir)
+	if err != nil {
+		return fmt.Errorf("%s: %s", dep.Name, err)
+	}
+	set[dep.Hash] = dir
+
+	var cpkg Package
+	if err := gx.FindPackageInDir(&cpkg, dir); err != nil {
+		return err
+	}
+
+	for _, cdep := range cpkg.Dependencies {
+		if err := depClosure(cdep, pkgdir, set); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	cli "github.com/urfave/cli"
+	gx "github.com/whyrusleeping/gx/gxutil"
+)
+
+var EditorCommand = cli.Command{
+	Name:  "editor",
+	Usage: "set up a GOPATH editors can resolve gx imports with",
+	Description: `editor makes the gx/ipfs/... imports of the package resolvable by editors
+and the go tools they run, so that go to definition works on rewritten
+code.
+
+It creates a GOPATH in .gx/editor made of symlinks: the package at its
+dvcs import path and each of its dependencies, installed locally or
+globally, at its gx/ipfs/<hash> path. Pointing the GOPATH of the editor at
+it, followed by the usual GOPATH, is enough.
+
+With --vscode the go.gopath and go.toolsEnvVars settings of
+.vscode/settings.json are set to it. Otherwise the GOPATH to use is
+printed, to be set in the project GOPATH of GoLand or the environment of
+other editors. Run it again after installing or updating dependencies.`,
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "vscode",
+			Usage: "write the GOPATH to the vscode settings of the package",
+		},
+		cli.BoolFlag{
+			Name:  "clean",
+			Usage: "remove the editor GOPATH",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		root, err := gx.GetPackageRoot()
+		if err != nil {
+			return err
+		}
+
+		farm := filepath.Join(root, ".gx", "editor")
+		if c.Bool("clean") {
+			return os.RemoveAll(farm)
+		}
+
+		pkg, err := LoadPackageFile(filepath.Join(root, gx.PkgFileName))
+		if err != nil {
+			return err
+		}
+
+		n, err := buildEditorGoPath(farm, root, pkg)
+		if err != nil {
+			return err
+		}
+		Log("linked %d dependencies of %s in %s", n, pkg.Name, farm)
+
+		gopaths, err := getGoPaths()
+		if err != nil {
+			return err
+		}
+		gopath := strings.Join(append([]string{farm}, gopaths...), string(filepath.ListSeparator))
+
+		if c.Bool("vscode") {
+			return writeVSCodeGoPath(root, gopath)
+		}
+		if jsonOutput {
+			return printJSON(map[string]string{"GOPATH": gopath})
+		}
+		fmt.Println(gopath)
+		return nil
+	},
+}
+
+// buildEditorGoPath (re)creates in `farm` a GOPATH of symlinks to the
+// package `pkg` at `root` and to its installed dependencies, and returns
+// the number of dependencies linked.
+func buildEditorGoPath(farm, root string, pkg *Package) (int, error) {
+	if err := os.RemoveAll(farm); err != nil {
+		return 0, err
+	}
+
+	gxdir := filepath.Join(farm, "src", "gx", "ipfs")
+	if err := os.MkdirAll(gxdir, 0755); err != nil {
+		return 0, err
+	}
+
+	if pkg.Gx.DvcsImport != "" {
+		self := filepath.Join(farm, "src", filepath.FromSlash(pkg.Gx.DvcsImport))
+		if err := os.MkdirAll(filepath.Dir(self), 0755); err != nil {
+			return 0, err
+		}
+		if err := os.Symlink(root, self); err != nil {
+			return 0, err
+		}
+	}
+
+	pkgdir := filepath.Join(root, vendorDir)
+	done := make(map[string]bool)
+	var linked int
+	var link func(pkg *Package) error
+	link = func(pkg *Package) error {
+		for _, dep := range pkg.Dependencies {
+			if done[dep.Hash] {
+				continue
+			}
+			done[dep.Hash] = true
+
+			dir := filepath.Join(pkgdir, dep.Hash)
+			var dpkg Package
+			if err := gx.FindPackageInDir(&dpkg, dir); err != nil {
+				dir = globalPkgDir(dep.Hash)
+				if err := gx.FindPackageInDir(&dpkg, dir); err != nil {
+					Warn("%s (%s) is not installed, its imports won't resolve", dep.Name, dep.Hash)
+					continue
+				}
+			}
+
+			if err := os.Symlink(dir, filepath.Join(gxdir, dep.Hash)); err != nil {
+				return err
+			}
+			linked++
+			if err := link(&dpkg); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := link(pkg); err != nil {
+		return 0, err
+	}
+	return linked, nil
+}
+
+// writeVSCodeGoPath sets the GOPATH used by the go extension of vscode for
+// the package at `root` to `gopath`, keeping the other settings.
+func writeVSCodeGoPath(root, gopath string) error {
+	p := filepath.Join(root, ".vscode", "settings.json")
+
+	settings := make(map[string]interface{})
+	data, err := ioutil.ReadFile(p)
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(data, &settings); err != nil {
+			return fmt.Errorf("%s: %s", p, err)
+		}
+	case !os.IsNotExist(err):
+		return err
+	}
+
+	env, _ := settings["go.toolsEnvVars"].(map[string]interface{})
+	if env == nil {
+		env = make(map[string]interface{})
+	}
+	env["GOPATH"] = gopath
+	env["GO111MODULE"] = "off"
+	settings["go.toolsEnvVars"] = env
+	settings["go.gopath"] = gopath
+
+	out, err := json.MarshalIndent(settings, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(p, append(out, '\n'), 0644); err != nil {
+		return err
+	}
+	Log("set the GOPATH in %s", p)
+	return nil
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	cli "github.com/urfave/cli"
+	gx "github.com/whyrusleeping/gx/gxutil"
+)
+
+// ExportedDep is the packaging metadata exported for a single dependency.
+type ExportedDep struct {
+	Name       string `json:"name"`
+	Version    string `json:"version"`
+	Hash       string `json:"hash"`
+	GoPackage  string `json:"goPackagePath,omitempty"`
+	URL        string `json:"url,omitempty"`
+	Rev        string `json:"rev,omitempty"`
+	Sha256     string `json:"sha256,omitempty"`
+	GxSha256   string `json:"gxSha256,omitempty"`
+	License    string `json:"license,omitempty"`
+	ImportPath string `json:"importPath"`
+}
+
+var ExportCommand = cli.Command{
+	Name:  "export",
+	Usage: "export dependency metadata for distribution packagers",
+	Description: `export prints every (transitive) dependency of the current package with
+its gx hash, upstream url and commit, and source checksums in a format
+consumable by Nix (deps.nix, as used by buildGoPackage) or Guix (json).
+
+Upstream sha256 sums are computed with nix-prefetch-git, and the sha256
+of the gx package itself (gxSha256) with nix-hash, when they are
+installed.`,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "format",
+			Usage: "output format, one of 'nix' or 'json'",
+			Value: "json",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		root, err := gx.GetPackageRoot()
+		if err != nil {
+			return err
+		}
+
+		pkg, err := LoadPackageFile(filepath.Join(root, gx.PkgFileName))
+		if err != nil {
+			return err
+		}
+
+		pkgdir := filepath.Join(root, vendorDir)
+		deps, err := collectDeps(pkg, pkgdir)
+		if err != nil {
+			return err
+		}
+
+		var hashes []string
+		for h := range deps {
+			hashes = append(hashes, h)
+		}
+		sort.Strings(hashes)
+
+		_, err = exec.LookPath("nix-prefetch-git")
+		prefetch := err == nil
+		if !prefetch {
+			Log("nix-prefetch-git not found, upstream sha256 sums will be left empty")
+		}
+
+		var out []*ExportedDep
+		for _, h := range hashes {
+			dpkg := deps[h]
+			ed := &ExportedDep{
+				Name:       dpkg.Name,
+				Version:    dpkg.Version,
+				Hash:       h,
+				GoPackage:  dpkg.Gx.DvcsImport,
+				Rev:        dpkg.Gx.DvcsCommit,
+				License:    dpkg.License,
+				ImportPath: "gx/ipfs/" + h + "/" + dpkg.Name,
+			}
+
+			switch {
+			case dpkg.Gx.DvcsRepo != "":
+				ed.URL = dpkg.Gx.DvcsRepo
+			case dpkg.Gx.DvcsImport != "":
+				ed.URL = "https://" + dpkg.Gx.DvcsImport
+			}
+
+			dir, err := findDepDir(h, pkgdir)
+			if err != nil {
+				return err
+			}
+			ed.GxSha256, err = nixHashPath(filepath.Join(dir, dpkg.Name))
+			if err != nil {
+				VLog("hashing %s: %s", dpkg.Name, err)
+			}
+
+			if prefetch && ed.URL != "" && ed.Rev != "" {
+				ed.Sha256, err = nixPrefetchGit(ed.URL, ed.Rev)
+				if err != nil {
+					Error("prefetching %s: %s", ed.URL, err)
+				}
+			}
+
+			out = append(out, ed)
+		}
+
+		format := c.String("format")
+		if jsonOutput {
+			if c.IsSet("format") && format != "json" {
+				return fmt.Errorf("--json cannot be used with --format %s", format)
+			}
+			format = "json"
+		}
+
+		switch format {
+		case "json":
+			data, err := json.MarshalIndent(out, "", "  ")
+			if err != nil {
+				return err
+			}
+			fmt.Println(string(data))
+		case "nix":
+			return printDepsNix(out)
+		default:
+			return fmt.Errorf("unrecognized export format: %s", format)
+		}
+
+		return nil
+	},
+}
+
+// nixFakeSha256 is the value of nix's lib.fakeSha256, which makes the
+// build fail with the actual hash to use.
+const nixFakeSha256 = "0000000000000000000000000000000000000000000000000000"
+
+// printDepsNix prints `deps` as a deps.nix. A dependency without an
+// upstream commit can't be fetched and fails the export, one without a
+// sha256 gets lib.fakeSha256.
+func printDepsNix(deps []*ExportedDep) error {
+	for _, d := range deps {
+		if d.URL != "" && d.Rev == "" {
+			return fmt.Errorf("no upstream commit recorded for %s (%s), it can't be fetched by nix", d.Name, d.Hash)
+		}
+	}
+
+	fmt.Println("[")
+	for _, d := range deps {
+		if d.URL == "" {
+			continue
+		}
+		sha256 := d.Sha256
+		if sha256 == "" {
+			Warn("no sha256 for %s %s, using lib.fakeSha256 (nix-prefetch-git is needed to compute it)", d.URL, d.Rev)
+			sha256 = nixFakeSha256
+		}
+		fmt.Println("  {")
+		fmt.Printf("    goPackagePath = %q;\n", d.GoPackage)
+		fmt.Println("    fetch = {")
+		fmt.Println("      type = \"git\";")
+		fmt.Printf("      url = %q;\n", d.URL)
+		fmt.Printf("      rev = %q;\n", d.Rev)
+		fmt.Printf("      sha256 = %q;\n", sha256)
+		fmt.Println("    };")
+		fmt.Println("  }")
+	}
+	fmt.Println("]")
+	return nil
+}
+
+func nixPrefetchGit(url, rev string) (string, error) {
+	out, err := exec.Command("nix-prefetch-git", "--quiet", "--url", url, "--rev", rev).Output()
+	if err != nil {
+		return "", err
+	}
+
+	var res struct {
+		Sha256 string `json:"sha256"`
+	}
+	if err := json.Unmarshal(out, &res); err != nil {
+		return "", err
+	}
+	return res.Sha256, nil
+}
+
+// nixHashPath returns the nix sha256 of `dir` if nix is installed.
+func nixHashPath(dir string) (string, error) {
+	if _, err := exec.LookPath("nix-hash"); err != nil {
+		return "", nil
+	}
+
+	out, err := exec.Command("nix-hash", "--type", "sha256", "--base32", dir).Output()
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
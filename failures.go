@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"sort"
+)
+
+// errImportAborted is returned for the packages not imported because
+// another one failed, unless the import keeps going after failures.
+var errImportAborted = errors.New("import aborted after a failure")
+
+// depError is the error of a package whose dependency `dep` failed to
+// import. It reads as the error of the dependency.
+type depError struct {
+	dep string
+	err error
+}
+
+func (e *depError) Error() string {
+	return e.err.Error()
+}
+
+// ImportFailure is a package that could not be imported.
+type ImportFailure struct {
+	DvcsImport string `json:"dvcsimport"`
+	Error      string `json:"error"`
+
+	// the dependency whose failure made this package fail, if any
+	Dependency string `json:"dependency,omitempty"`
+}
+
+// recordFailure records why `imppath` failed to import. The first failure
+// aborts the rest of the import, unless keepGoing is set or it was
+// interrupted. It must be called
+// with i.mu held.
+func (i *Importer) recordFailure(imppath string, err error) {
+	if err == errImportAborted {
+		return
+	}
+	// failing because of the interruption, it is retried when resuming
+	if i.ctx != nil && i.ctx.Err() != nil {
+		return
+	}
+
+	f := ImportFailure{DvcsImport: imppath, Error: err.Error()}
+	if de, ok := err.(*depError); ok {
+		f.Dependency = getBaseDVCS(de.dep)
+		f.Error = "dependency failed"
+	} else if i.firstErr == nil {
+		i.firstErr = err
+	}
+	i.failures = append(i.failures, f)
+}
+
+// Failures returns the packages that failed to import, sorted by dvcs
+// import.
+func (i *Importer) Failures() []ImportFailure {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	out := append([]ImportFailure(nil), i.failures...)
+	sort.Slice(out, func(a, b int) bool {
+		return out[a].DvcsImport < out[b].DvcsImport
+	})
+	return out
+}
+
+// printImportSummary logs what an import published and what failed.
+func printImportSummary(published []ImportedPackage, failures []ImportFailure) {
+	Log("published %d packages:", len(published))
+	for _, ip := range published {
+		Log("  %s %s as %s", ip.DvcsImport, ip.Version, ip.Hash)
+	}
+
+	if len(failures) == 0 {
+		return
+	}
+	Error("%d packages failed:", len(failures))
+	for _, f := range failures {
+		if f.Dependency != "" {
+			Error("  %s: depends on %s, which failed", f.DvcsImport, f.Dependency)
+		} else {
+			Error("  %s: %s", f.DvcsImport, f.Error)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	rw "github.com/whyrusleeping/gx-go/rewrite"
+	gx "github.com/whyrusleeping/gx/gxutil"
+)
+
+// unresolvedPackage is a package whose gx imports fixImports left as is.
+type unresolvedPackage struct {
+	Hash  string `json:"hash"`
+	Error string `json:"error"`
+
+	// Imports are the files importing the package, by import path.
+	Imports map[string][]string `json:"imports"`
+}
+
+// fixImports rewrites the gx imports under `path` back to the dvcs imports
+// of their packages, found in the resolve cache, in GOPATH or else fetched.
+// The packages imported are resolved up front and in parallel. The ones
+// that can't be are returned, their imports left as is.
+func fixImports(op *rewriteOp, path string) ([]*unresolvedPackage, error) {
+	filter := func(s string) bool {
+		return strings.HasSuffix(s, ".go")
+	}
+
+	imports, err := rw.ListImports(path, packageVendorRoot(path), filter)
+	if err != nil {
+		return nil, err
+	}
+
+	// the package of each hash, imported as gx/ipfs/<hash>/<name>
+	canons := make(map[string]string)
+	for imp := range imports {
+		if hash, canon := splitGxImport(imp); hash != "" {
+			canons[hash] = canon
+		}
+	}
+
+	fixmap, failed := resolveGxImports(canons)
+
+	rwf := func(imp string) string {
+		hash, canon := splitGxImport(imp)
+		if base, ok := fixmap[hash]; ok {
+			return base + strings.TrimPrefix(imp, canon)
+		}
+		return imp
+	}
+
+	if err := op.rewrite(path, rwf, filter); err != nil {
+		return nil, err
+	}
+
+	var unresolved []*unresolvedPackage
+	byHash := make(map[string]*unresolvedPackage)
+	for imp, files := range imports {
+		hash, _ := splitGxImport(imp)
+		err, ok := failed[hash]
+		if !ok {
+			continue
+		}
+		u, ok := byHash[hash]
+		if !ok {
+			u = &unresolvedPackage{Hash: hash, Error: err.Error(), Imports: make(map[string][]string)}
+			byHash[hash] = u
+			unresolved = append(unresolved, u)
+		}
+		u.Imports[imp] = files
+	}
+	sort.Slice(unresolved, func(i, j int) bool { return unresolved[i].Hash < unresolved[j].Hash })
+	return unresolved, nil
+}
+
+// splitGxImport returns the hash of the gx import `imp` and its
+// gx/ipfs/<hash>/<name> prefix, or empty strings if it isn't one.
+func splitGxImport(imp string) (string, string) {
+	parts := strings.Split(imp, "/")
+	if len(parts) < 4 || parts[0] != "gx" || parts[1] != "ipfs" {
+		return "", ""
+	}
+	return parts[2], strings.Join(parts[:4], "/")
+}
+
+// reportUnresolved prints the packages fixImports left the imports of, on
+// stderr, or as json on stdout with --json.
+func reportUnresolved(unresolved []*unresolvedPackage) error {
+	if jsonOutput {
+		if unresolved == nil {
+			unresolved = []*unresolvedPackage{}
+		}
+		return printJSON(unresolved)
+	}
+	if len(unresolved) == 0 {
+		return nil
+	}
+
+	Warn("could not resolve %d gx packages, their imports were left as is:", len(unresolved))
+	for _, u := range unresolved {
+		fmt.Fprintf(os.Stderr, "  %s: %s\n", u.Hash, u.Error)
+
+		var imps []string
+		for imp := range u.Imports {
+			imps = append(imps, imp)
+		}
+		sort.Strings(imps)
+		for _, imp := range imps {
+			files := u.Imports[imp]
+			sort.Strings(files)
+			list := strings.Join(files, ", ")
+			if len(files) > 3 {
+				list = fmt.Sprintf("%s and %d more", strings.Join(files[:3], ", "), len(files)-3)
+			}
+			fmt.Fprintf(os.Stderr, "    %s (%s)\n", imp, list)
+		}
+	}
+	return nil
+}
+
+// resolveGxImports returns the dvcs imports of the packages of `canons`
+// (gx imports by hash) by hash, and why the others couldn't be resolved.
+func resolveGxImports(canons map[string]string) (map[string]string, map[string]error) {
+	p := newProgress("resolving", "packages", len(canons))
+	defer p.Done()
+
+	var mu sync.Mutex
+	resolved := make(map[string]string)
+	failed := make(map[string]error)
+	sem := make(chan struct{}, config.concurrency())
+	var wg sync.WaitGroup
+	for hash, canon := range canons {
+		wg.Add(1)
+		go func(hash, canon string) {
+			defer wg.Done()
+			defer p.Processed()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			if isInterrupted() {
+				return
+			}
+
+			dvcs, err := resolveGxImport(hash, canon)
+			if err == nil && dvcs == "" {
+				err = fmt.Errorf("package %s has no dvcs import set", canon)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				VLog("resolving %s: %s", canon, err)
+				failed[hash] = err
+				return
+			}
+			resolved[hash] = dvcs
+		}(hash, canon)
+	}
+	wg.Wait()
+	return resolved, failed
+}
+
+// resolveGxImport returns the dvcs import of the package `hash`, imported
+// as `canon`.
+func resolveGxImport(hash, canon string) (string, error) {
+	if pkg, ok := cachedPackage(hash); ok {
+		return pkg.Gx.DvcsImport, nil
+	}
+
+	var pkg Package
+	if err := gx.FindPackageInDir(&pkg, goPathSrc(canon)); err == nil {
+		recordPackageIn(hash, goPathSrc(canon), &pkg)
+		return pkg.Gx.DvcsImport, nil
+	}
+
+	dir, err := storeFetch(hash)
+	if err != nil {
+		return "", err
+	}
+	if err := gx.FindPackageInDir(&pkg, dir); err != nil {
+		return "", err
+	}
+	return pkg.Gx.DvcsImport, nil
+}
@@ -0,0 +1,23 @@
+package main
+
+import "testing"
+
+func TestSplitGxImport(t *testing.T) {
+	// the hash and package import of each import
+	cases := map[string][2]string{
+		"gx/ipfs/QmHash/name":         {"QmHash", "gx/ipfs/QmHash/name"},
+		"gx/ipfs/QmHash/name/sub/pkg": {"QmHash", "gx/ipfs/QmHash/name"},
+		"gx/ipfs/bafyhash/name":       {"bafyhash", "gx/ipfs/bafyhash/name"},
+	}
+	for imp, want := range cases {
+		if hash, c := splitGxImport(imp); hash != want[0] || c != want[1] {
+			t.Errorf("splitGxImport(%q) = %q, %q, want %q, %q", imp, hash, c, want[0], want[1])
+		}
+	}
+
+	for _, imp := range []string{"gx/ipfs/QmHash", "gx/ipns/QmHash/name", "github.com/x/y", "fmt"} {
+		if hash, c := splitGxImport(imp); hash != "" || c != "" {
+			t.Errorf("splitGxImport(%q) = %q, %q, want no gx import", imp, hash, c)
+		}
+	}
+}
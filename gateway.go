@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	gx "github.com/whyrusleeping/gx/gxutil"
+)
+
+// gateways returns the ipfs http gateways packages are fetched from when
+// fetching them through gx fails, in the order they are tried. They are
+// taken from GX_GO_GATEWAYS (comma separated), or else the config.
+func gateways() []string {
+	if env := os.Getenv("GX_GO_GATEWAYS"); env != "" {
+		var gws []string
+		for _, gw := range strings.Split(env, ",") {
+			if gw = strings.TrimSpace(gw); gw != "" {
+				gws = append(gws, gw)
+			}
+		}
+		return gws
+	}
+	return config.Gateways
+}
+
+// withGatewayFallback runs the gx fetch of the package `hash` into `dir` in
+// `fetch`, and if it fails, fetches the package from the gateways instead.
+func withGatewayFallback(hash, dir string, fetch func() error) error {
+	err := fetch()
+	if err == nil || len(gateways()) == 0 {
+		return err
+	}
+
+	Warn("fetching %s with gx failed, trying the gateways: %s", hash, err)
+	if gerr := fetchFromGateways(hash, dir); gerr != nil {
+		return fmt.Errorf("%s, and %s", err, gerr)
+	}
+	return nil
+}
+
+// fetchFromGateways fetches the package `hash` into `dir`, as gx get does,
+// from the first of the gateways that has it.
+func fetchFromGateways(hash, dir string) error {
+	if !isHash(hash) {
+		return fmt.Errorf("invalid hash %q", hash)
+	}
+
+	var errs []string
+	for _, gw := range gateways() {
+		err := fetchFromGateway(gw, hash, dir)
+		if err == nil {
+			Log("fetched %s from %s", hash, gw)
+			return nil
+		}
+		VLog("fetching %s from %s: %s", hash, gw, err)
+		errs = append(errs, fmt.Sprintf("%s: %s", gw, err))
+	}
+	return fmt.Errorf("no gateway could provide %s (%s)", hash, strings.Join(errs, "; "))
+}
+
+// fetchFromGateway downloads the package `hash` as a CAR archive from the
+// gateway `gw` and extracts it into `dir`, once verified.
+func fetchFromGateway(gw, hash, dir string) error {
+	url := strings.TrimSuffix(gw, "/") + "/ipfs/" + hash + "?format=car"
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/vnd.ipld.car")
+
+	timeout := cmdTimeout
+	if timeout == 0 {
+		timeout = 10 * time.Minute
+	}
+	client := &http.Client{Timeout: timeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s", resp.Status)
+	}
+
+	// extract next to the destination, so a failed download leaves no
+	// partial package behind
+	tmp := dir + ".gx-go-fetch"
+	if err := os.RemoveAll(tmp); err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	if err := extractCAR(resp.Body, hash, tmp); err != nil {
+		return fmt.Errorf("extracting the download: %s", err)
+	}
+
+	var pkg Package
+	if err := gx.FindPackageInDir(&pkg, tmp); err != nil {
+		return fmt.Errorf("no package found in the download: %s", err)
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	return os.Rename(tmp, dir)
+}
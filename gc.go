@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	cli "github.com/urfave/cli"
+	gx "github.com/whyrusleeping/gx/gxutil"
+)
+
+var GcCommand = cli.Command{
+	Name:      "gc",
+	Usage:     "remove unreferenced packages from the global gx store",
+	ArgsUsage: "[project dirs...]",
+	Description: `gc scans local gx projects for the packages they (transitively)
+depend on and deletes every package in the gx/ipfs store of each GOPATH
+entry that is not referenced by any of them.
+
+If no project directories are given, every package.json found under the
+src dir of each GOPATH entry (outside of gx/ipfs and vendor directories)
+is used.`,
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "dry-run",
+			Usage: "print out what would be removed without touching files",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		gopaths, err := getGoPaths()
+		if err != nil {
+			return err
+		}
+
+		roots := c.Args()
+		if len(roots) == 0 {
+			roots, err = findGoPathProjects()
+			if err != nil {
+				return err
+			}
+		}
+
+		live := make(map[string]bool)
+		for _, root := range roots {
+			pkg, err := LoadPackageFile(filepath.Join(root, gx.PkgFileName))
+			if err != nil {
+				// such as the package.json files of other tools
+				Warn("skipping %s: %s", root, err)
+				continue
+			}
+
+			VLog("marking deps of %s", root)
+			vdir := filepath.Join(root, packageVendorRoot(root), "gx", "ipfs")
+			markLiveDeps(pkg, vdir, live)
+		}
+
+		var removed []string
+		var reclaimed int64
+		for _, gp := range gopaths {
+			store := filepath.Join(gp, "src", "gx", "ipfs")
+			dirents, err := ioutil.ReadDir(store)
+			if err != nil {
+				if os.IsNotExist(err) {
+					continue
+				}
+				return err
+			}
+
+			for _, e := range dirents {
+				if live[e.Name()] || !isHash(e.Name()) {
+					continue
+				}
+
+				p := filepath.Join(store, e.Name())
+				size, err := dirSize(p)
+				if err != nil {
+					return err
+				}
+
+				if c.Bool("dry-run") {
+					if !jsonOutput {
+						fmt.Printf("would remove %s (%s)\n", p, humanSize(size))
+					}
+				} else {
+					VLog("removing %s", p)
+					if err := os.RemoveAll(p); err != nil {
+						return fmt.Errorf("removing %s: %s", p, err)
+					}
+				}
+
+				removed = append(removed, p)
+				reclaimed += size
+			}
+		}
+
+		if jsonOutput {
+			return printJSON(map[string]interface{}{
+				"removed":   removed,
+				"reclaimed": reclaimed,
+			})
+		}
+
+		Log("%d packages removed, %s reclaimed", len(removed), humanSize(reclaimed))
+		return nil
+	},
+}
+
+// findGoPathProjects returns the local projects of every GOPATH entry.
+func findGoPathProjects() ([]string, error) {
+	gopaths, err := getGoPaths()
+	if err != nil {
+		return nil, err
+	}
+
+	var out []string
+	for _, gp := range gopaths {
+		projects, err := findLocalProjects(filepath.Join(gp, "src"))
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, projects...)
+	}
+	return out, nil
+}
+
+// findLocalProjects returns every directory under `srcdir` containing a
+// package.json, skipping the gx store itself and vendor directories.
+func findLocalProjects(srcdir string) ([]string, error) {
+	var out []string
+	err := filepath.Walk(srcdir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+
+		if fi.IsDir() {
+			if p == filepath.Join(srcdir, "gx") || skipDir(fi.Name()) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if fi.Name() == gx.PkgFileName {
+			out = append(out, filepath.Dir(p))
+		}
+		return nil
+	})
+	return out, err
+}
+
+// markLiveDeps marks the hashes of all dependencies of `pkg`, read from the
+// vendor directory `vdir` of the project or else the global store.
+// Dependencies installed in neither are skipped.
+func markLiveDeps(pkg *Package, vdir string, live map[string]bool) {
+	for _, dep := range pkg.Dependencies {
+		if live[dep.Hash] {
+			continue
+		}
+		live[dep.Hash] = true
+
+		var cpkg Package
+		err := gx.FindPackageInDir(&cpkg, filepath.Join(vdir, dep.Hash))
+		if err != nil {
+			err = gx.FindPackageInDir(&cpkg, globalPkgDir(dep.Hash))
+		}
+		if err != nil {
+			VLog("  - dep %s (%s) not installed: %s", dep.Name, dep.Hash, err)
+			continue
+		}
+
+		markLiveDeps(&cpkg, vdir, live)
+	}
+}
+
+func dirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.Mode().IsRegular() {
+			size += fi.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
+func humanSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
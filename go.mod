@@ -3,8 +3,12 @@ module github.com/whyrusleeping/gx-go
 go 1.13
 
 require (
+	github.com/ipfs/go-ipfs-api v0.0.3
+	github.com/ipfs/go-ipfs-files v0.0.6
 	github.com/kr/fs v0.1.0
 	github.com/mitchellh/go-homedir v1.1.0
+	github.com/multiformats/go-multihash v0.0.13
+	github.com/sabhiram/go-gitignore v0.0.0-20180611051255-d3107576ba94
 	github.com/urfave/cli v1.22.2
 	github.com/whyrusleeping/gx v0.14.3
 	github.com/whyrusleeping/stump v0.0.0-20160611222256-206f8f13aae1
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// goVersionMatches returns whether the go version `have` satisfies the
+// constraint `req`. A constraint is a list of alternatives separated by
+// "||", each made of space separated comparisons that must all hold, such
+// as ">=1.12 <1.20 || >=1.21" or ">=1.11 !=1.13.2". The operators are =,
+// !=, <, <=, > and >=. A bare version is a minimum, as in older packages,
+// and "=" on a version missing components matches any of its releases.
+func goVersionMatches(have, req string) (bool, error) {
+	hv, err := parseGoVersion(have)
+	if err != nil {
+		return false, err
+	}
+
+	// every alternative is checked, so a malformed constraint is rejected
+	// whatever the go version
+	matched := false
+	for _, alt := range strings.Split(req, "||") {
+		fields := strings.Fields(alt)
+		if len(fields) == 0 {
+			return false, fmt.Errorf("empty alternative in go version constraint %q", req)
+		}
+
+		ok := true
+		for _, f := range fields {
+			m, err := matchGoVersion(hv, f)
+			if err != nil {
+				return false, fmt.Errorf("go version constraint %q: %s", req, err)
+			}
+			ok = ok && m
+		}
+		matched = matched || ok
+	}
+	return matched, nil
+}
+
+// matchGoVersion checks the version `have` against a single comparison.
+func matchGoVersion(have []int, cmp string) (bool, error) {
+	op := strings.TrimRight(cmp, "0123456789.gorcbeta")
+	want, err := parseGoVersion(cmp[len(op):])
+	if err != nil {
+		return false, err
+	}
+	if op == "" {
+		op = ">="
+	}
+
+	switch op {
+	case "=", "==":
+		return compareVersions(have[:min(len(have), len(want))], want) == 0, nil
+	case "!=":
+		return compareVersions(have[:min(len(have), len(want))], want) != 0, nil
+	case "<":
+		return compareVersions(have, want) < 0, nil
+	case "<=":
+		return compareVersions(have, want) <= 0, nil
+	case ">":
+		return compareVersions(have, want) > 0, nil
+	case ">=":
+		return compareVersions(have, want) >= 0, nil
+	default:
+		return false, fmt.Errorf("unknown operator %q", op)
+	}
+}
+
+// parseGoVersion parses a go version such as "1.12", "go1.12.3" or
+// "1.13rc1". Pre-releases are treated as the release they precede.
+func parseGoVersion(v string) ([]int, error) {
+	v = strings.TrimPrefix(v, "go")
+	for _, s := range []string{"rc", "beta"} {
+		if i := strings.Index(v, s); i >= 0 {
+			v = v[:i]
+			break
+		}
+	}
+
+	var out []int
+	for _, p := range strings.Split(v, ".") {
+		n, err := strconv.Atoi(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid go version %q", v)
+		}
+		out = append(out, n)
+	}
+	return out, nil
+}
+
+// compareVersions compares two parsed versions, missing trailing
+// components counting as zeros.
+func compareVersions(a, b []int) int {
+	for i := 0; i < len(a) || i < len(b); i++ {
+		var av, bv int
+		if i < len(a) {
+			av = a[i]
+		}
+		if i < len(b) {
+			bv = b[i]
+		}
+		if av != bv {
+			if av < bv {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseGoVersion(t *testing.T) {
+	cases := []struct {
+		in   string
+		want []int
+		err  bool
+	}{
+		{"1.12", []int{1, 12}, false},
+		{"go1.12.3", []int{1, 12, 3}, false},
+		{"1.13rc1", []int{1, 13}, false},
+		{"go1.14beta2", []int{1, 14}, false},
+		{"1.x", nil, true},
+		{"", nil, true},
+	}
+	for _, c := range cases {
+		got, err := parseGoVersion(c.in)
+		if (err != nil) != c.err {
+			t.Errorf("parseGoVersion(%q) error = %v, want error %t", c.in, err, c.err)
+			continue
+		}
+		if !c.err && !reflect.DeepEqual(got, c.want) {
+			t.Errorf("parseGoVersion(%q) = %v, want %v", c.in, got, c.want)
+		}
+	}
+}
+
+func TestGoVersionMatches(t *testing.T) {
+	cases := []struct {
+		have, req string
+		want      bool
+		err       bool
+	}{
+		{"go1.12.3", "1.12", true, false},
+		{"go1.11", "1.12", false, false},
+		{"go1.12.3", ">=1.12 <1.13", true, false},
+		{"go1.13", ">=1.12 <1.13", false, false},
+		{"go1.12.3", "=1.12", true, false},
+		{"go1.13", "!=1.12", true, false},
+		{"go1.13rc1", ">=1.13", true, false},
+		{"go1.10", "<1.9 || >=1.10", true, false},
+		{"go1.9.2", "<1.9 || >=1.10", false, false},
+		{"go1.12", "~1.12", false, true},
+		{"go1.12", "1.12 ||", false, true},
+		{"go1.x", "1.12", false, true},
+	}
+	for _, c := range cases {
+		got, err := goVersionMatches(c.have, c.req)
+		if (err != nil) != c.err {
+			t.Errorf("goVersionMatches(%q, %q) error = %v, want error %t", c.have, c.req, err, c.err)
+			continue
+		}
+		if got != c.want {
+			t.Errorf("goVersionMatches(%q, %q) = %t, want %t", c.have, c.req, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"time"
+
+	gx "github.com/whyrusleeping/gx/gxutil"
+)
+
+// Packages are fetched and installed through the gx library rather than by
+// running the gx binary, which may be missing from PATH or not match the
+// version gx-go was built with.
+
+// newPM returns a gx package manager configured as the gx binary's. The
+// hooks it runs get their environment from hookEnv, which its callers set.
+func newPM() (*gx.PM, error) {
+	cfg, err := gx.LoadConfig()
+	if err != nil {
+		return nil, fmt.Errorf("loading the gx config: %s", err)
+	}
+	return gx.NewPM(cfg)
+}
+
+// installPath returns the directory the dependencies of the package at
+// `root` are installed to, as the install-path hook prints it.
+func installPath(root string, global bool) (string, error) {
+	if global {
+		gpath, err := getGoPath()
+		if err != nil {
+			return "", fmt.Errorf("GOPATH not set")
+		}
+		return filepath.Join(gpath, "src"), nil
+	}
+	return filepath.Join(root, packageVendorRoot(root)), nil
+}
+
+// gxFetch fetches the package `hash` into `dir`, as gx get does.
+func gxFetch(hash, dir string) error {
+	pm, err := newPM()
+	if err != nil {
+		return err
+	}
+	defer hookEnv()()
+
+	VLog("fetching %s to %s", hash, dir)
+	if _, err := pm.GetPackageTo(hash, dir); err != nil {
+		return fmt.Errorf("fetching %s: %s", hash, err)
+	}
+	return nil
+}
+
+// gxInstall installs the dependencies of the package at `root`, globally or
+// in its vendor directory, as gx install does.
+func gxInstall(root string, global bool) error {
+	var pkg gx.Package
+	if err := gx.LoadPackageFile(&pkg, filepath.Join(root, gx.PkgFileName)); err != nil {
+		return err
+	}
+
+	if err := reqCheckHook(root, false); err != nil {
+		return err
+	}
+
+	ipath, err := installPath(root, global)
+	if err != nil {
+		return err
+	}
+
+	pm, err := newPM()
+	if err != nil {
+		return err
+	}
+	pm.SetGlobal(global)
+	defer hookEnv()()
+
+	Log("installing the dependencies of %s to %s", pkg.Name, ipath)
+	start := time.Now()
+	// gx only runs the post-install hooks of the packages found in place
+	if err := materializeDeps(pkg.Dependencies, ipath, make(map[string]bool)); err != nil {
+		return err
+	}
+	if err := pm.InstallDeps(&pkg, ipath); err != nil {
+		return fmt.Errorf("installing the dependencies of %s: %s", pkg.Name, err)
+	}
+	VLog("installed the dependencies of %s in %s", pkg.Name, time.Since(start).Round(time.Millisecond))
+	return nil
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	shell "github.com/ipfs/go-ipfs-api"
+	files "github.com/ipfs/go-ipfs-files"
+	homedir "github.com/mitchellh/go-homedir"
+	mh "github.com/multiformats/go-multihash"
+	gi "github.com/sabhiram/go-gitignore"
+	gx "github.com/whyrusleeping/gx/gxutil"
+)
+
+// Packages are addressed by the cid of their root, which appears in their
+// gx/ipfs/<hash>/<name> import paths. Older ipfs versions print base58 v0
+// cids (Qm...), newer ones lowercase base32 v1 cids (bafy...), both of
+// which make valid import path elements.
+
+var cidBase32 = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+
+// isHash returns whether `s` is a gx package hash.
+func isHash(s string) bool {
+	_, err := parseHash(s)
+	return err == nil
+}
+
+// parseHash returns the multihash of the gx package hash `s`.
+func parseHash(s string) (mh.Multihash, error) {
+	switch {
+	case strings.HasPrefix(s, "Qm"):
+		if len(s) != 46 {
+			return nil, fmt.Errorf("invalid hash %q: a v0 cid is 46 characters long", s)
+		}
+		h, err := mh.FromB58String(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid hash %q: %s", s, err)
+		}
+		return h, nil
+	case strings.HasPrefix(s, "b"):
+		data, err := cidBase32.DecodeString(s[1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid hash %q: %s", s, err)
+		}
+
+		version, n := binary.Uvarint(data)
+		if n <= 0 || version != 1 {
+			return nil, fmt.Errorf("invalid hash %q: not a v1 cid", s)
+		}
+		data = data[n:]
+
+		// the codec of the content, dag-pb for gx packages
+		if _, n = binary.Uvarint(data); n <= 0 {
+			return nil, fmt.Errorf("invalid hash %q: bad codec", s)
+		}
+
+		h, err := mh.Cast(data[n:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid hash %q: %s", s, err)
+		}
+		return h, nil
+	default:
+		return nil, fmt.Errorf("invalid hash %q: not a base58 (Qm...) or base32 (b...) cid", s)
+	}
+}
+
+// sameHash returns whether the hashes `a` and `b` address the same content,
+// even if one is a v0 cid and the other a v1 cid.
+func sameHash(a, b string) bool {
+	if a == b {
+		return true
+	}
+
+	ha, err := parseHash(a)
+	if err != nil {
+		return false
+	}
+	hb, err := parseHash(b)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(ha, hb)
+}
+
+// hashForms returns `hash` and, for a sha2-256 dag-pb cid, the other cid
+// version addressing the same content: packages may be referenced by one
+// and installed or imported under the other.
+func hashForms(hash string) []string {
+	c, err := cidBytes(hash)
+	if err != nil {
+		return []string{hash}
+	}
+	codec, h, _, err := splitCid(c)
+	if err != nil || codec != codecDagPb {
+		return []string{hash}
+	}
+	dh, err := mh.Decode(h)
+	if err != nil || dh.Code != mh.SHA2_256 {
+		return []string{hash}
+	}
+
+	if !strings.HasPrefix(hash, "Qm") {
+		return []string{hash, h.B58String()}
+	}
+	var b [binary.MaxVarintLen64]byte
+	v1 := append(b[:binary.PutUvarint(b[:], 1)], codecDagPb)
+	return []string{hash, "b" + cidBase32.EncodeToString(append(v1, h...))}
+}
+
+// hashDir returns the directory of the package `hash` within `dir`,
+// installed under either form of its hash, or under `hash` if it isn't.
+func hashDir(dir, hash string) string {
+	for _, form := range hashForms(hash) {
+		p := filepath.Join(dir, form)
+		if _, err := os.Stat(p); err == nil {
+			return p
+		}
+	}
+	return filepath.Join(dir, hash)
+}
+
+// checkHashFunction returns an error if `fn` is not a multihash function
+// name ipfs can hash packages with, such as sha2-256 or blake2b-256.
+func checkHashFunction(fn string) error {
+	if _, ok := mh.Names[fn]; !ok || fn == "identity" {
+		return fmt.Errorf("unknown hash function %q", fn)
+	}
+	return nil
+}
+
+// publishWithHash publishes the package in `dir` with its content hashed
+// with `fn`, as gx publish does: between its pre-publish and post-publish
+// hooks, recording the hash in .gx/lastpubver.
+func publishWithHash(dir string, pkg *Package, fn string) (string, error) {
+	pm, err := newPM()
+	if err != nil {
+		return "", err
+	}
+	defer hookEnv()()
+	if !pm.ShellOnline() {
+		return "", fmt.Errorf("ipfs daemon isn't running")
+	}
+
+	if err := runPublishHook(dir, pkg, "pre-publish"); err != nil {
+		return "", err
+	}
+
+	hash, err := addWithHash(pm.Shell(), dir, pkg, fn)
+	if err != nil {
+		return "", fmt.Errorf("publishing: %s", err)
+	}
+	Log("package %s published with hash: %s", pkg.Name, hash)
+
+	if err := os.MkdirAll(filepath.Join(dir, ".gx"), 0755); err != nil {
+		return hash, err
+	}
+	lastpub := fmt.Sprintf("%s: %s\n", pkg.Version, hash)
+	if err := ioutil.WriteFile(filepath.Join(dir, ".gx", "lastpubver"), []byte(lastpub), 0644); err != nil {
+		return hash, fmt.Errorf("failed to write version file: %s", err)
+	}
+
+	return hash, runPublishHook(dir, pkg, "post-publish", hash)
+}
+
+// runPublishHook runs the `hook` of the subtool of `pkg` in `dir`, as gx
+// runs it, if the subtool is installed.
+func runPublishHook(dir string, pkg *Package, hook string, args ...string) error {
+	bin, err := exec.LookPath("gx-" + pkg.Language)
+	if err != nil {
+		if pkg.SubtoolRequired {
+			return fmt.Errorf("no binary named gx-%s was found", pkg.Language)
+		}
+		return nil
+	}
+	if err := runIn(dir, bin, append([]string{"hook", hook}, args...)...); err != nil {
+		return fmt.Errorf("%s hook failed: %s", hook, err)
+	}
+	return nil
+}
+
+// addWithHash adds the package `pkg` in `dir` to ipfs as gx does, but with
+// its content hashed with `fn`, which gives a v1 cid. The files gx would
+// leave out are staged out first, as ipfs add doesn't know its ignore
+// rules.
+func addWithHash(sh *shell.Shell, dir string, pkg *Package, fn string) (string, error) {
+	tmpdir, err := ioutil.TempDir("", "gx-go-publish")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tmpdir)
+
+	stage := filepath.Join(tmpdir, pkg.Name)
+	if err := os.Mkdir(stage, 0755); err != nil {
+		return "", err
+	}
+	if err := stagePublishedFiles(dir, stage); err != nil {
+		return "", err
+	}
+
+	stat, err := os.Lstat(stage)
+	if err != nil {
+		return "", err
+	}
+	sf, err := files.NewSerialFile(stage, true, stat)
+	if err != nil {
+		return "", err
+	}
+	slf := files.NewSliceDirectory([]files.DirEntry{files.FileEntry(pkg.Name, sf)})
+
+	resp, err := sh.Request("add").
+		Option("recursive", true).
+		Option("wrap-with-directory", true).
+		Option("cid-version", 1).
+		Option("hash", fn).
+		Body(files.NewMultiFileReader(slf, true)).
+		Send(context.Background())
+	if err != nil {
+		return "", err
+	}
+	defer resp.Close()
+	if resp.Error != nil {
+		return "", resp.Error
+	}
+
+	// the wrapping directory comes last
+	var final string
+	dec := json.NewDecoder(resp.Output)
+	for {
+		var out struct{ Hash string }
+		if err := dec.Decode(&out); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return "", err
+		}
+		final = out.Hash
+	}
+
+	h, err := parseHash(final)
+	if err != nil {
+		return "", fmt.Errorf("publishing with %s: %s", fn, err)
+	}
+	dh, err := mh.Decode(h)
+	if err != nil {
+		return "", err
+	}
+	if dh.Name != fn {
+		return "", fmt.Errorf("ipfs hashed the package with %s instead of %s, it may be too old", dh.Name, fn)
+	}
+	return final, nil
+}
+
+// stagePublishedFiles copies the files of the package in `dir` that gx
+// publishes to `stage`, leaving out those ignored by its .gitignore, the
+// global ~/.gitignore or its .gxignore, and the git and gx metadata.
+func stagePublishedFiles(dir, stage string) error {
+	var ignores []*gi.GitIgnore
+	ignoreFiles := []string{filepath.Join(dir, ".gitignore"), filepath.Join(dir, ".gxignore")}
+	if home, err := homedir.Dir(); err == nil {
+		ignoreFiles = append(ignoreFiles, filepath.Join(home, ".gitignore"))
+	}
+	for _, p := range ignoreFiles {
+		ig, err := gi.CompileIgnoreFile(p)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+		ignores = append(ignores, ig)
+	}
+
+	return filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+
+		if rel == ".git" || strings.HasPrefix(rel, ".git/") || strings.HasPrefix(rel, ".gx/") || strings.HasSuffix(rel, ".gxrc") {
+			return nil
+		}
+		for _, ig := range ignores {
+			if ig.MatchesPath(rel) {
+				return nil
+			}
+		}
+
+		dst := filepath.Join(stage, filepath.FromSlash(rel))
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			return err
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			target, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(target, dst)
+		}
+		return copyFile(p, dst)
+	})
+}
+
+// invalidDepHashes describes each dependency of `pkg` whose hash is not a
+// valid cid, as left by a truncated copy or a bad merge of package.json.
+func invalidDepHashes(pkg *Package) []string {
+	var bad []string
+	for _, dep := range pkg.Dependencies {
+		if _, err := parseHash(dep.Hash); err != nil {
+			bad = append(bad, fmt.Sprintf("dependency %s of %s: %s", dep.Name, pkg.Name, err))
+		}
+	}
+	return bad
+}
+
+// invalidLockHashes describes each reference of the lock file `lck` whose
+// hash is not a valid cid.
+func invalidLockHashes(lck *gx.LockFile) []string {
+	var bad []string
+	var check func(deps map[string]map[string]gx.Lock)
+	check = func(deps map[string]map[string]gx.Lock) {
+		for _, ldeps := range deps {
+			for dvcs, l := range ldeps {
+				parts := strings.Split(strings.TrimPrefix(l.Ref, "/ipfs/"), "/")
+				if _, err := parseHash(parts[0]); err != nil {
+					bad = append(bad, fmt.Sprintf("lock of %s: %s", dvcs, err))
+				}
+				check(l.Deps)
+			}
+		}
+	}
+	check(lck.Deps)
+	sort.Strings(bad)
+	return bad
+}
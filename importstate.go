@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+
+	gx "github.com/whyrusleeping/gx/gxutil"
+)
+
+const defaultImportState = ".gx-go-import.json"
+
+// importState is the progress of an import, saved as packages get published
+// so that an interrupted import can be resumed.
+type importState struct {
+	Root      string                    `json:"root"`
+	Published map[string]*gx.Dependency `json:"published"`
+	Pending   []string                  `json:"pending,omitempty"`
+}
+
+// resumeState loads the progress of a previous import of `root` saved at
+// `p` into the importer, and has the importer save its progress there.
+func (i *Importer) resumeState(p, root string) error {
+	i.statePath = p
+	i.stateRoot = root
+
+	data, err := ioutil.ReadFile(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	var st importState
+	if err := json.Unmarshal(data, &st); err != nil {
+		return fmt.Errorf("parsing import state %s: %s", p, err)
+	}
+
+	if st.Root != root {
+		Warn("ignoring import state %s for a different package (%s)", p, st.Root)
+		return nil
+	}
+
+	Log("resuming import of %s, %d packages already published", root, len(st.Published))
+	for imp, dep := range st.Published {
+		i.pkgs[imp] = dep
+	}
+	return nil
+}
+
+// saveState writes the progress of the import, if it has a state file.
+// It must be called with i.mu held.
+func (i *Importer) saveState() {
+	if i.statePath == "" {
+		return
+	}
+
+	st := importState{
+		Root:      i.stateRoot,
+		Published: i.pkgs,
+	}
+	for imp := range i.inflight {
+		st.Pending = append(st.Pending, imp)
+	}
+	sort.Strings(st.Pending)
+
+	data, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		Error("saving import state: %s", err)
+		return
+	}
+
+	// write then rename, so an interruption never leaves a partial file
+	tmp := i.statePath + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		Error("saving import state: %s", err)
+		return
+	}
+	if err := os.Rename(tmp, i.statePath); err != nil {
+		Error("saving import state: %s", err)
+	}
+}
+
+// clearState removes the state file once the import is complete.
+func (i *Importer) clearState() error {
+	if i.statePath == "" {
+		return nil
+	}
+
+	err := os.Remove(i.statePath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// writeImportReport writes the packages published by an import as json to
+// the file `p`, or to stdout if it is "-" or --json is set.
+func writeImportReport(p string, published []ImportedPackage) error {
+	if p == "-" || (p == "" && jsonOutput) {
+		return printJSON(published)
+	}
+	if p == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(published, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(p, append(data, '\n'), 0644)
+}
+
+// updateImportMap adds the dvcs imports published by an import that are
+// missing from `mapping` to it, and writes the result to `p`.
+func updateImportMap(p string, mapping map[string]string, published []ImportedPackage) error {
+	out := make(map[string]string)
+	for imp, hash := range mapping {
+		out[imp] = hash
+	}
+
+	var added int
+	for _, ip := range published {
+		if _, ok := out[ip.DvcsImport]; !ok {
+			out[ip.DvcsImport] = ip.Hash
+			added++
+		}
+	}
+
+	data, err := json.MarshalIndent(out, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	Log("adding %d new entries to %s", added, p)
+	return ioutil.WriteFile(p, append(data, '\n'), 0644)
+}
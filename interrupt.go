@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	rw "github.com/whyrusleeping/gx-go/rewrite"
+)
+
+// Commands leaving the tree inconsistent when killed halfway (rewrite, link,
+// import) handle SIGINT and SIGTERM instead: they stop at the next safe
+// point and undo what they left unfinished. A second signal exits at once.
+
+// errInterrupted is returned by the operations stopped by a signal.
+var errInterrupted = errors.New("interrupted")
+
+// interrupted is set once a signal was received, so that the operations
+// failing because of it aren't retried.
+var interrupted int32
+
+// isInterrupted returns whether a signal was received.
+func isInterrupted() bool {
+	return atomic.LoadInt32(&interrupted) != 0
+}
+
+// interruptContext returns a context cancelled on SIGINT or SIGTERM, until
+// the returned function is called.
+func interruptContext() (context.Context, func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+
+	done := make(chan struct{})
+	go func() {
+		select {
+		case sig := <-sigs:
+			Warn("received %s, stopping (send it again to exit right away)", sig)
+			atomic.StoreInt32(&interrupted, 1)
+			cancel()
+		case <-done:
+			return
+		}
+		select {
+		case <-sigs:
+			Fatal("exiting without cleaning up")
+		case <-done:
+		}
+	}()
+
+	return ctx, func() {
+		signal.Stop(sigs)
+		close(done)
+		cancel()
+	}
+}
+
+// rewriteOp holds the interrupt context and the progress shared by the
+// rewrites of a command. A nil one rewrites without either.
+type rewriteOp struct {
+	ctx context.Context
+
+	// the progress of the rewrites, started by the first one, if they
+	// report it
+	report bool
+	once   sync.Once
+	p      *progress
+}
+
+// startRewrites returns the rewriteOp of a command, whose rewrites stop on
+// SIGINT or SIGTERM, restoring the files they rewrote, and report their
+// progress. It must be ended with the returned function.
+func startRewrites() (*rewriteOp, func()) {
+	ctx, stop := interruptContext()
+	op := &rewriteOp{ctx: ctx, report: true}
+	return op, func() {
+		if op.p != nil {
+			op.p.Done()
+		}
+		stop()
+	}
+}
+
+// counter returns the progress the files rewritten are counted with, if
+// any.
+func (op *rewriteOp) counter() rw.Counter {
+	if !op.report {
+		return nil
+	}
+	op.once.Do(func() {
+		op.p = newProgress("rewriting", "files", 0)
+	})
+	return op.p
+}
+
+// rewrite rewrites the imports under `path` with `rwf` as rw.RewriteImports
+// does, skipping the vendor directory of the package at `path`. The files
+// rewritten are restored if the command is interrupted.
+func (op *rewriteOp) rewrite(path string, rwf func(string) string, filter func(string) bool) error {
+	ctx, c := context.Background(), rw.Counter(nil)
+	if op != nil {
+		if op.ctx != nil {
+			ctx = op.ctx
+		}
+		c = op.counter()
+	}
+
+	err := rw.RewriteImportsContext(ctx, path, packageVendorRoot(path), rwf, filter, c)
+	if err == context.Canceled {
+		Log("restored the files rewritten in %s", path)
+		return errInterrupted
+	}
+	return err
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	cli "github.com/urfave/cli"
+	gx "github.com/whyrusleeping/gx/gxutil"
+)
+
+var LicensesCommand = cli.Command{
+	Name:  "licenses",
+	Usage: "detect the licenses of all dependencies of the current package",
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "allow",
+			Usage: "comma separated list of allowed licenses, fail if any dependency uses another one",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		root, err := gx.GetPackageRoot()
+		if err != nil {
+			return err
+		}
+
+		pkg, err := LoadPackageFile(filepath.Join(root, gx.PkgFileName))
+		if err != nil {
+			return err
+		}
+
+		pkgdir := filepath.Join(root, vendorDir)
+		deps, err := collectDeps(pkg, pkgdir)
+		if err != nil {
+			return err
+		}
+
+		var allowed map[string]bool
+		if a := c.String("allow"); a != "" {
+			allowed = make(map[string]bool)
+			for _, l := range strings.Split(a, ",") {
+				allowed[strings.TrimSpace(l)] = true
+			}
+		}
+
+		var hashes []string
+		for h := range deps {
+			hashes = append(hashes, h)
+		}
+		sort.Slice(hashes, func(i, j int) bool {
+			return deps[hashes[i]].Name < deps[hashes[j]].Name
+		})
+
+		type licenseInfo struct {
+			Name     string `json:"name"`
+			Version  string `json:"version"`
+			Detected string `json:"detected"`
+			Declared string `json:"declared,omitempty"`
+		}
+
+		var bad []string
+		var infos []licenseInfo
+		w := tabwriter.NewWriter(os.Stdout, 12, 4, 1, ' ', 0)
+		fmt.Fprintf(w, "NAME\tVERSION\tDETECTED\tDECLARED\n")
+		for _, h := range hashes {
+			dpkg := deps[h]
+
+			dir, err := findDepDir(h, pkgdir)
+			if err != nil {
+				return err
+			}
+
+			detected, err := detectLicense(filepath.Join(dir, dpkg.Name))
+			if err != nil {
+				return err
+			}
+
+			infos = append(infos, licenseInfo{dpkg.Name, dpkg.Version, detected, dpkg.License})
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", dpkg.Name, dpkg.Version, detected, dpkg.License)
+
+			if allowed != nil && !allowed[detected] {
+				bad = append(bad, fmt.Sprintf("%s (%s)", dpkg.Name, detected))
+			}
+		}
+		if jsonOutput {
+			if err := printJSON(infos); err != nil {
+				return err
+			}
+		} else {
+			w.Flush()
+		}
+
+		if len(bad) > 0 {
+			return fmt.Errorf("dependencies with disallowed licenses: %s", strings.Join(bad, ", "))
+		}
+		return nil
+	},
+}
+
+var licenseFileRE = regexp.MustCompile(`(?i)^(licen[cs]e|copying|unlicense)(\..*)?$`)
+
+// licensePatterns are checked in order, so more specific licenses must
+// come before the ones whose text they contain.
+var licensePatterns = []struct {
+	id string
+	re *regexp.Regexp
+}{
+	{"AGPL-3.0", regexp.MustCompile(`(?i)GNU AFFERO GENERAL PUBLIC LICENSE`)},
+	{"LGPL-3.0", regexp.MustCompile(`(?is)GNU LESSER GENERAL PUBLIC LICENSE.*Version 3`)},
+	{"LGPL-2.1", regexp.MustCompile(`(?is)GNU LESSER GENERAL PUBLIC LICENSE.*Version 2\.1`)},
+	{"GPL-3.0", regexp.MustCompile(`(?is)GNU GENERAL PUBLIC LICENSE.*Version 3`)},
+	{"GPL-2.0", regexp.MustCompile(`(?is)GNU GENERAL PUBLIC LICENSE.*Version 2`)},
+	{"MPL-2.0", regexp.MustCompile(`(?i)Mozilla Public License,? (Version|v\.?) ?2\.0`)},
+	{"Apache-2.0", regexp.MustCompile(`(?i)Apache License,?\s+Version 2\.0`)},
+	{"BSD-3-Clause", regexp.MustCompile(`(?is)Redistributions of source code.*Neither the name`)},
+	{"BSD-2-Clause", regexp.MustCompile(`(?is)Redistributions of source code.*Redistributions in binary form`)},
+	{"ISC", regexp.MustCompile(`(?i)Permission to use, copy, modify, and(/or)? distribute this software for any`)},
+	{"MIT", regexp.MustCompile(`(?i)Permission is hereby granted, free of charge, to any person`)},
+	{"Unlicense", regexp.MustCompile(`(?i)This is free and unencumbered software released into the public domain`)},
+	{"CC0-1.0", regexp.MustCompile(`(?i)CC0 1\.0 Universal`)},
+}
+
+// detectLicense guesses the license of the package in `dir` from the
+// license files at its top level. It returns "UNKNOWN" if there are
+// none or their text isn't recognized.
+func detectLicense(dir string) (string, error) {
+	dirents, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return "", err
+	}
+
+	found := make(map[string]bool)
+	for _, e := range dirents {
+		if e.IsDir() || !licenseFileRE.MatchString(e.Name()) {
+			continue
+		}
+
+		data, err := ioutil.ReadFile(filepath.Join(dir, e.Name()))
+		if err != nil {
+			return "", err
+		}
+
+		for _, lp := range licensePatterns {
+			if lp.re.Match(data) {
+				found[lp.id] = true
+				break
+			}
+		}
+	}
+
+	if len(found) == 0 {
+		return "UNKNOWN", nil
+	}
+
+	var ids []string
+	for id := range found {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return strings.Join(ids, " AND "), nil
+}
@@ -1,10 +1,10 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strings"
 
@@ -79,6 +79,14 @@ unlinked go-unixfs /home/user/go/src/github.com/ipfs/go-unixfs
 			}
 
 			if !remove {
+				if jsonOutput {
+					out := make(map[string]string)
+					for _, link := range links {
+						out[link[0]] = link[1]
+					}
+					return printJSON(out)
+				}
+
 				for _, link := range links {
 					fmt.Printf("%s %s\n", link[0], link[1])
 				}
@@ -98,27 +106,55 @@ unlinked go-unixfs /home/user/go/src/github.com/ipfs/go-unixfs
 				parentPackagePath, err)
 		}
 
+		ctx, stop := interruptContext()
+		defer stop()
+
+		verb := "linking"
+		if remove {
+			verb = "unlinking"
+		}
+		bar := newProgress(verb, "packages", len(depRefs))
+		defer bar.Done()
+
+		results := make(map[string]string)
 		for _, ref := range depRefs {
+			if ctx.Err() != nil {
+				return errInterrupted
+			}
+
 			dep := parentPkg.FindDep(ref)
 			if dep == nil {
 				return fmt.Errorf("dependency reference not found in the parent package: %s", ref)
 			}
 
 			if remove {
-				target, err := unlinkDependency(dep)
+				target, err := unlinkDependency(ctx, dep)
 				if err != nil {
 					return err
 				}
-				fmt.Printf("unlinked %s %s\n", dep.Name, target)
+				results[dep.Name] = target
+				if !jsonOutput {
+					clearProgress()
+					fmt.Printf("unlinked %s %s\n", dep.Name, target)
+				}
 			} else {
-				target, err := linkDependency(dep, overrideDeps, parentPackagePath)
+				target, err := linkDependency(ctx, dep, overrideDeps, parentPackagePath)
 				if err != nil {
 					return err
 				}
-				fmt.Printf("linked %s %s\n", dep.Name, target)
+				results[dep.Name] = target
+				if !jsonOutput {
+					clearProgress()
+					fmt.Printf("linked %s %s\n", dep.Name, target)
+				}
 			}
+			bar.Add(1)
 		}
+		bar.Done()
 
+		if jsonOutput {
+			return printJSON(results)
+		}
 		return nil
 	},
 }
@@ -126,7 +162,7 @@ unlinked go-unixfs /home/user/go/src/github.com/ipfs/go-unixfs
 func listLinkedPackages() ([][]string, error) {
 	var links [][]string
 
-	srcdir, err := gx.InstallPath("go", "", true)
+	srcdir, err := installPath("", true)
 	if err != nil {
 		return links, err
 	}
@@ -165,13 +201,16 @@ func listLinkedPackages() ([][]string, error) {
 //                               (`target`)  ->   (`linkPath`)
 // If `overrideDeps` is set pass the option to the `post-install` hook to override
 // dependency versions.
-func linkDependency(dep *gx.Dependency, overrideDeps bool, parentPackagePath string) (string, error) {
-	gxSrcDir, err := gx.InstallPath("go", "", true)
+func linkDependency(ctx context.Context, dep *gx.Dependency, overrideDeps bool, parentPackagePath string) (string, error) {
+	// the progress of link is reported instead of the one of its rewrites
+	op := &rewriteOp{ctx: ctx}
+
+	gxSrcDir, err := installPath("", true)
 	if err != nil {
 		return "", err
 	}
 
-	dvcsImport, err := findDepDVCSimport(dep, gxSrcDir)
+	dvcsImport, err := findDepDVCSimport(dep)
 	if err != nil {
 		return "", fmt.Errorf("error trying to get the DVCS import" +
 			"of the dependeny %s: %s", dep.Name, err)
@@ -187,11 +226,18 @@ func linkDependency(dep *gx.Dependency, overrideDeps bool, parentPackagePath str
 	linkPath := filepath.Join(linkPackageDir, dep.Name)
 
 	_, err = os.Stat(target)
-	if os.IsNotExist(err) {
-		goget := exec.Command("go", "get", dvcsImport+"/...")
-		goget.Stdout = nil
-		goget.Stderr = os.Stderr
-		if err = goget.Run(); err != nil {
+	if os.IsNotExist(err) && viaModCache(dvcsImport) {
+		if _, err := fetchFromModCache(dvcsImport, gxSrcDir); err != nil {
+			return "", err
+		}
+	} else if os.IsNotExist(err) {
+		err = withRetries("go get "+dvcsImport, func() error {
+			goget := command("go", "get", dvcsImport+"/...")
+			goget.Stdout = nil
+			goget.Stderr = barClearingWriter{}
+			return goget.Run()
+		})
+		if err != nil {
 			return "", fmt.Errorf("error during go get: %s", err)
 		}
 	} else if err != nil {
@@ -202,43 +248,64 @@ func linkDependency(dep *gx.Dependency, overrideDeps bool, parentPackagePath str
 	if err != nil {
 		return "", fmt.Errorf("error during os.RemoveAll: %s", err)
 	}
+	if err := os.MkdirAll(linkPackageDir, 0755); err != nil {
+		return "", err
+	}
 
 	err = os.Symlink(target, linkPath)
 	if err != nil {
 		return "", fmt.Errorf("error during os.Symlink: %s", err)
 	}
 
-	gxinst := exec.Command("gx", "install")
-	gxinst.Dir = target
-	gxinst.Stdout = nil
-	gxinst.Stderr = os.Stderr
-	if err = gxinst.Run(); err != nil {
-		return "", fmt.Errorf("error during gx install: %s", err)
+	// until the link is complete, an interruption puts the package back
+	undo := func() error {
+		Log("unlinking %s", dep.Name)
+		if err := os.Remove(linkPath); err != nil {
+			return fmt.Errorf("interrupted, and removing the link %s failed: %s", linkPath, err)
+		}
+		if err := materialize(dep.Hash, linkPackageDir); err != nil {
+			return fmt.Errorf("interrupted, and reinstalling %s failed: %s", dep.Name, err)
+		}
+		return errInterrupted
+	}
+
+	err = withRetries("gx install", func() error {
+		return gxInstall(target, true)
+	})
+	if ctx.Err() != nil {
+		return "", undo()
+	}
+	if err != nil {
+		return "", err
 	}
 
-	rwcmdArgs := []string{"hook", "post-install", linkPackageDir}
+	var depsPkgDir string
 	if overrideDeps {
-		rwcmdArgs = append(rwcmdArgs, "--override-deps", parentPackagePath)
+		depsPkgDir = parentPackagePath
 	}
-	rwcmd := exec.Command("gx-go", rwcmdArgs...)
-	rwcmd.Dir = target
-	rwcmd.Stdout = os.Stdout
-	rwcmd.Stderr = os.Stderr
-	if err := rwcmd.Run(); err != nil {
-		return "", fmt.Errorf("error during gx-go rw: %s", err)
+	err = postInstall(op, []string{linkPackageDir}, depsPkgDir)
+	if ctx.Err() != nil {
+		return "", undo()
+	}
+	if err != nil {
+		return "", fmt.Errorf("error during post-install: %s", err)
+	}
+	if err := runUserHooks("post-install", []string{linkPackageDir}); err != nil {
+		return "", err
 	}
-	// TODO: Wrap command calls in a function.
 
 	return target, nil
 }
 
-// Return the DVCS import path of a dependency (fetching it
+// Return the DVCS import path of a dependency (fetching it into the store
 // if necessary).
-func findDepDVCSimport(dep *gx.Dependency, gxSrcDir string) (string, error) {
-	gxdir := filepath.Join(gxSrcDir, "gx", "ipfs", dep.Hash)
+func findDepDVCSimport(dep *gx.Dependency) (string, error) {
+	if pkg, ok := cachedPackage(dep.Hash); ok && pkg.Gx.DvcsImport != "" {
+		return pkg.Gx.DvcsImport, nil
+	}
 
 	// Get the dependency to find out its DVCS import.
-	err := gxGetPackage(dep.Hash)
+	gxdir, err := storeFetch(dep.Hash)
 	if err != nil {
 		return "", err
 	}
@@ -254,33 +321,34 @@ func findDepDVCSimport(dep *gx.Dependency, gxSrcDir string) (string, error) {
 
 // rm -rf $GOPATH/src/gx/ipfs/$hash
 // gx get $hash
-func unlinkDependency(dep *gx.Dependency) (string, error) {
-	gxSrcDir, err := gx.InstallPath("go", "", true)
+func unlinkDependency(ctx context.Context, dep *gx.Dependency) (string, error) {
+	gxSrcDir, err := installPath("", true)
 	if err != nil {
 		return "", err
 	}
 
-	dvcsImport, err := findDepDVCSimport(dep, gxSrcDir)
+	dvcsImport, err := findDepDVCSimport(dep)
 	if err != nil {
 		return "", fmt.Errorf("error trying to get the DVCS import of the dependeny %s: %s", dep.Name, err)
 	}
 
 	target := filepath.Join(gxSrcDir, dvcsImport)
 
-	uwcmd := exec.Command("gx-go", "rw", "--fix")
-	// The `--fix` options is more time consuming (compared to the normal
-	// `gx-go uw` call) but as some of the import paths may have been written
-	// from synced dependencies (`gx-go link --sync`) of another package that
-	// may not be available now (to build the rewrite map) this is the safer
-	// option.
-	uwcmd.Dir = target
-	uwcmd.Stdout = nil
-	uwcmd.Stderr = os.Stderr
-	if err := uwcmd.Run(); err != nil {
-		return "", fmt.Errorf("error during gx-go rw: %s", err)
+	// Fixing the imports is more time consuming than undoing the rewrite
+	// (`gx-go rw --fix` compared to `gx-go uw`) but as some of the import
+	// paths may have been written from synced dependencies (`gx-go link
+	// --sync`) of another package that may not be available now (to build
+	// the rewrite map) this is the safer option.
+	// the progress of link is reported instead of the one of its rewrites
+	unresolved, err := fixImports(&rewriteOp{ctx: ctx}, target)
+	if err != nil {
+		return "", fmt.Errorf("error fixing the imports of %s: %s", target, err)
+	}
+	for _, u := range unresolved {
+		Warn("%s: could not resolve %s, its imports were left as is: %s", target, u.Hash, u.Error)
 	}
 
-	// Remove the package at the end as `gx-go rw --fix` will need to use it
+	// Remove the package at the end as fixing the imports needs it
 	// (to find the DVCS import paths).
 	err = os.RemoveAll(filepath.Join(gxSrcDir, "gx", "ipfs", dep.Hash))
 	if err != nil {
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	gx "github.com/whyrusleeping/gx/gxutil"
+)
+
+type lockedDep struct {
+	dvcs string
+	lock gx.Lock
+}
+
+// genFullLockDeps fills `deps` with a lock for every dependency of `pkg`,
+// each carrying the locks of its own dependencies, so that the exact hash
+// of every transitive dependency is recorded even when two packages
+// depend on different versions of the same import. `cache` memoizes the
+// lock generated for each hash.
+func genFullLockDeps(pkg *Package, deps map[string]gx.Lock, cache map[string]*lockedDep) error {
+	for _, dep := range pkg.Dependencies {
+		ld, ok := cache[dep.Hash]
+		if !ok {
+			var cpkg Package
+			err := gx.LoadPackage(&cpkg, pkg.Language, dep.Hash)
+			if err != nil {
+				if os.IsNotExist(err) {
+					VLog("LoadPackage error: %s", err)
+					return fmt.Errorf("package %s (%s) not found", dep.Name, dep.Hash)
+				}
+				return err
+			}
+
+			ld = &lockedDep{
+				dvcs: cpkg.Gx.DvcsImport,
+				lock: gx.Lock{
+					Ref: fmt.Sprintf("/ipfs/%s/%s", dep.Hash, dep.Name),
+				},
+			}
+
+			if len(cpkg.Dependencies) > 0 {
+				sub := make(map[string]gx.Lock)
+				if err := genFullLockDeps(&cpkg, sub, cache); err != nil {
+					return err
+				}
+				ld.lock.Deps = map[string]map[string]gx.Lock{pkg.Language: sub}
+			}
+
+			cache[dep.Hash] = ld
+		}
+
+		if ld.dvcs == "" {
+			VLog("package %s (%s) has no dvcs import, skipping", dep.Name, dep.Hash)
+			continue
+		}
+		deps[ld.dvcs] = ld.lock
+	}
+
+	return nil
+}
+
+// loadRootLockFile loads the lock file in `root`, returning nil if there
+// is none.
+func loadRootLockFile(root string) (*gx.LockFile, error) {
+	var lck gx.LockFile
+	err := gx.LoadLockFile(&lck, filepath.Join(root, gx.LckFileName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	if bad := invalidLockHashes(&lck); len(bad) > 0 {
+		return nil, fmt.Errorf("%s: %s", gx.LckFileName, bad[0])
+	}
+
+	return &lck, nil
+}
+
+// lockRewriteMapping builds a rewrite mapping from a lock file instead of
+// from the package.json files of the dependencies. Direct dependencies take
+// precedence over transitive ones, as in `buildRewriteMapping`, but two
+// transitive dependencies locked to different hashes of a package the
+// root doesn't depend on are an error rather than resolved by walk order.
+// Undoing maps every hash locked back.
+func lockRewriteMapping(lck *gx.LockFile, m map[string]string, undo bool) error {
+	direct := make(map[string]string)
+	transitive := make(map[string][]string)
+	var process func(l gx.Lock, rootPackage bool) error
+	process = func(l gx.Lock, rootPackage bool) error {
+		for _, lang := range sortedLockLanguages(l.Deps) {
+			deps := l.Deps[lang]
+			for _, dvcs := range sortedLockImports(deps) {
+				to, err := lockImport(dvcs, deps[dvcs])
+				if err != nil {
+					return err
+				}
+
+				if rootPackage {
+					direct[dvcs] = to
+				} else if !containsString(transitive[dvcs], to) {
+					transitive[dvcs] = append(transitive[dvcs], to)
+				}
+			}
+		}
+
+		for _, lang := range sortedLockLanguages(l.Deps) {
+			deps := l.Deps[lang]
+			for _, dvcs := range sortedLockImports(deps) {
+				if err := process(deps[dvcs], false); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+
+	if err := process(lck.Lock, true); err != nil {
+		return err
+	}
+
+	if undo {
+		// every hash maps back, whichever version was used
+		for dvcs, tos := range transitive {
+			for _, to := range tos {
+				m[to] = dvcs
+			}
+		}
+		for dvcs, to := range direct {
+			m[to] = dvcs
+		}
+		return nil
+	}
+
+	for dvcs, tos := range transitive {
+		if _, ok := direct[dvcs]; ok {
+			continue
+		}
+		if len(tos) > 1 {
+			sort.Strings(tos)
+			return fmt.Errorf("%s is locked to both %s and %s by different dependencies, add the one to use to package.json", dvcs, tos[0], tos[1])
+		}
+		m[dvcs] = tos[0]
+	}
+	for dvcs, to := range direct {
+		m[dvcs] = to
+	}
+	return nil
+}
+
+// lockImport returns the gx import path of the lock `l` of `dvcs`.
+func lockImport(dvcs string, l gx.Lock) (string, error) {
+	parts := strings.Split(strings.TrimPrefix(l.Ref, "/ipfs/"), "/")
+	if len(parts) != 2 {
+		return "", fmt.Errorf("invalid lock reference for %s: %q", dvcs, l.Ref)
+	}
+	return "gx/ipfs/" + parts[0] + "/" + parts[1], nil
+}
+
+// findLock returns the lock of the package `hash` within `l`, which holds
+// the hashes its own dependencies are locked to.
+func findLock(l gx.Lock, hash string) (gx.Lock, bool) {
+	for _, lang := range sortedLockLanguages(l.Deps) {
+		deps := l.Deps[lang]
+		for _, dvcs := range sortedLockImports(deps) {
+			dl := deps[dvcs]
+			if strings.HasPrefix(dl.Ref, "/ipfs/"+hash+"/") {
+				return dl, true
+			}
+			if found, ok := findLock(dl, hash); ok {
+				return found, true
+			}
+		}
+	}
+	return gx.Lock{}, false
+}
+
+// checkLockDeps warns about the direct dependencies of `pkg` and `lck`
+// that differ, as the lock file is then out of date and is what rewrites
+// use.
+func checkLockDeps(pkg *Package, lck *gx.LockFile) {
+	locked := make(map[string]bool)
+	for _, deps := range lck.Deps {
+		for _, dl := range deps {
+			locked[strings.Split(strings.TrimPrefix(dl.Ref, "/ipfs/"), "/")[0]] = true
+		}
+	}
+
+	var stale bool
+	for _, dep := range pkg.Dependencies {
+		if !locked[dep.Hash] {
+			Warn("%s %s is a dependency in package.json but isn't in %s", dep.Name, dep.Hash, gx.LckFileName)
+			stale = true
+		}
+		delete(locked, dep.Hash)
+	}
+	for hash := range locked {
+		Warn("%s is in %s but isn't a dependency in package.json", hash, gx.LckFileName)
+		stale = true
+	}
+	if stale {
+		Warn("%s is out of date but is what imports are rewritten with, regenerate it with `gx-go lock-gen --transitive`", gx.LckFileName)
+	}
+}
+
+func sortedLockLanguages(deps map[string]map[string]gx.Lock) []string {
+	langs := make([]string, 0, len(deps))
+	for lang := range deps {
+		langs = append(langs, lang)
+	}
+	sort.Strings(langs)
+	return langs
+}
+
+func sortedLockImports(deps map[string]gx.Lock) []string {
+	imps := make([]string, 0, len(deps))
+	for dvcs := range deps {
+		imps = append(imps, dvcs)
+	}
+	sort.Strings(imps)
+	return imps
+}
+
+// buildPackageRewriteMapping builds the rewrite mapping for the package in
+// `root`, using its lock file if it has one.
+func buildPackageRewriteMapping(pkg *Package, root, pkgdir string, m map[string]string, undo bool) error {
+	lck, err := loadRootLockFile(root)
+	if err != nil {
+		return err
+	}
+
+	if lck != nil {
+		VLog("  - using rewrite mapping from %s", gx.LckFileName)
+		checkLockDeps(pkg, lck)
+		return lockRewriteMapping(lck, m, undo)
+	}
+
+	return buildRewriteMapping(pkg, pkgdir, m, undo)
+}
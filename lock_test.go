@@ -0,0 +1,80 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	gx "github.com/whyrusleeping/gx/gxutil"
+)
+
+// testLockFile returns a lock file of the go dependencies `deps`, each a
+// ref followed by the names and refs of its own dependencies.
+func testLockFile(deps map[string][]string) *gx.LockFile {
+	lock := func(ref string, sub ...string) gx.Lock {
+		l := gx.Lock{Ref: ref}
+		if len(sub) > 0 {
+			l.Deps = map[string]map[string]gx.Lock{"go": {}}
+			for i := 0; i < len(sub); i += 2 {
+				l.Deps["go"][sub[i]] = gx.Lock{Ref: sub[i+1]}
+			}
+		}
+		return l
+	}
+
+	lck := &gx.LockFile{Lock: gx.Lock{Deps: map[string]map[string]gx.Lock{"go": {}}}}
+	for name, refs := range deps {
+		lck.Deps["go"][name] = lock(refs[0], refs[1:]...)
+	}
+	return lck
+}
+
+func TestLockRewriteMapping(t *testing.T) {
+	lck := testLockFile(map[string][]string{
+		"github.com/x/a": {"/ipfs/QmA2/a"},
+		"github.com/x/b": {"/ipfs/QmB/b", "github.com/x/a", "/ipfs/QmA1/a"},
+		"github.com/x/c": {"/ipfs/QmC/c", "github.com/x/d", "/ipfs/QmD/d"},
+	})
+
+	m := make(map[string]string)
+	if err := lockRewriteMapping(lck, m, false); err != nil {
+		t.Fatal(err)
+	}
+	// the version of a the package depends on directly wins over the one b
+	// is locked to
+	exp := map[string]string{
+		"github.com/x/a": "gx/ipfs/QmA2/a",
+		"github.com/x/b": "gx/ipfs/QmB/b",
+		"github.com/x/c": "gx/ipfs/QmC/c",
+		"github.com/x/d": "gx/ipfs/QmD/d",
+	}
+	if !reflect.DeepEqual(m, exp) {
+		t.Fatalf("got %v, expected %v", m, exp)
+	}
+}
+
+func TestLockRewriteMappingConflict(t *testing.T) {
+	lck := testLockFile(map[string][]string{
+		"github.com/x/b": {"/ipfs/QmB/b", "github.com/x/a", "/ipfs/QmA1/a"},
+		"github.com/x/c": {"/ipfs/QmC/c", "github.com/x/a", "/ipfs/QmA2/a"},
+	})
+
+	err := lockRewriteMapping(lck, make(map[string]string), false)
+	if err == nil {
+		t.Fatal("expected two versions of a to conflict")
+	}
+	if !strings.Contains(err.Error(), "locked to both gx/ipfs/QmA1/a and gx/ipfs/QmA2/a") {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// undoing maps both versions back, without conflict
+	m := make(map[string]string)
+	if err := lockRewriteMapping(lck, m, true); err != nil {
+		t.Fatal(err)
+	}
+	for _, imp := range []string{"gx/ipfs/QmA1/a", "gx/ipfs/QmA2/a"} {
+		if m[imp] != "github.com/x/a" {
+			t.Errorf("%s maps to %q, expected github.com/x/a", imp, m[imp])
+		}
+	}
+}
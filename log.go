@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	stump "github.com/whyrusleeping/stump"
+)
+
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var levelNames = map[logLevel]string{
+	levelDebug: "debug",
+	levelInfo:  "info",
+	levelWarn:  "warn",
+	levelError: "error",
+}
+
+// setLogLevel sets the minimum level of the logs to print, for gx-go and for
+// the gx library, which logs through stump.
+func setLogLevel(l logLevel) {
+	logMin = l
+	stump.Verbose = l == levelDebug
+	stump.LogOut = logOut
+	stump.ErrOut = logOut
+}
+
+func parseLogLevel(s string) (logLevel, error) {
+	for l, name := range levelNames {
+		if name == s {
+			return l, nil
+		}
+	}
+	return 0, fmt.Errorf("unrecognized log level %q (must be debug, info, warn or error)", s)
+}
+
+// Diagnostics always go to stderr so that stdout only carries the output
+// of commands.
+var (
+	logOut    io.Writer = os.Stderr
+	logMin              = levelInfo
+	logFormat           = "text"
+)
+
+// Log logs at info level. Like all the logging functions, it takes a
+// format string followed by its arguments, as fmt.Printf does.
+func Log(format string, args ...interface{}) {
+	logAt(levelInfo, format, args...)
+}
+
+// VLog logs at debug level, shown with --verbose or --log-level=debug.
+func VLog(format string, args ...interface{}) {
+	logAt(levelDebug, format, args...)
+}
+
+func Warn(format string, args ...interface{}) {
+	logAt(levelWarn, format, args...)
+}
+
+func Error(format string, args ...interface{}) {
+	logAt(levelError, format, args...)
+}
+
+func Fatal(format string, args ...interface{}) {
+	Error(format, args...)
+	os.Exit(1)
+}
+
+func logAt(level logLevel, format string, args ...interface{}) {
+	if level < logMin {
+		return
+	}
+
+	msg := strings.TrimSuffix(fmt.Sprintf(format, args...), "\n")
+	if logFormat == "json" {
+		out, err := json.Marshal(map[string]string{
+			"time":  time.Now().Format(time.RFC3339),
+			"level": levelNames[level],
+			"msg":   msg,
+		})
+		if err != nil {
+			return
+		}
+		fmt.Fprintln(logOut, string(out))
+		return
+	}
+
+	switch level {
+	case levelWarn:
+		msg = colored(colorYellow, "WARNING:") + " " + msg
+	case levelError:
+		msg = colored(colorRed, "ERROR:") + " " + msg
+	}
+
+	termMu.Lock()
+	defer termMu.Unlock()
+	clearBar()
+	fmt.Fprintln(logOut, msg)
+}
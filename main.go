@@ -9,20 +9,59 @@ import (
 	"os/exec"
 	"path"
 	"path/filepath"
-	"runtime"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"text/tabwriter"
 
 	homedir "github.com/mitchellh/go-homedir"
 	cli "github.com/urfave/cli"
-	rw "github.com/whyrusleeping/gx-go/rewrite"
 	gx "github.com/whyrusleeping/gx/gxutil"
-	. "github.com/whyrusleeping/stump"
 )
 
-var vendorDir = filepath.Join("vendor", "gx", "ipfs")
+const defaultVendorRoot = "vendor"
+
+// vendorRoot is the directory, relative to the package root, that packages
+// are installed into locally. gx places them under gx/ipfs within it.
+var vendorRoot = defaultVendorRoot
+
+var vendorDir = filepath.Join(vendorRoot, "gx", "ipfs")
+
+// setVendorRoot sets the local install directory to the one of the package
+// at `root`.
+func setVendorRoot(root string) {
+	vendorRoot = packageVendorRoot(root)
+	vendorDir = filepath.Join(vendorRoot, "gx", "ipfs")
+}
+
+// packageVendorRoot returns the local install directory of the package at
+// `root`. In order of precedence, it is taken from GX_GO_VENDOR_DIR, the
+// vendordir field of its package.json, and the config.
+func packageVendorRoot(root string) string {
+	dir := config.VendorDir
+
+	var pkg Package
+	if err := gx.LoadPackageFile(&pkg, filepath.Join(root, gx.PkgFileName)); err == nil && pkg.Gx.VendorDir != "" {
+		dir = pkg.Gx.VendorDir
+	}
+
+	if env := os.Getenv("GX_GO_VENDOR_DIR"); env != "" {
+		dir = env
+	}
+
+	if dir == "" {
+		return defaultVendorRoot
+	}
+
+	// packages get installed within the package, never outside of it
+	dir = filepath.Clean(filepath.FromSlash(dir))
+	if filepath.IsAbs(dir) || dir == "." || dir == ".." || strings.HasPrefix(dir, ".."+string(filepath.Separator)) {
+		Warn("ignoring vendor dir %q, it must be a subdirectory of the package", dir)
+		return defaultVendorRoot
+	}
+	return dir
+}
 
 var cwd string
 
@@ -31,8 +70,46 @@ type GoInfo struct {
 	DvcsImport string `json:"dvcsimport,omitempty"`
 
 	// GoVersion sets a compiler version requirement, users will be warned if installing
-	// a package using an unsupported compiler
+	// a package using an unsupported compiler. It is a minimum version or a
+	// constraint such as ">=1.12 <1.20 || >=1.21", see goVersionMatches.
 	GoVersion string `json:"goversion,omitempty"`
+
+	// DvcsCommit is the upstream commit this package was published from
+	DvcsCommit string `json:"dvcscommit,omitempty"`
+
+	// DvcsTag is the upstream tag of DvcsCommit, if any
+	DvcsTag string `json:"dvcstag,omitempty"`
+
+	// DvcsRepo is the url of the upstream repository
+	DvcsRepo string `json:"dvcsrepo,omitempty"`
+
+	// ExternalDeps are the imports this package depends on that were left
+	// out of gx when it was imported, and must be provided externally
+	ExternalDeps []string `json:"externaldeps,omitempty"`
+
+	// VendorDir overrides the directory dependencies are installed into
+	// locally, "vendor" by default
+	VendorDir string `json:"vendordir,omitempty"`
+
+	// RequiresCgo is set for packages that can't be built without cgo
+	RequiresCgo bool `json:"requirescgo,omitempty"`
+
+	// SupportedOS and SupportedArch list the GOOS and GOARCH values the
+	// package builds for, any if empty
+	SupportedOS   []string `json:"supportedos,omitempty"`
+	SupportedArch []string `json:"supportedarch,omitempty"`
+
+	// Tools are the external programs needed to build the package
+	Tools []ToolReq `json:"tools,omitempty"`
+}
+
+// ToolReq is an external program a package needs to build, such as protoc.
+type ToolReq struct {
+	Name       string `json:"name"`
+	MinVersion string `json:"minversion,omitempty"`
+
+	// VersionFlag makes the tool print its version, --version by default
+	VersionFlag string `json:"versionflag,omitempty"`
 }
 
 type Package struct {
@@ -53,71 +130,275 @@ func LoadPackageFile(name string) (*Package, error) {
 		return nil, err
 	}
 
+	if bad := invalidDepHashes(&pkg); len(bad) > 0 {
+		return nil, fmt.Errorf("%s: %s", name, bad[0])
+	}
+
 	return &pkg, nil
 }
 
+// gxGoVersion is the version of gx-go.
+const gxGoVersion = "1.9.0"
+
 func main() {
 	app := cli.NewApp()
 	app.Name = "gx-go"
 	app.Author = "whyrusleeping"
 	app.Usage = "gx extensions for golang"
-	app.Version = "1.9.0"
+	app.Version = gxGoVersion
 	app.Flags = []cli.Flag{
 		cli.BoolFlag{
 			Name:  "verbose",
 			Usage: "turn on verbose output",
 		},
+		cli.BoolFlag{
+			Name:  "json",
+			Usage: "print command results as json",
+		},
+		cli.BoolFlag{
+			Name:   "quiet, q",
+			Usage:  "only print errors and command results",
+			EnvVar: "GX_GO_QUIET",
+		},
+		cli.BoolFlag{
+			Name:   "modcache",
+			Usage:  "fetch dvcs sources through the go module cache instead of go get",
+			EnvVar: "GX_GO_MODCACHE",
+		},
+		cli.BoolFlag{
+			Name:   "yes, non-interactive",
+			Usage:  "never prompt, answer yes to questions and take the default for other prompts",
+			EnvVar: "GX_GO_NONINTERACTIVE",
+		},
+		cli.IntFlag{
+			Name:   "retries",
+			Usage:  "number of times to retry failed network operations",
+			Value:  3,
+			EnvVar: "GX_GO_RETRIES",
+		},
+		cli.DurationFlag{
+			Name:   "timeout",
+			Usage:  "kill the go, gx, git and gx-go commands spawned if they run longer than this (e.g. 10m), 0 for no limit",
+			EnvVar: "GX_GO_TIMEOUT",
+		},
+		cli.BoolFlag{
+			Name:  "no-color",
+			Usage: "don't color the output (also NO_COLOR)",
+		},
+		cli.BoolFlag{
+			Name:   "wait-lock",
+			Usage:  "wait for the other gx-go commands modifying the package to finish, instead of failing",
+			EnvVar: "GX_GO_WAIT_LOCK",
+		},
+		cli.StringFlag{
+			Name:  "log-level",
+			Usage: "minimum level of logs to print: debug, info, warn or error",
+			Value: "info",
+		},
+		cli.StringFlag{
+			Name:  "log-format",
+			Usage: "format of the logs printed to stderr: text or json",
+			Value: "text",
+		},
 	}
 	app.Before = func(c *cli.Context) error {
-		Verbose = c.Bool("verbose")
+		lvl, err := parseLogLevel(c.String("log-level"))
+		if err != nil {
+			return err
+		}
+		if c.Bool("verbose") {
+			lvl = levelDebug
+		}
+		quiet = c.Bool("quiet")
+		if quiet {
+			lvl = levelError
+		}
+		setLogLevel(lvl)
+
+		switch f := c.String("log-format"); f {
+		case "text", "json":
+			logFormat = f
+		default:
+			return fmt.Errorf("unrecognized log format %q (must be text or json)", f)
+		}
+
+		if err := loadConfig(); err != nil {
+			return err
+		}
+
+		jsonOutput = c.Bool("json")
+		retries = c.Int("retries")
+		cmdTimeout = c.Duration("timeout")
+		nonInteractive = c.Bool("yes") || config.NonInteractive
+		if nonInteractive && os.Getenv("GIT_TERMINAL_PROMPT") == "" {
+			// fail fetches needing credentials instead of hanging on a prompt
+			os.Setenv("GIT_TERMINAL_PROMPT", "0")
+		}
+		useModCache = c.Bool("modcache") || config.ModCache
+		waitLock = c.Bool("wait-lock")
+		noColor = c.Bool("no-color") || os.Getenv("NO_COLOR") != ""
 		return nil
 	}
 
 	mcwd, err := os.Getwd()
 	if err != nil {
-		Fatal("failed to get cwd:", err)
+		Fatal("failed to get cwd: %s", err)
 	}
 	lcwd, err := filepath.EvalSymlinks(mcwd)
 	if err != nil {
-		Fatal("failed to resolve symlinks of cdw:", err)
+		Fatal("failed to resolve symlinks of cdw: %s", err)
 	}
 	cwd = lcwd
 
 	app.Commands = []cli.Command{
 		DepMapCommand,
 		HookCommand,
-		ImportCommand,
+		withPackageLock(ImportCommand),
 		PathCommand,
-		RewriteCommand,
-		rewriteUndoAlias,
-		UpdateCommand,
+		withPackageLock(RewriteCommand),
+		withPackageLock(rewriteUndoAlias),
+		withPackageLock(UpdateCommand),
 		DvcsDepsCommand,
-		LinkCommand,
+		withPackageLock(LinkCommand),
 		LockGenCommand,
-
-		DevCopyCommand,
+		GcCommand,
+		DuCommand,
+		TreeCommand,
+		DiffCommand,
+		ChangelogCommand,
+		withPackageLock(BisectCommand),
+		BundleCommand,
+		withPackageLock(UnbundleCommand),
+		PinCommand,
+		SbomCommand,
+		LicensesCommand,
+		ExportCommand,
+		WorkspaceCommand,
+		RdepsCommand,
+		withPackageLock(ReleaseCommand),
+		TestCommand,
+		VerifyCommand,
+		DaemonCommand,
+		withPackageLock(EditorCommand),
+		withPackageLock(OverlayCommand),
+		withPackageLock(DedupCommand),
+		StoreCommand,
+		ResolveCacheCommand,
+		VersionCommand,
+
+		withPackageLock(DevCopyCommand),
 		// Go tool compat:
 		GetCommand,
 	}
 
+	app.After = func(c *cli.Context) error {
+		if err := saveResolveCache(); err != nil {
+			Warn("saving the resolve cache: %s", err)
+		}
+		return nil
+	}
+
 	if err := app.Run(os.Args); err != nil {
-		Fatal("Error: " + err.Error())
+		Fatal("%s", err)
 	}
 }
 
 var DepMapCommand = cli.Command{
 	Name:  "dep-map",
 	Usage: "prints out a json dep map for usage by 'import --map'",
+	Description: `dep-map prints a json map of dvcs imports to the hashes of the vendored
+packages providing them.
+
+With any of --versions, --depth or --parents each entry is an object
+holding the hash along with the requested extra information.
+
+With --reverse, the map goes from the hashes of all the packages in the
+dependency tree, including other versions of the same imports, to their
+dvcs import and name.
+
+With --merge, the dep maps of all the package directories given as
+arguments are combined into one. When packages disagree on the hash of
+an import, the first one given wins and the conflict is reported.`,
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "versions",
+			Usage: "include the name and version of each package",
+		},
+		cli.BoolFlag{
+			Name:  "depth",
+			Usage: "include the depth in the dependency tree of each package",
+		},
+		cli.BoolFlag{
+			Name:  "parents",
+			Usage: "include the package that introduced each entry",
+		},
+		cli.BoolFlag{
+			Name:  "reverse",
+			Usage: "map hashes to dvcs imports and package names instead",
+		},
+		cli.BoolFlag{
+			Name:  "merge",
+			Usage: "merge the dep maps of the package directories given as arguments",
+		},
+	},
 	Action: func(c *cli.Context) error {
-		pkg, err := LoadPackageFile(gx.PkgFileName)
-		if err != nil {
-			return err
+		var entries map[string]*DepMapEntry
+		var hashes map[string]ReverseDepMapEntry
+		if c.Bool("merge") {
+			if !c.Args().Present() {
+				return fmt.Errorf("must specify the package directories to merge")
+			}
+
+			merged, err := mergeDepMaps(c.Args())
+			if err != nil {
+				return err
+			}
+			entries = merged
+		} else {
+			pkg, err := LoadPackageFile(gx.PkgFileName)
+			if err != nil {
+				return err
+			}
+
+			entries = make(map[string]*DepMapEntry)
+			hashes = make(map[string]ReverseDepMapEntry)
+			err = walkMapEntries(pkg, vendorDir, 1, entries, hashes)
+			if err != nil {
+				return err
+			}
 		}
 
-		m := make(map[string]string)
-		err = buildMap(pkg, m)
-		if err != nil {
-			return err
+		var m interface{}
+		if c.Bool("reverse") {
+			if hashes == nil {
+				hashes = make(map[string]ReverseDepMapEntry)
+				for dvcs, e := range entries {
+					hashes[e.Hash] = ReverseDepMapEntry{
+						DvcsImport: dvcs,
+						Name:       e.Name,
+					}
+				}
+			}
+			m = hashes
+		} else if c.Bool("versions") || c.Bool("depth") || c.Bool("parents") {
+			for _, e := range entries {
+				if !c.Bool("versions") {
+					e.Name, e.Version = "", ""
+				}
+				if !c.Bool("depth") {
+					e.Depth = 0
+				}
+				if !c.Bool("parents") {
+					e.Parent = ""
+				}
+			}
+			m = entries
+		} else {
+			flat := make(map[string]string)
+			for dvcs, e := range entries {
+				flat[dvcs] = e.Hash
+			}
+			m = flat
 		}
 
 		out, err := json.MarshalIndent(m, "", "  ")
@@ -138,6 +419,10 @@ var LockGenCommand = cli.Command{
 			Name:  "ignore-conflicts",
 			Usage: "Does not error on conflicting import in sub-packages",
 		},
+		cli.BoolFlag{
+			Name:  "transitive",
+			Usage: "record the exact dependencies of every sub-package",
+		},
 	},
 	Action: func(c *cli.Context) error {
 		ignoreConflict := c.Bool("ignore-conflicts")
@@ -155,7 +440,12 @@ var LockGenCommand = cli.Command{
 		lockFile.Deps = make(map[string]map[string]gx.Lock)
 		lockFile.Deps[pkg.Language] = make(map[string]gx.Lock)
 
-		if err := genLockDeps(pkg, lockFile.Deps[pkg.Language], done, ignoreConflict); err != nil {
+		if c.Bool("transitive") {
+			cache := make(map[string]*lockedDep)
+			if err := genFullLockDeps(pkg, lockFile.Deps[pkg.Language], cache); err != nil {
+				return err
+			}
+		} else if err := genLockDeps(pkg, lockFile.Deps[pkg.Language], done, ignoreConflict); err != nil {
 			return err
 		}
 
@@ -172,26 +462,34 @@ var LockGenCommand = cli.Command{
 var HookCommand = cli.Command{
 	Name:  "hook",
 	Usage: "go specific hooks to be called by the gx tool",
+	Before: func(c *cli.Context) error {
+		warnGxCompat()
+		return nil
+	},
 	Subcommands: []cli.Command{
-		postImportCommand,
-		reqCheckCommand,
-		installLocHookCommand,
-		postInitHookCommand,
-		postUpdateHookCommand,
-		postInstallHookCommand,
-		preTestHookCommand,
-		postTestHookCommand,
-		testHookCommand,
+		withPackageLock(withUserHooks(postImportCommand)),
+		withUserHooks(reqCheckCommand),
+		withUserHooks(installLocHookCommand),
+		withPackageLock(withUserHooks(postInitHookCommand)),
+		withPackageLock(withUserHooks(postUpdateHookCommand)),
+		withPackageLock(withUserHooks(postInstallHookCommand)),
+		withUserHooks(preTestHookCommand),
+		withUserHooks(postTestHookCommand),
+		withUserHooks(prePublishHookCommand),
+		withUserHooks(testHookCommand),
 	},
 	Action: func(c *cli.Context) error { return nil },
 }
 
 var ImportCommand = cli.Command{
-	Name:  "import",
-	Usage: "import a go package and all its depencies into gx",
+	Name:      "import",
+	Usage:     "import a go package and all its depencies into gx",
+	ArgsUsage: "<package>[@ref]",
 	Description: `imports a given go package and all of its dependencies into gx
 producing a package.json for each, and outputting a package hash
-for each.`,
+for each.
+
+A tag, branch or commit to import the package at can be given after an '@'.`,
 	Flags: []cli.Flag{
 		cli.BoolFlag{
 			Name:  "rewrite",
@@ -201,6 +499,30 @@ for each.`,
 			Name:  "yesall",
 			Usage: "assume defaults for all options",
 		},
+		cli.StringSliceFlag{
+			Name:  "exclude",
+			Usage: "import path or glob pattern of packages to never import, recording them as external deps",
+		},
+		cli.StringSliceFlag{
+			Name:  "break-cycle",
+			Usage: "drop the dependency of one repository on another to break an import cycle, as 'from=to'",
+		},
+		cli.BoolFlag{
+			Name:  "shallow",
+			Usage: "fetch dependencies with shallow git clones",
+		},
+		cli.BoolFlag{
+			Name:  "no-test-deps",
+			Usage: "do not import the dependencies of test files",
+		},
+		cli.BoolFlag{
+			Name:  "offline",
+			Usage: "only use packages already present in GOPATH, never fetching anything",
+		},
+		cli.IntFlag{
+			Name:  "jobs, j",
+			Usage: "number of packages to fetch and publish in parallel (default: the configured concurrency or the number of CPUs)",
+		},
 		cli.BoolFlag{
 			Name:  "tmpdir",
 			Usage: "create and use a temporary directory for the GOPATH",
@@ -209,6 +531,48 @@ for each.`,
 			Name:  "map",
 			Usage: "json document mapping imports to prexisting hashes",
 		},
+		cli.StringFlag{
+			Name:  "state",
+			Usage: "file the import progress is saved to, and resumed from if it exists",
+			Value: defaultImportState,
+		},
+		cli.BoolFlag{
+			Name:  "fresh",
+			Usage: "ignore the progress of a previous import",
+		},
+		cli.StringFlag{
+			Name:  "map-out",
+			Usage: "file to write the map updated with the newly published hashes to (default: the --map file)",
+		},
+		cli.StringSliceFlag{
+			Name:  "gxignore",
+			Usage: "add a pattern to the .gxignore of every published package (e.g. testdata), may be repeated",
+		},
+		cli.BoolFlag{
+			Name:  "keep-going, k",
+			Usage: "keep importing the packages that don't depend on a failed one, and summarize the failures",
+		},
+		cli.BoolFlag{
+			Name:  "review",
+			Usage: "fetch and show the whole dependency tree first, and confirm, rename or skip each new package",
+		},
+		cli.StringFlag{
+			Name:  "overrides",
+			Usage: "json file mapping import paths to the name, version and license to publish them with",
+		},
+		cli.StringFlag{
+			Name:  "report",
+			Usage: "write a json report of the published packages to the given file, or '-' for stdout",
+		},
+		cli.StringFlag{
+			Name:   "hash-function",
+			Usage:  "multihash function to publish packages with (e.g. blake2b-256), instead of gx's sha2-256",
+			EnvVar: "GX_GO_HASH_FUNCTION",
+		},
+		cli.BoolFlag{
+			Name:  "minimal",
+			Usage: "strip tests and test data from the packages vendored",
+		},
 	},
 	Action: func(c *cli.Context) error {
 		var mapping map[string]string
@@ -220,48 +584,154 @@ for each.`,
 			}
 		}
 
+		if c.Bool("offline") && c.Bool("tmpdir") {
+			return fmt.Errorf("--offline needs the packages in GOPATH, it cannot be used with --tmpdir")
+		}
+
 		var gopath string
 		if c.Bool("tmpdir") {
 			dir, err := ioutil.TempDir("", "gx-go-import")
 			if err != nil {
 				return fmt.Errorf("creating temp dir: %s", err)
 			}
-			err = os.Setenv("GOPATH", dir)
-			if err != nil {
-				return fmt.Errorf("setting GOPATH: %s", err)
-			}
-			Log("setting GOPATH to", dir)
+			Log("using temporary GOPATH %s", dir)
 
 			gopath = dir
 		} else {
-			gp, err := getGoPath()
+			gps, err := getGoPaths()
 			if err != nil {
 				return fmt.Errorf("couldnt determine gopath: %s", err)
 			}
 
-			gopath = gp
+			gopath = strings.Join(gps, string(filepath.ListSeparator))
 		}
 
 		importer, err := NewImporter(c.Bool("rewrite"), gopath, mapping)
 		if err != nil {
 			return err
 		}
-
-		importer.yesall = c.Bool("yesall")
+		defer importer.Close()
+
+		importer.yesall = c.Bool("yesall") || nonInteractive
+		importer.offline = c.Bool("offline")
+		importer.noTestDeps = c.Bool("no-test-deps")
+		importer.breakCycles = c.StringSlice("break-cycle")
+		importer.shallow = c.Bool("shallow")
+		importer.keepGoing = c.Bool("keep-going")
+		lookupImportMeta = !importer.offline
+		importer.excludes = append(config.ImportExcludes, c.StringSlice("exclude")...)
+		importer.gxignore = append(importer.gxignore, config.GxIgnore...)
+		importer.gxignore = append(importer.gxignore, c.StringSlice("gxignore")...)
+		importer.overrides = make(map[string]*PackageOverride)
+		for imp, ov := range config.Overrides {
+			importer.overrides[imp] = ov
+		}
+		if p := c.String("overrides"); p != "" {
+			var ovs map[string]*PackageOverride
+			if err := loadMap(&ovs, p); err != nil {
+				return fmt.Errorf("loading overrides %s: %s", p, err)
+			}
+			for imp, ov := range ovs {
+				importer.overrides[imp] = ov
+			}
+		}
+		importer.hashFunc = config.HashFunction
+		if fn := c.String("hash-function"); fn != "" {
+			importer.hashFunc = fn
+		}
+		if importer.hashFunc != "" {
+			if err := checkHashFunction(importer.hashFunc); err != nil {
+				return err
+			}
+		}
+		if j := c.Int("jobs"); j > 0 {
+			importer.sem = make(chan struct{}, j)
+		}
+		minimal, err := minimalVendor()
+		if err != nil {
+			return err
+		}
+		importer.minimal = c.Bool("minimal") || minimal
+		forceMinimal = c.Bool("minimal")
 
 		if !c.Args().Present() {
 			return fmt.Errorf("must specify a package name")
 		}
 
 		pkg := c.Args().First()
+
+		state := c.String("state")
+		if c.Bool("fresh") {
+			if err := os.Remove(state); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		if err := importer.resumeState(state, pkg); err != nil {
+			return err
+		}
+
+		if parts := strings.SplitN(pkg, "@", 2); len(parts) == 2 {
+			pkg = parts[0]
+			importer.pin(pkg, parts[1])
+		}
+
+		if c.Bool("review") {
+			if err := importer.review(pkg); err != nil {
+				return err
+			}
+		}
+
 		Log("vendoring package %s", pkg)
 
+		ctx, stop := interruptContext()
+		defer stop()
+		importer.ctx = ctx
+
+		if progressBars() {
+			importer.bar = newProgress("importing", "packages", 0)
+		}
 		_, err = importer.GxPublishGoPackage(pkg)
-		if err != nil {
+		if importer.bar != nil {
+			importer.bar.Done()
+		}
+		if err == errInterrupted {
+			if c.Bool("tmpdir") {
+				// resuming fetches into another one
+				os.RemoveAll(gopath)
+			}
+			Log("import progress saved to %s, run the same import again to resume", state)
+			return err
+		}
+		if err != nil && !importer.keepGoing {
+			Log("import progress saved to %s, run the same import again to resume", state)
 			return err
 		}
 
-		return nil
+		published := importer.Published()
+		if err := writeImportReport(c.String("report"), published); err != nil {
+			return err
+		}
+
+		mapout := c.String("map-out")
+		if mapout == "" {
+			mapout = preset
+		}
+		if mapout != "" {
+			if err := updateImportMap(mapout, mapping, published); err != nil {
+				return fmt.Errorf("updating map %s: %s", mapout, err)
+			}
+		}
+
+		if importer.keepGoing {
+			failures := importer.Failures()
+			printImportSummary(published, failures)
+			if len(failures) > 0 {
+				Log("import progress saved to %s, run the same import again to resume", state)
+				return fmt.Errorf("%d packages failed to import", len(failures))
+			}
+		}
+
+		return importer.clearState()
 	},
 }
 
@@ -269,23 +739,142 @@ var UpdateCommand = cli.Command{
 	Name:      "update",
 	Usage:     "update a packages imports to a new path",
 	ArgsUsage: "[old import] [new import]",
+	Description: `update rewrites all imports of 'old import' (and its sub-packages) to
+'new import'.
+
+If the old import belongs to a dependency declared in package.json and
+the new import is a gx path, the dependency entry is updated to point
+to the new package as well (unless --no-pkg is given).
+
+With --map, all the old -> new pairs in the given json document are
+applied at once instead. The document has the same format as the
+output of 'dep-map': values may either be import paths or gx hashes,
+in which case the import is rewritten to the gx path of that package.
+
+Old imports containing a '*' are treated as patterns where each '*'
+matches a single path element, and with --regex old imports are
+regular expressions. In both cases the new import may refer to the
+matched groups as $1, $2, etc:
+
+    gx-go update 'github.com/ipfs/go-ipfs-*' 'github.com/ipfs-archive/go-ipfs-$1'`,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "map",
+			Usage: "json document mapping old imports to new imports or hashes",
+		},
+		cli.BoolFlag{
+			Name:  "regex",
+			Usage: "treat old imports as regular expressions",
+		},
+		cli.BoolFlag{
+			Name:  "dry-run",
+			Usage: "print out the imports that would change without touching files",
+		},
+		cli.BoolFlag{
+			Name:  "no-pkg",
+			Usage: "only rewrite imports, leave package.json untouched",
+		},
+	},
 	Action: func(c *cli.Context) error {
-		if len(c.Args()) < 2 {
-			return fmt.Errorf("must specify current and new import names")
+		updates := make(map[string]string)
+		if mfile := c.String("map"); mfile != "" {
+			var m map[string]string
+			if err := loadMap(&m, mfile); err != nil {
+				return err
+			}
+
+			for oldimp, v := range m {
+				newimp, err := resolveUpdateTarget(v)
+				if err != nil {
+					return fmt.Errorf("%s: %s", oldimp, err)
+				}
+				updates[oldimp] = newimp
+			}
+		} else {
+			if len(c.Args()) < 2 {
+				return fmt.Errorf("must specify current and new import names")
+			}
+
+			updates[c.Args()[0]] = c.Args()[1]
 		}
 
-		oldimp := c.Args()[0]
-		newimp := c.Args()[1]
+		var rules []*updateRule
+		for oldimp, newimp := range updates {
+			r, err := parseUpdateRule(oldimp, newimp, c.Bool("regex"))
+			if err != nil {
+				return fmt.Errorf("invalid pattern %q: %s", oldimp, err)
+			}
+			rules = append(rules, r)
+		}
 
-		err := doUpdate(cwd, oldimp, newimp)
+		changes, err := findUpdateChanges(cwd, rules)
 		if err != nil {
 			return err
 		}
 
-		return nil
+		if len(changes) == 0 {
+			return fmt.Errorf("no imports matched")
+		}
+
+		files := make(map[string]bool)
+		for _, ch := range changes {
+			files[ch.File] = true
+			if c.Bool("dry-run") && !jsonOutput {
+				rel, _ := filepath.Rel(cwd, ch.File)
+				fmt.Printf("%s:%d: %s -> %s\n", rel, ch.Line, ch.Old, ch.New)
+			}
+		}
+
+		if c.Bool("dry-run") {
+			if jsonOutput {
+				return printJSON(changes)
+			}
+			fmt.Printf("would update %d imports in %d files\n", len(changes), len(files))
+			return nil
+		}
+
+		op, done := startRewrites()
+		defer done()
+		err = doUpdateRules(op, cwd, rules)
+		if err != nil {
+			return err
+		}
+
+		if jsonOutput {
+			if err := printJSON(changes); err != nil {
+				return err
+			}
+		} else {
+			Log("updated %d imports in %d files", len(changes), len(files))
+		}
+
+		if c.Bool("no-pkg") || c.Bool("regex") {
+			return nil
+		}
+
+		return updatePackageDeps(cwd, updates)
 	},
 }
 
+// resolveUpdateTarget returns the import path for an update target, which
+// is either an import path or the hash of a gx package.
+func resolveUpdateTarget(v string) (string, error) {
+	if !isHash(v) {
+		return v, nil
+	}
+
+	var pkg Package
+	err := gx.FindPackageInDir(&pkg, filepath.Join(cwd, vendorDir, v))
+	if err != nil {
+		pkg = Package{}
+		if err := gx.LoadPackage(&pkg, "go", v); err != nil {
+			return "", fmt.Errorf("package %s not found, try 'gx install'", v)
+		}
+	}
+
+	return "gx/ipfs/" + v + "/" + pkg.Name, nil
+}
+
 var rewriteUndoAlias = cli.Command{
 	Name: "uw",
 	Action: func(c *cli.Context) error {
@@ -315,6 +904,19 @@ var RewriteCommand = cli.Command{
 			Name:  "fix",
 			Usage: "more error tolerant version of '--undo'",
 		},
+		cli.BoolFlag{
+			Name:  "strict",
+			Usage: "with --fix, fail if some gx imports can't be resolved",
+		},
+		cli.BoolFlag{
+			Name:   "fetch",
+			Usage:  "fetch the missing dependencies first, globally as gx install does",
+			EnvVar: "GX_GO_FETCH",
+		},
+		cli.BoolFlag{
+			Name:  "local",
+			Usage: "with --fetch, fetch the missing dependencies into the vendor directory (or --pkgdir) instead",
+		},
 	},
 	Action: func(c *cli.Context) error {
 		root, err := gx.GetPackageRoot()
@@ -322,8 +924,21 @@ var RewriteCommand = cli.Command{
 			return err
 		}
 
+		op, done := startRewrites()
+		defer done()
+
 		if c.Bool("fix") {
-			return fixImports(root)
+			unresolved, err := fixImports(op, root)
+			if err != nil {
+				return err
+			}
+			if err := reportUnresolved(unresolved); err != nil {
+				return err
+			}
+			if c.Bool("strict") && len(unresolved) > 0 {
+				return fmt.Errorf("%d gx packages imported under %s could not be resolved", len(unresolved), root)
+			}
+			return nil
 		}
 
 		pkg, err := LoadPackageFile(filepath.Join(root, gx.PkgFileName))
@@ -336,11 +951,24 @@ var RewriteCommand = cli.Command{
 			pkgdir = pdopt
 		}
 
+		if c.Bool("fetch") {
+			dest := pkgdir
+			if !c.Bool("local") {
+				dest = globalPkgDir("")
+			}
+			if err := fetchMissingDeps(op, pkg, pkgdir, dest); err != nil {
+				return fmt.Errorf("fetching the dependencies: %s", err)
+			}
+		}
+
 		VLog("  - building rewrite mapping")
 		mapping := make(map[string]string)
 		if !c.Args().Present() {
-			err = buildRewriteMapping(pkg, pkgdir, mapping, c.Bool("undo"))
+			err = buildPackageRewriteMapping(pkg, root, pkgdir, mapping, c.Bool("undo"))
 			if err != nil {
+				if !c.Bool("fetch") {
+					err = fmt.Errorf("%s\n(install the dependencies with 'gx install', or pass --fetch)", err)
+				}
 				return fmt.Errorf("build of rewrite mapping failed:\n%s", err)
 			}
 		} else {
@@ -365,7 +993,7 @@ var RewriteCommand = cli.Command{
 			return nil
 		}
 
-		err = doRewrite(pkg, root, mapping)
+		err = doRewrite(op, pkg, root, mapping)
 		if err != nil {
 			return err
 		}
@@ -377,8 +1005,27 @@ var RewriteCommand = cli.Command{
 var DvcsDepsCommand = cli.Command{
 	Name:  "dvcs-deps",
 	Usage: "display all dvcs deps",
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "missing",
+			Usage: "only display deps without a gx package in the dep map",
+		},
+		cli.StringFlag{
+			Name:  "map",
+			Usage: "json dep map to check against with --missing (default: the current package's dep map)",
+		},
+		cli.BoolFlag{
+			Name:  "tree",
+			Usage: "print the deps grouped by the package introducing them",
+		},
+	},
 	Action: func(c *cli.Context) error {
-		i, err := NewImporter(false, os.Getenv("GOPATH"), nil)
+		gps, err := getGoPaths()
+		if err != nil {
+			return err
+		}
+
+		i, err := NewImporter(false, strings.Join(gps, string(filepath.ListSeparator)), nil)
 		if err != nil {
 			return err
 		}
@@ -388,112 +1035,224 @@ var DvcsDepsCommand = cli.Command{
 			return err
 		}
 
-		deps, err := i.DepsToVendorForPackage(relp)
+		origins, err := i.DepOriginsForPackage(relp)
 		if err != nil {
 			return err
 		}
 
-		sort.Strings(deps)
-		for _, d := range deps {
-			fmt.Println(d)
+		if c.Bool("missing") {
+			known, err := loadDvcsDepMap(c.String("map"))
+			if err != nil {
+				return err
+			}
+
+			for d := range origins {
+				if _, ok := known[d]; ok {
+					delete(origins, d)
+				}
+			}
+		}
+
+		switch {
+		case jsonOutput:
+			out, err := json.MarshalIndent(origins, "", "  ")
+			if err != nil {
+				return err
+			}
+			fmt.Println(string(out))
+		case c.Bool("tree"):
+			printDvcsDepsTree(origins)
+		default:
+			var deps []string
+			for d := range origins {
+				deps = append(deps, d)
+			}
+
+			sort.Strings(deps)
+			for _, d := range deps {
+				fmt.Println(d)
+			}
 		}
 
 		return nil
 	},
 }
 
+// printDvcsDepsTree prints each package along with the deps it introduces
+// and the files importing them.
+func printDvcsDepsTree(origins map[string][]DepOrigin) {
+	bypkg := make(map[string]map[string][]string)
+	for dep, locs := range origins {
+		for _, o := range locs {
+			if bypkg[o.Package] == nil {
+				bypkg[o.Package] = make(map[string][]string)
+			}
+
+			loc := filepath.Base(o.File)
+			if o.Line > 0 {
+				loc += ":" + strconv.Itoa(o.Line)
+			}
+			bypkg[o.Package][dep] = append(bypkg[o.Package][dep], loc)
+		}
+	}
+
+	var pkgs []string
+	for p := range bypkg {
+		pkgs = append(pkgs, p)
+	}
+	sort.Strings(pkgs)
+
+	for _, p := range pkgs {
+		fmt.Println(p)
+
+		var deps []string
+		for d := range bypkg[p] {
+			deps = append(deps, d)
+		}
+		sort.Strings(deps)
+
+		for _, d := range deps {
+			fmt.Printf("  %s (%s)\n", d, strings.Join(bypkg[p][d], ", "))
+		}
+	}
+}
+
+// loadDvcsDepMap loads the dep map in `file`, or builds the one of the
+// current package if `file` is empty.
+func loadDvcsDepMap(file string) (map[string]string, error) {
+	m := make(map[string]string)
+	if file != "" {
+		return m, loadMap(&m, file)
+	}
+
+	pkg, err := LoadPackageFile(filepath.Join(cwd, gx.PkgFileName))
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make(map[string]*DepMapEntry)
+	err = buildMapEntries(pkg, filepath.Join(cwd, vendorDir), 1, entries)
+	if err != nil {
+		return nil, fmt.Errorf("building dep map: %s", err)
+	}
+
+	for dvcs, e := range entries {
+		m[dvcs] = e.Hash
+	}
+	return m, nil
+}
+
 func getImportPath(pkgpath string) (string, error) {
 	pkg, err := LoadPackageFile(filepath.Join(pkgpath, gx.PkgFileName))
-	if err != nil {
+	if err != nil && !os.IsNotExist(err) {
 		return "", err
 	}
-	return pkg.Gx.DvcsImport, nil
+
+	if pkg != nil && pkg.Gx.DvcsImport != "" {
+		return pkg.Gx.DvcsImport, nil
+	}
+
+	VLog("no dvcsimport set, guessing import path of %s", pkgpath)
+	return guessImportPath(pkgpath)
+}
+
+// guessImportPath derives the import path of the package in `dir` from its
+// location within GOPATH, or failing that from its go module.
+func guessImportPath(dir string) (string, error) {
+	imp, err := packagesGoImport(dir)
+	if err == nil {
+		return imp, nil
+	}
+
+	// the import path of the package itself, within its module, which
+	// go list prints as _/<dir> outside of GOPATH and modules
+	cmd := exec.Command("go", "list", "-f", "{{.ImportPath}}", ".")
+	cmd.Dir = dir
+	out, lerr := cmd.Output()
+	if lerr == nil {
+		if imp := strings.TrimSpace(string(out)); imp != "" && !strings.HasPrefix(imp, "_/") {
+			return imp, nil
+		}
+	}
+
+	return "", fmt.Errorf("could not determine import path: %s, and not in a go module", err)
 }
 
 var PathCommand = cli.Command{
 	Name:  "path",
 	Usage: "prints the import path of the current package within GOPATH",
+	Description: `path prints the dvcsimport set in package.json. If there is none, the
+import path is derived from the location of the package within GOPATH
+or from its go module.`,
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "set",
+			Usage: "write the import path into package.json",
+		},
+	},
 	Action: func(c *cli.Context) error {
 		rel, err := getImportPath(cwd)
 		if err != nil {
 			return err
 		}
 
+		if c.Bool("set") {
+			pkgpath := filepath.Join(cwd, gx.PkgFileName)
+			pkg, err := LoadPackageFile(pkgpath)
+			if err != nil {
+				return err
+			}
+
+			pkg.Gx.DvcsImport = rel
+			if err := gx.SavePackageFile(pkg, pkgpath); err != nil {
+				return err
+			}
+		}
+
+		if jsonOutput {
+			return printJSON(map[string]string{"path": rel})
+		}
+
 		fmt.Println(rel)
 		return nil
 	},
 }
 
 func goGetPackage(path string) error {
-	cmd := exec.Command("go", "get", "-d", path)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	cmd.Run()
-	return nil
-}
-
-func gxGetPackage(hash string) error {
-	srcdir, err := gx.InstallPath("go", "", true)
-	if err != nil {
+	if viaModCache(path) {
+		gopath, err := getGoPath()
+		if err != nil {
+			return err
+		}
+		_, err = fetchFromModCache(path, filepath.Join(gopath, "src"))
 		return err
 	}
-	gxdir := filepath.Join(srcdir, "gx", "ipfs", hash)
 
-	gxget := exec.Command("gx", "get", hash, "-o", gxdir)
-	gxget.Stdout = os.Stderr
-	gxget.Stderr = os.Stderr
-	if err = gxget.Run(); err != nil {
-		return fmt.Errorf("error during gx get: %s", err)
-	}
+	return withRetries("go get "+path, func() error {
+		cmd := command("go", "get", "-d", path)
+		cmd.Stdout = chatterOut()
+		cmd.Stderr = os.Stderr
+		err := cmd.Run()
 
-	return nil
+		// go get also fails on packages without buildable sources, which
+		// is fine as long as they were fetched
+		if _, serr := os.Stat(goPathSrc(path)); err != nil && serr != nil {
+			return fmt.Errorf("go get %s failed: %s", path, err)
+		}
+		return nil
+	})
 }
 
-func fixImports(path string) error {
-	fixmap := make(map[string]string)
-	gopath := os.Getenv("GOPATH")
-	rwf := func(imp string) string {
-		if strings.HasPrefix(imp, "gx/ipfs/") {
-			parts := strings.Split(imp, "/")
-			canon := strings.Join(parts[:4], "/")
-			rest := strings.Join(parts[4:], "/")
-			if rest != "" {
-				rest = "/" + rest
-			}
-
-			if base, ok := fixmap[canon]; ok {
-				return base + rest
-			}
-
-			var pkg Package
-			err := gx.FindPackageInDir(&pkg, filepath.Join(gopath, "src", canon))
-			if err != nil {
-				hash := parts[2]
-				err = gxGetPackage(hash)
-				if err != nil {
-					VLog(err)
-					return imp
-				}
-				err := gx.FindPackageInDir(&pkg, filepath.Join(gopath, "src", canon))
-				if err != nil {
-					VLog(err)
-					return imp
-				}
-			}
-
-			if pkg.Gx.DvcsImport != "" {
-				fixmap[imp] = pkg.Gx.DvcsImport
-				return pkg.Gx.DvcsImport + rest
-			}
-			fmt.Printf("Package %s has no dvcs import set!\n", imp)
-		}
-		return imp
+func gxGetPackage(hash string) error {
+	srcdir, err := installPath("", true)
+	if err != nil {
+		return err
 	}
+	return gxGetPackageTo(hash, filepath.Join(srcdir, "gx", "ipfs", hash))
+}
 
-	filter := func(s string) bool {
-		return strings.HasSuffix(s, ".go")
-	}
-	return rw.RewriteImports(path, rwf, filter)
+func gxGetPackageTo(hash, gxdir string) error {
+	return materialize(hash, gxdir)
 }
 
 var GetCommand = cli.Command{
@@ -505,19 +1264,13 @@ var GetCommand = cli.Command{
 			return err
 		}
 
-		gpath, err := getGoPath()
-		if err != nil {
-			return err
-		}
-
-		pkgdir := filepath.Join(gpath, "src", pkgpath)
-
-		cmd := exec.Command("gx", "install")
-		cmd.Dir = pkgdir
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
+		// with --modcache, a module version may be given as path@version
+		pkgdir := goPathSrc(strings.SplitN(pkgpath, "@", 2)[0])
 
-		if err := cmd.Run(); err != nil {
+		err := withRetries("gx install", func() error {
+			return gxInstall(pkgdir, true)
+		})
+		if err != nil {
 			return err
 		}
 
@@ -528,11 +1281,13 @@ var GetCommand = cli.Command{
 
 		depsdir := filepath.Join(pkgdir, vendorDir)
 		rwmapping := make(map[string]string)
-		if err := buildRewriteMapping(&pkg, depsdir, rwmapping, false); err != nil {
+		if err := buildPackageRewriteMapping(&pkg, pkgdir, depsdir, rwmapping, false); err != nil {
 			return err
 		}
 
-		if err := doRewrite(&pkg, pkgdir, rwmapping); err != nil {
+		op, done := startRewrites()
+		defer done()
+		if err := doRewrite(op, &pkg, pkgdir, rwmapping); err != nil {
 			return err
 		}
 
@@ -540,9 +1295,34 @@ var GetCommand = cli.Command{
 	},
 }
 
+// nonInteractive is set by the global --yes flag, and makes prompts return
+// without reading stdin.
+var nonInteractive bool
+
+// checkInteractive returns an error if prompting for `text` is impossible
+// because stdin is not a terminal.
+func checkInteractive(text string) error {
+	fi, err := os.Stdin.Stat()
+	if err != nil {
+		return err
+	}
+
+	if fi.Mode()&os.ModeCharDevice == 0 {
+		return fmt.Errorf("cannot prompt %q: stdin is not a terminal (use --yes to run non-interactively)", text)
+	}
+	return nil
+}
+
 func prompt(text, def string) (string, error) {
+	if nonInteractive {
+		return def, nil
+	}
+	if err := checkInteractive(text); err != nil {
+		return "", err
+	}
+
 	scan := bufio.NewScanner(os.Stdin)
-	fmt.Printf("%s (default: '%s') ", text, def)
+	fmt.Fprintf(os.Stderr, "%s (default: '%s') ", text, def)
 	for scan.Scan() {
 		if scan.Text() != "" {
 			return scan.Text(), nil
@@ -550,49 +1330,83 @@ func prompt(text, def string) (string, error) {
 		return def, nil
 	}
 
-	return "", scan.Err()
+	if err := scan.Err(); err != nil {
+		return "", err
+	}
+	return "", fmt.Errorf("unexpected termination of stdin")
 }
 
-func yesNoPrompt(prompt string, def bool) bool {
+func yesNoPrompt(prompt string, def bool) (bool, error) {
+	if nonInteractive {
+		return true, nil
+	}
+	if err := checkInteractive(prompt); err != nil {
+		return false, err
+	}
+
 	opts := "[y/N]"
 	if def {
 		opts = "[Y/n]"
 	}
 
-	fmt.Printf("%s %s ", prompt, opts)
+	fmt.Fprintf(os.Stderr, "%s %s ", prompt, opts)
 	scan := bufio.NewScanner(os.Stdin)
 	for scan.Scan() {
 		val := strings.ToLower(scan.Text())
 		switch val {
 		case "":
-			return def
+			return def, nil
 		case "y":
-			return true
+			return true, nil
 		case "n":
-			return false
+			return false, nil
 		default:
-			fmt.Println("please type 'y' or 'n'")
+			fmt.Fprintln(os.Stderr, "please type 'y' or 'n'")
 		}
 	}
 
-	panic("unexpected termination of stdin")
+	if err := scan.Err(); err != nil {
+		return false, err
+	}
+	return false, fmt.Errorf("unexpected termination of stdin")
 }
 
 var postImportCommand = cli.Command{
 	Name:  "post-import",
 	Usage: "hook called after importing a new go package",
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:   "update",
+			Usage:  "update imports of the package to the gx one without prompting",
+			EnvVar: "GX_GO_UPDATE_IMPORTS",
+		},
+		cli.BoolFlag{
+			Name:   "no-update",
+			Usage:  "leave imports of the package as they are without prompting",
+			EnvVar: "GX_GO_NO_UPDATE_IMPORTS",
+		},
+	},
 	Action: func(c *cli.Context) error {
 		if !c.Args().Present() {
 			Fatal("no package specified")
 		}
 		dephash := c.Args().First()
 
+		var update *bool
+		yes, no := c.Bool("update"), c.Bool("no-update")
+		if yes && no {
+			return fmt.Errorf("--update and --no-update are mutually exclusive")
+		}
+		if yes || no {
+			update = &yes
+		}
+
 		pkg, err := LoadPackageFile(gx.PkgFileName)
 		if err != nil {
 			return err
 		}
 
-		err = postImportHook(pkg, dephash)
+		err = postImportHook(pkg, dephash, update)
 		if err != nil {
 			return err
 		}
@@ -604,13 +1418,20 @@ var postImportCommand = cli.Command{
 var reqCheckCommand = cli.Command{
 	Name:  "req-check",
 	Usage: "hook called to check if requirements of a package are met",
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:   "json",
+			Usage:  "print the result of each requirement check as json",
+			EnvVar: "GX_GO_REQCHECK_JSON",
+		},
+	},
 	Action: func(c *cli.Context) error {
 		if !c.Args().Present() {
 			Fatal("no package specified")
 		}
 		pkgpath := c.Args().First()
 
-		err := reqCheckHook(pkgpath)
+		err := reqCheckHook(pkgpath, jsonOutput || c.Bool("json"))
 		if err != nil {
 			return err
 		}
@@ -652,8 +1473,9 @@ var postInitHookCommand = cli.Command{
 }
 
 var postInstallHookCommand = cli.Command{
-	Name:  "post-install",
-	Usage: "post install hook for newly installed go packages",
+	Name:      "post-install",
+	Usage:     "post install hook for newly installed go packages",
+	ArgsUsage: "<package dir>...",
 	Flags: []cli.Flag{
 		cli.BoolFlag{
 			Name:  "global",
@@ -668,98 +1490,216 @@ var postInstallHookCommand = cli.Command{
 		if !c.Args().Present() {
 			return fmt.Errorf("must specify path to newly installed package")
 		}
-		npkg := c.Args().First()
-		// update sub-package refs here
-		// ex:
-		// if this package is 'github.com/X/Y' replace all imports
-		// matching 'github.com/X/Y*' with 'gx/<hash>/name*'
 
-		var pkg Package
-		err := gx.FindPackageInDir(&pkg, npkg)
+		minimal, err := minimalVendor()
 		if err != nil {
-			return fmt.Errorf("find package failed: %s", err)
+			return err
+		}
+		normalize, err := reproducible()
+		if err != nil {
+			return err
 		}
 
-		dir := filepath.Join(npkg, pkg.Name)
-
-		// build rewrite mapping from parent package if
-		// this call is made on one in the vendor directory
-		var reldir string
-		if strings.Contains(npkg, "vendor/gx/ipfs") {
-			reldir = strings.Split(npkg, "vendor/gx/ipfs")[0]
-			reldir = filepath.Join(reldir, "vendor", "gx", "ipfs")
-		} else {
-			reldir = dir
+		op, done := startRewrites()
+		err = postInstall(op, c.Args(), c.String("override-deps"))
+		done()
+		if err != nil {
+			return err
 		}
 
-		var depsPkg *Package
-		var depsPkgDir string
-		if depsPkgDir = c.String("override-deps"); depsPkgDir != "" {
-			err := gx.FindPackageInDir(&depsPkg, depsPkgDir)
-			if err != nil {
-				return fmt.Errorf("find deps package in %s failed : %s", depsPkgDir, err)
+		if minimal && !c.Bool("global") {
+			for _, npkg := range c.Args() {
+				if err := stripPackage(npkg); err != nil {
+					return fmt.Errorf("stripping %s: %s", npkg, err)
+				}
 			}
 		}
+		if normalize && !c.Bool("global") {
+			for _, npkg := range c.Args() {
+				if err := normalizeTree(npkg); err != nil {
+					return fmt.Errorf("normalizing %s: %s", npkg, err)
+				}
+			}
+		}
+		return nil
+	},
+}
+
+// postInstall runs the post-install hook on the packages installed in
+// `npkgs`, overriding the versions of their deps with the ones of the
+// package in `depsPkgDir` if it is set.
+func postInstall(op *rewriteOp, npkgs []string, depsPkgDir string) error {
+	var depsmap map[string]string
+	if depsPkgDir != "" {
+		var depsPkg Package
+		err := gx.FindPackageInDir(&depsPkg, depsPkgDir)
+		if err != nil {
+			return fmt.Errorf("find deps package in %s failed : %s", depsPkgDir, err)
+		}
 
-		mapping := make(map[string]string)
-		err = buildRewriteMapping(&pkg, reldir, mapping, false)
+		// The dependency versions of `depsPkg` take precedence, the
+		// ones of the installed packages only fill in the dependencies
+		// it doesn't have.
+		depsmap = make(map[string]string)
+		depsdir := filepath.Join(depsPkgDir, packageVendorRoot(depsPkgDir), "gx", "ipfs")
+		err = buildPackageRewriteMapping(&depsPkg, depsPkgDir, depsdir, depsmap, false)
+		if err != nil {
+			return fmt.Errorf("building rewrite mapping failed for package %s: %s", depsPkg.Name, err)
+		}
+	}
+
+	// gx passes a single package, but rewriting several at once
+	// shares the loading of their common deps
+	errs := make([]error, len(npkgs))
+	sem := make(chan struct{}, config.concurrency())
+	var wg sync.WaitGroup
+	for n, npkg := range npkgs {
+		wg.Add(1)
+		go func(n int, npkg string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			errs[n] = postInstallRewrite(op, npkg, depsmap)
+		}(n, npkg)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
 		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// postInstallRewrite rewrites the imports of the package installed in
+// `npkg` to its gx dependencies, preferring the versions in `depsmap` if
+// it is set.
+func postInstallRewrite(op *rewriteOp, npkg string, depsmap map[string]string) error {
+	// update sub-package refs here
+	// ex:
+	// if this package is 'github.com/X/Y' replace all imports
+	// matching 'github.com/X/Y*' with 'gx/<hash>/name*'
+
+	var pkg Package
+	err := gx.FindPackageInDir(&pkg, npkg)
+	if err != nil {
+		return fmt.Errorf("find package failed: %s", err)
+	}
+
+	dir := filepath.Join(npkg, pkg.Name)
+
+	// build rewrite mapping from parent package if
+	// this call is made on one in the vendor directory
+	reldir := dir
+	root, vendored := vendoringRoot(npkg)
+	if vendored {
+		reldir = filepath.Join(root, packageVendorRoot(root), "gx", "ipfs")
+	}
+
+	mapping := make(map[string]string)
+	for dvcsImport, gxImportPath := range depsmap {
+		mapping[dvcsImport] = gxImportPath
+	}
+
+	hash := filepath.Base(npkg)
+	own := make(map[string]string)
+	err = installedRewriteMapping(&pkg, hash, dir, reldir, root, own)
+	if err != nil {
+		if depsmap == nil {
 			return fmt.Errorf("building rewrite mapping failed for package %s: %s", pkg.Name, err)
 		}
+		// the overridden versions of the deps may be all we need
+		Warn("building rewrite mapping failed for package %s, using the overridden deps only: %s", pkg.Name, err)
+	}
+
+	var replacedImports []string
+	for dvcsImport, gxImportPath := range own {
+		depsGxImportPath, exists := mapping[dvcsImport]
+		if !exists {
+			mapping[dvcsImport] = gxImportPath
+		} else if depsGxImportPath != gxImportPath {
+			replacedImports = append(replacedImports, dvcsImport)
+		}
+	}
 
-		if depsPkg != nil {
-			// Use the dependency versions of `depsPkg` in case of a mismatch
-			// with the versions in `pkg`.
+	if len(replacedImports) > 0 {
+		sort.Strings(replacedImports)
+		Log("Replaced %d entries in the rewrite map of %s:", len(replacedImports), pkg.Name)
+		for _, dvcsImport := range replacedImports {
+			Log("  %s", dvcsImport)
+		}
+	}
 
-			depsRewriteMap := make(map[string]string)
-			err = buildRewriteMapping(depsPkg, depsPkgDir, depsRewriteMap, false)
-			if err != nil {
-				return fmt.Errorf("building rewrite mapping failed for package %s: %s", depsPkg.Name, err)
-				// TODO: All the dependencies of the deps package need to be fetched. Should we call
-				// `gx install --global`?
-			}
-
-			// Iterate the `rewriteMap` indexed by the DVCS imports (since `undo`
-			// is false) and replace them with dependencies found in the
-			// `depsRewriteMap` if the gx import paths don't match (that is,
-			// if their versions are different).
-			var replacedImports []string
-			for dvcsImport, gxImportPath := range mapping {
-				depsGxImportPath, exists := depsRewriteMap[dvcsImport]
-
-				if exists && gxImportPath != depsGxImportPath {
-					mapping[dvcsImport] = depsGxImportPath
-					replacedImports = append(replacedImports, dvcsImport)
-				}
-			}
+	newimp := "gx/ipfs/" + hash + "/" + pkg.Name
+	mapping[pkg.Gx.DvcsImport] = newimp
 
-			if len(replacedImports) > 0 {
-				fmt.Printf("Replaced %d entries in the rewrite map:\n", len(replacedImports))
-				for _, dvcsImport := range replacedImports {
-					fmt.Printf("  %s\n", dvcsImport)
-				}
+	err = doRewrite(op, &pkg, dir, mapping)
+	if err != nil {
+		return fmt.Errorf("rewrite failed: %s", err)
+	}
+
+	return nil
+}
+
+// vendoringRoot returns the root of the package the package installed in
+// `npkg` is installed in the vendor directory of, if it is.
+func vendoringRoot(npkg string) (string, bool) {
+	npkg, err := filepath.Abs(npkg)
+	if err != nil {
+		return "", false
+	}
+	gxdir := filepath.Dir(npkg)
+
+	for dir := filepath.Dir(gxdir); ; dir = filepath.Dir(dir) {
+		if _, err := os.Stat(filepath.Join(dir, gx.PkgFileName)); err == nil {
+			if filepath.Join(dir, packageVendorRoot(dir), "gx", "ipfs") == gxdir {
+				return dir, true
 			}
-			// TODO: This should be handled by the `VLog` function.
-			// (At the moment this is called from `gx-go link` which doesn't
-			// have access to the global `Verbose` flag to check whether to
-			// include the `--verbose` argument or not.)
 		}
+		if filepath.Dir(dir) == dir {
+			return "", false
+		}
+	}
+}
 
-		hash := filepath.Base(npkg)
-		newimp := "gx/ipfs/" + hash + "/" + pkg.Name
-		mapping[pkg.Gx.DvcsImport] = newimp
-
-		err = doRewrite(&pkg, dir, mapping)
+// installedRewriteMapping builds the rewrite mapping of the package `hash`
+// installed in `dir`, whose dependencies are in `reldir`. Within the vendor
+// directory of the package at `root`, if set, and if it has a lock file,
+// that is the lock of the package in it, so intermediate packages are
+// rewritten to the exact versions locked too.
+func installedRewriteMapping(pkg *Package, hash, dir, reldir, root string, m map[string]string) error {
+	if root != "" {
+		lck, err := loadRootLockFile(root)
 		if err != nil {
-			return fmt.Errorf("rewrite failed: %s", err)
+			return err
+		}
+		if lck != nil {
+			if l, ok := findLock(lck.Lock, hash); ok {
+				VLog("  - using rewrite mapping from the lock of %s in %s", pkg.Name, filepath.Join(root, gx.LckFileName))
+				return lockRewriteMapping(&gx.LockFile{Lock: l}, m, false)
+			}
 		}
+	}
+	return buildPackageRewriteMapping(pkg, dir, reldir, m, false)
+}
 
-		return nil
-	},
+func doRewrite(op *rewriteOp, pkg *Package, cwd string, mapping map[string]string) error {
+	VLog("  - rewriting imports")
+	err := op.rewrite(cwd, rewriteMapper(mapping), rewriteFilter)
+	if err != nil {
+		return err
+	}
+	VLog("  - finished!")
+
+	return nil
 }
 
-func doRewrite(pkg *Package, cwd string, mapping map[string]string) error {
-	rwm := func(in string) string {
+// rewriteMapper returns the function rewriting an import path with the
+// rewrite map `mapping`, which maps packages along with their subpackages.
+// Results are cached in `mapping`.
+func rewriteMapper(mapping map[string]string) func(string) string {
+	return func(in string) string {
 		m, ok := mapping[in]
 		if ok {
 			return m
@@ -776,19 +1716,13 @@ func doRewrite(pkg *Package, cwd string, mapping map[string]string) error {
 		mapping[in] = in
 		return in
 	}
+}
 
-	filter := func(s string) bool {
-		return strings.HasSuffix(s, ".go")
-	}
-
-	VLog("  - rewriting imports")
-	err := rw.RewriteImports(cwd, rwm, filter)
-	if err != nil {
-		return err
-	}
-	VLog("  - finished!")
-
-	return nil
+// rewriteFilter returns whether the file at the relative path `s` of a
+// package has its imports rewritten.
+func rewriteFilter(s string) bool {
+	return strings.HasSuffix(s, ".go") && !rewriteExcluded(s) &&
+		!strings.HasPrefix(s, vendorRoot+string(filepath.Separator))
 }
 
 var installLocHookCommand = cli.Command{
@@ -814,7 +1748,7 @@ var installLocHookCommand = cli.Command{
 				return fmt.Errorf("install-path cwd: %s", err)
 			}
 
-			fmt.Println(filepath.Join(cwd, "vendor"))
+			fmt.Println(filepath.Join(cwd, vendorRoot))
 			return nil
 		}
 	},
@@ -823,48 +1757,89 @@ var installLocHookCommand = cli.Command{
 var postUpdateHookCommand = cli.Command{
 	Name:  "post-update",
 	Usage: "rewrite go package imports to new versions",
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "no-vendor",
+			Usage: "do not rewrite the imports of vendored packages",
+		},
+	},
 	Action: func(c *cli.Context) error {
 		if len(c.Args()) < 2 {
 			Fatal("must specify two arguments")
 		}
 		before := "gx/ipfs/" + c.Args()[0]
 		after := "gx/ipfs/" + c.Args()[1]
-		err := doUpdate(cwd, before, after)
+		op, done := startRewrites()
+		defer done()
+		err := doUpdate(op, cwd, before, after)
 		if err != nil {
 			return err
 		}
 
-		return nil
+		if c.Bool("no-vendor") {
+			return nil
+		}
+
+		// Vendored packages importing the old version would otherwise
+		// link both versions into the final binary.
+		return updateVendoredPackages(op, filepath.Join(cwd, vendorDir), before, after)
 	},
 }
 
+// updateVendoredPackages rewrites `oldimp` to `newimp` in every package
+// installed in `vdir`.
+func updateVendoredPackages(op *rewriteOp, vdir, oldimp, newimp string) error {
+	hashes, err := ioutil.ReadDir(vdir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	for _, h := range hashes {
+		if !h.IsDir() {
+			continue
+		}
+
+		var pkg Package
+		if err := gx.FindPackageInDir(&pkg, filepath.Join(vdir, h.Name())); err != nil {
+			VLog("skipping %s: %s", h.Name(), err)
+			continue
+		}
+
+		VLog("  - updating imports of vendored package %s", pkg.Name)
+		err := doUpdate(op, filepath.Join(vdir, h.Name(), pkg.Name), oldimp, newimp)
+		if err != nil {
+			return fmt.Errorf("updating vendored package %s: %s", pkg.Name, err)
+		}
+	}
+
+	return nil
+}
+
 var testHookCommand = cli.Command{
 	Name:            "test",
 	SkipFlagParsing: true,
+	Usage:           "run go test on the copy of the package made by pre-test",
 	Action: func(c *cli.Context) error {
-		args := []string{"test"}
-		args = append(args, c.Args()...)
-		cmd := exec.Command("go", args...)
-		cmd.Stderr = os.Stderr
-		cmd.Stdin = os.Stdin
-		cmd.Stdout = os.Stdout
-		return cmd.Run()
+		return runTests(c.Args())
 	},
 }
 
 var preTestHookCommand = cli.Command{
 	Name:  "pre-test",
-	Usage: "",
+	Usage: "copy the package with its imports rewritten for testing",
 	Action: func(c *cli.Context) error {
-		return fullRewrite(false)
+		return preTest()
 	},
 }
 
 var postTestHookCommand = cli.Command{
 	Name:  "post-test",
-	Usage: "",
+	Usage: "delete the copy of the package made for testing",
 	Action: func(c *cli.Context) error {
-		return fullRewrite(true)
+		return postTest()
 	},
 }
 
@@ -876,19 +1851,24 @@ var DevCopyCommand = cli.Command{
 		// gx-go rewrite --undo
 		// symlink <hash> -> dvcs path
 
+		root, err := gx.GetPackageRoot()
+		if err != nil {
+			return err
+		}
+
 		Log("creating local copy of deps")
-		cmd := exec.Command("gx", "install", "--local")
-		cmd.Stderr = os.Stderr
-		cmd.Stdout = os.Stdout
-		if err := cmd.Run(); err != nil {
+		err = withRetries("gx install", func() error {
+			return gxInstall(root, false)
+		})
+		if err != nil {
 			return err
 		}
 
+		op, done := startRewrites()
+		defer done()
+
 		Log("change imports to dvcs")
-		cmd = exec.Command("gx-go", "rewrite", "--undo")
-		cmd.Stderr = os.Stderr
-		cmd.Stdout = os.Stdout
-		if err := cmd.Run(); err != nil {
+		if err := rewritePackage(op, root, true); err != nil {
 			return err
 		}
 
@@ -897,7 +1877,7 @@ var DevCopyCommand = cli.Command{
 			return err
 		}
 
-		return devCopySymlinking(filepath.Join(cwd, "vendor"), pkg, make(map[string]bool))
+		return devCopySymlinking(op, filepath.Join(cwd, vendorRoot), pkg, make(map[string]bool))
 	},
 }
 
@@ -913,7 +1893,7 @@ func genLockDeps(pkg *Package, deps map[string]gx.Lock, done map[string]bool, ig
 		err := gx.LoadPackage(&cpkg, pkg.Language, dep.Hash)
 		if err != nil {
 			if os.IsNotExist(err) {
-				VLog("LoadPackage error: ", err)
+				VLog("LoadPackage error: %s", err)
 				return fmt.Errorf("package %s (%s) not found", dep.Name, dep.Hash)
 			}
 			return err
@@ -938,7 +1918,7 @@ func genLockDeps(pkg *Package, deps map[string]gx.Lock, done map[string]bool, ig
 	return nil
 }
 
-func devCopySymlinking(root string, pkg *Package, done map[string]bool) error {
+func devCopySymlinking(op *rewriteOp, root string, pkg *Package, done map[string]bool) error {
 	for _, dep := range pkg.Dependencies {
 		if done[dep.Hash] {
 			continue
@@ -949,18 +1929,14 @@ func devCopySymlinking(root string, pkg *Package, done map[string]bool) error {
 		err := gx.LoadPackage(&cpkg, pkg.Language, dep.Hash)
 		if err != nil {
 			if os.IsNotExist(err) {
-				VLog("LoadPackage error: ", err)
+				VLog("LoadPackage error: %s", err)
 				return fmt.Errorf("package %s (%s) not found", dep.Name, dep.Hash)
 			}
 			return err
 		}
 
 		frompath := filepath.Join(root, "gx", "ipfs", dep.Hash, dep.Name)
-		cmd := exec.Command("gx-go", "rewrite", "--undo")
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-		cmd.Dir = frompath
-		if err := cmd.Run(); err != nil {
+		if err := rewritePackage(op, frompath, true); err != nil {
 			return err
 		}
 
@@ -974,7 +1950,7 @@ func devCopySymlinking(root string, pkg *Package, done map[string]bool) error {
 			return err
 		}
 
-		if err := devCopySymlinking(root, &cpkg, done); err != nil {
+		if err := devCopySymlinking(op, root, &cpkg, done); err != nil {
 			return err
 		}
 	}
@@ -986,40 +1962,52 @@ func fullRewrite(undo bool) error {
 	if err != nil {
 		return err
 	}
+	op, done := startRewrites()
+	defer done()
+	return rewritePackage(op, root, undo)
+}
 
+// rewritePackage rewrites the imports of the package at `root` to its gx
+// deps, or back to their dvcs paths with `undo`.
+func rewritePackage(op *rewriteOp, root string, undo bool) error {
 	pkg, err := LoadPackageFile(filepath.Join(root, gx.PkgFileName))
 	if err != nil {
 		return err
 	}
 
-	pkgdir := filepath.Join(root, vendorDir)
+	pkgdir := filepath.Join(root, packageVendorRoot(root), "gx", "ipfs")
 
 	mapping := make(map[string]string)
-	err = buildRewriteMapping(pkg, pkgdir, mapping, undo)
+	err = buildPackageRewriteMapping(pkg, root, pkgdir, mapping, undo)
 	if err != nil {
 		return fmt.Errorf("build of rewrite mapping failed:\n%s", err)
 	}
 
-	return doRewrite(pkg, root, mapping)
+	return doRewrite(op, pkg, root, mapping)
 }
 
 func packagesGoImport(p string) (string, error) {
-	gopath, err := getGoPath()
+	gopaths, err := getGoPaths()
 	if err != nil {
 		return "", err
 	}
 
-	srcdir := path.Join(gopath, "src")
-	srcdir += "/"
+	for _, gopath := range gopaths {
+		srcdir := path.Join(gopath, "src")
+		srcdir += "/"
 
-	if !strings.HasPrefix(p, srcdir) {
-		return "", fmt.Errorf("package not within GOPATH/src")
+		if strings.HasPrefix(p, srcdir) {
+			return p[len(srcdir):], nil
+		}
 	}
 
-	return p[len(srcdir):], nil
+	return "", fmt.Errorf("package not within GOPATH/src")
 }
 
-func postImportHook(pkg *Package, npkgHash string) error {
+// postImportHook offers to update the imports of the dvcs path of the newly
+// imported package `npkgHash`. If `update` is set it says whether to,
+// without prompting.
+func postImportHook(pkg *Package, npkgHash string, update *bool) error {
 	var npkg Package
 	err := gx.LoadPackage(&npkg, "go", npkgHash)
 	if err != nil {
@@ -1027,10 +2015,22 @@ func postImportHook(pkg *Package, npkgHash string) error {
 	}
 
 	if npkg.Gx.DvcsImport != "" {
-		q := fmt.Sprintf("update imports of %s to the newly imported package?", npkg.Gx.DvcsImport)
-		if yesNoPrompt(q, false) {
+		var ok bool
+		if update != nil {
+			ok = *update
+		} else {
+			q := fmt.Sprintf("update imports of %s to the newly imported package?", npkg.Gx.DvcsImport)
+			ok, err = yesNoPrompt(q, false)
+			if err != nil {
+				return err
+			}
+		}
+
+		if ok {
 			nimp := fmt.Sprintf("gx/ipfs/%s/%s", npkgHash, npkg.Name)
-			err := doUpdate(cwd, npkg.Gx.DvcsImport, nimp)
+			op, done := startRewrites()
+			defer done()
+			err := doUpdate(op, cwd, npkg.Gx.DvcsImport, nimp)
 			if err != nil {
 				return err
 			}
@@ -1040,7 +2040,7 @@ func postImportHook(pkg *Package, npkgHash string) error {
 	return nil
 }
 
-func reqCheckHook(pkgpath string) error {
+func reqCheckHook(pkgpath string, asJSON bool) error {
 	var npkg Package
 	pkgfile := filepath.Join(pkgpath, gx.PkgFileName)
 	err := gx.LoadPackageFile(&npkg, pkgfile)
@@ -1048,48 +2048,28 @@ func reqCheckHook(pkgpath string) error {
 		return err
 	}
 
-	if npkg.Gx.GoVersion != "" {
-		out, err := exec.Command("go", "version").CombinedOutput()
+	var results []reqResult
+	for _, check := range []func(*Package) ([]reqResult, error){
+		checkGoVersionReq,
+		checkPlatformReqs,
+		checkToolReqs,
+	} {
+		res, err := check(&npkg)
 		if err != nil {
-			return fmt.Errorf("no go compiler installed")
-		}
-
-		parts := strings.Split(string(out), " ")
-		if len(parts) < 4 {
-			return fmt.Errorf("unrecognized output from go compiler")
-		}
-		if parts[2] == "devel" {
-			Log("warning: using unknown development version of go, proceed with caution")
-			return nil
+			return err
 		}
+		results = append(results, res...)
+	}
 
-		havevers := parts[2][2:]
-
-		reqvers := npkg.Gx.GoVersion
-
-		badreq, err := versionComp(havevers, reqvers)
-		if err != nil {
+	if asJSON {
+		if err := printJSON(results); err != nil {
 			return err
 		}
-		if badreq {
-			return fmt.Errorf("package '%s' requires at least go version %s, you have %s installed.", npkg.Name, reqvers, havevers)
-		}
+	}
 
-		gxgocompvers := runtime.Version()
-		if strings.HasPrefix(gxgocompvers, "devel") {
-			return nil
-		}
-		if strings.HasPrefix(gxgocompvers, "go") {
-			badreq, err := versionComp(gxgocompvers[2:], reqvers)
-			if err != nil {
-				return err
-			}
-			if badreq {
-				return fmt.Errorf("package '%s' requires at least go version %s.\nhowever, your gx-go binary was compiled with %s.\nPlease update gx-go (or recompile with your current go compiler)", npkg.Name, reqvers, gxgocompvers)
-			}
-		} else {
-			Log("gx-go was compiled with an unrecognized version of go. (%s)", gxgocompvers)
-			Log("If you encounter any strange issues during its usage, try rebuilding gx-go with go %s or higher", reqvers)
+	for _, r := range results {
+		if !r.Satisfied {
+			return fmt.Errorf("%s", r.Message)
 		}
 	}
 	return nil
@@ -1102,56 +2082,124 @@ func min(a, b int) int {
 	return b
 }
 
-func versionComp(have, req string) (bool, error) {
-	hp := strings.Split(have, ".")
-	rp := strings.Split(req, ".")
+func globalPath() string {
+	gp, _ := getGoPath()
+	return filepath.Join(gp, "src", "gx", "ipfs")
+}
 
-	// treat X.YrcZ or X.YbetaZ as simply X.Y
-	for _, s := range []string{"rc", "beta"} {
-		if strings.Contains(hp[len(hp)-1], s) {
-			hp[len(hp)-1] = strings.Split(hp[len(hp)-1], s)[0]
-			break
-		}
-	}
+// globalPkgDir returns the directory of the package `hash` in the global gx
+// store of any GOPATH entry, falling back to the first one.
+func globalPkgDir(hash string) string {
+	return goPathSrc(filepath.Join("gx", "ipfs", hash))
+}
 
-	l := min(len(hp), len(rp))
-	hp = hp[:l]
-	rp = rp[:l]
-	for i, v := range hp {
-		hv, err := strconv.Atoi(v)
-		if err != nil {
-			return false, err
-		}
+// fetchMissingDeps fetches the dependencies of `pkg`, and theirs, found
+// neither in `pkgdir` nor globally into `dest`, and rewrites their imports
+// as the post-install hook does after gx install.
+func fetchMissingDeps(op *rewriteOp, pkg *Package, pkgdir, dest string) error {
+	var fetched []string
+	done := make(map[string]bool)
 
-		rv, err := strconv.Atoi(rp[i])
-		if err != nil {
-			return false, err
-		}
+	var walk func(pkg *Package) error
+	walk = func(pkg *Package) error {
+		for _, dep := range pkg.Dependencies {
+			if done[dep.Hash] {
+				continue
+			}
+			done[dep.Hash] = true
+
+			var dpkg Package
+			if err := gx.FindPackageInDir(&dpkg, hashDir(pkgdir, dep.Hash)); err != nil {
+				if err := gx.FindPackageInDir(&dpkg, globalPkgDir(dep.Hash)); err != nil {
+					dir := filepath.Join(dest, dep.Hash)
+					Log("fetching %s (%s)", dep.Name, dep.Hash)
+					if err := gxGetPackageTo(dep.Hash, dir); err != nil {
+						return fmt.Errorf("fetching %s (%s): %s", dep.Name, dep.Hash, err)
+					}
+					if err := gx.FindPackageInDir(&dpkg, dir); err != nil {
+						return err
+					}
+					fetched = append(fetched, dir)
+				}
+			}
 
-		if hv < rv {
-			return true, nil
-		} else if hv > rv {
-			return false, nil
+			if err := walk(&dpkg); err != nil {
+				return err
+			}
 		}
+		return nil
+	}
+
+	if err := walk(pkg); err != nil {
+		return err
 	}
-	return false, nil
+	if len(fetched) == 0 {
+		return nil
+	}
+	return postInstall(op, fetched, "")
 }
 
-func globalPath() string {
-	gp, _ := getGoPath()
-	return filepath.Join(gp, "src", "gx", "ipfs")
+// depLoad is the loading of a dependency by loadDep, shared by the
+// callers loading the same one.
+type depLoad struct {
+	done chan struct{}
+	pkg  *Package
+	err  error
+}
+
+// depLoadKey identifies the loads of loadDep.
+type depLoadKey struct {
+	hash   string
+	pkgDir string
 }
 
+var (
+	depLoadsMu sync.Mutex
+	depLoads   = make(map[depLoadKey]*depLoad)
+)
+
 // Load the `Dependency` by its hash returning the `Package` where it's
 // installed, `pkgDir` is an optional parameter with the directory
 // where to look for that dependency.
 // TODO: `pkgDir` isn't actually the package directory, it's where
 // *all* the packages are stored, it should have another name (and
 // it shouldn't be "packages directory").
+// Packages are loaded once per hash and `pkgDir`; failed loads are shared
+// by the callers waiting on them, but retried by later ones.
 func loadDep(dep *gx.Dependency, pkgDir string) (*Package, error) {
+	key := depLoadKey{dep.Hash, pkgDir}
+	depLoadsMu.Lock()
+	if l, ok := depLoads[key]; ok {
+		depLoadsMu.Unlock()
+		<-l.done
+		return l.pkg, l.err
+	}
+	l := &depLoad{done: make(chan struct{})}
+	depLoads[key] = l
+	depLoadsMu.Unlock()
+
+	l.pkg, l.err = findOrFetchDep(dep, pkgDir)
+	if l.err != nil {
+		depLoadsMu.Lock()
+		delete(depLoads, key)
+		depLoadsMu.Unlock()
+	} else {
+		dir := globalPkgDir(dep.Hash)
+		if pkgDir != "" {
+			if _, err := os.Stat(filepath.Join(pkgDir, dep.Hash)); err == nil {
+				dir = filepath.Join(pkgDir, dep.Hash)
+			}
+		}
+		recordPackageIn(dep.Hash, dir, l.pkg)
+	}
+	close(l.done)
+	return l.pkg, l.err
+}
+
+func findOrFetchDep(dep *gx.Dependency, pkgDir string) (*Package, error) {
 	var pkg Package
 	if pkgDir != "" {
-		pkgPath := filepath.Join(pkgDir, dep.Hash)
+		pkgPath := hashDir(pkgDir, dep.Hash)
 		VLog("  - fetching dep: %s (%s)", dep.Name, dep.Hash)
 		err := gx.FindPackageInDir(&pkg, pkgPath)
 		if err == nil {
@@ -1161,19 +2209,18 @@ func loadDep(dep *gx.Dependency, pkgDir string) (*Package, error) {
 
 	// Either `pkgDir` wasn't specified or it failed
 	// to find it there, try global path.
-	p := filepath.Join(globalPath(), dep.Hash)
+	p := globalPkgDir(dep.Hash)
 	VLog("  - checking in global namespace (%s)", p)
 	err := gx.FindPackageInDir(&pkg, p)
 	if err != nil {
-		// It didn't find the package in the glogal path, try
-		// fetching it.
-		err := gxGetPackage(dep.Hash)
-		// TODO: This works because `gxGetPackage` has the global path hard-coded.
+		// It isn't installed, read it from the store, fetching it
+		// there if needed.
+		dir, err := storeFetch(dep.Hash)
 		if err != nil {
 			return nil, fmt.Errorf("failed to fetch package: %s", err)
 		}
 
-		err = gx.FindPackageInDir(&pkg, p)
+		err = gx.FindPackageInDir(&pkg, dir)
 		if err != nil {
 			return nil, fmt.Errorf("failed to find package: %s", err)
 		}
@@ -1195,9 +2242,18 @@ func addRewriteForDep(dep *gx.Dependency, pkg *Package, m map[string]string, und
 	from := pkg.Gx.DvcsImport
 	to := "gx/ipfs/" + dep.Hash + "/" + pkg.Name
 	if undo {
+		// the package may be imported under either form of its hash
+		for _, form := range hashForms(dep.Hash)[1:] {
+			addRewriteEntry(m, "gx/ipfs/"+form+"/"+pkg.Name, from, overwrite)
+		}
 		from, to = to, from
 	}
+	addRewriteEntry(m, from, to, overwrite)
+}
 
+// addRewriteEntry maps `from` to `to` in `m`, unless it is already mapped
+// and `overwrite` isn't set.
+func addRewriteEntry(m map[string]string, from, to string, overwrite bool) {
 	_, entryExists := m[from]
 	if !entryExists || overwrite {
 		m[from] = to
@@ -1224,7 +2280,13 @@ func buildRewriteMapping(pkg *Package, pkgdir string, m map[string]string, undo
 			}
 			seen[dep.Hash] = struct{}{}
 
-			cpkg, err := loadDep(dep, pkgdir)
+			// mapping hashes back only needs their dvcs imports, which
+			// the resolve cache may know without the packages installed
+			load := loadDep
+			if undo {
+				load = resolveDep
+			}
+			cpkg, err := load(dep, pkgdir)
 			if err != nil {
 				VLog("error loading dep %q of %q: %s", dep.Name, pkg.Name, err)
 				return fmt.Errorf("package %q not found. (dependency of %s)", dep.Name, pkg.Name)
@@ -1245,28 +2307,105 @@ func buildRewriteMapping(pkg *Package, pkgdir string, m map[string]string, undo
 	return process(pkg, true)
 }
 
-func buildMap(pkg *Package, m map[string]string) error {
-	for _, dep := range pkg.Dependencies {
-		var ch Package
-		err := gx.FindPackageInDir(&ch, filepath.Join(vendorDir, dep.Hash))
+// DepMapEntry describes the package a dvcs import is mapped to.
+type DepMapEntry struct {
+	Hash    string `json:"hash"`
+	Name    string `json:"name,omitempty"`
+	Version string `json:"version,omitempty"`
+
+	// Depth is the depth in the dependency tree at which the entry was
+	// first found, direct dependencies having a depth of 1.
+	Depth int `json:"depth,omitempty"`
+
+	// Parent is the name of the package that introduced the entry.
+	Parent string `json:"parent,omitempty"`
+}
+
+// mergeDepMaps combines the dep maps of the packages in `roots`, reporting
+// imports mapped to different hashes on stderr.
+func mergeDepMaps(roots []string) (map[string]*DepMapEntry, error) {
+	merged := make(map[string]*DepMapEntry)
+	from := make(map[string]string)
+	for _, root := range roots {
+		pkg, err := LoadPackageFile(filepath.Join(root, gx.PkgFileName))
 		if err != nil {
-			return err
+			return nil, err
+		}
+
+		entries := make(map[string]*DepMapEntry)
+		err = buildMapEntries(pkg, filepath.Join(root, packageVendorRoot(root), "gx", "ipfs"), 1, entries)
+		if err != nil {
+			return nil, fmt.Errorf("building dep map of %s: %s", root, err)
+		}
+
+		for dvcs, e := range entries {
+			prev, ok := merged[dvcs]
+			if !ok {
+				merged[dvcs] = e
+				from[dvcs] = root
+				continue
+			}
+
+			if prev.Hash != e.Hash {
+				Warn("conflict for %s: %s (%s) and %s (%s)", dvcs, prev.Hash, from[dvcs], e.Hash, root)
+			}
+		}
+	}
+
+	return merged, nil
+}
+
+// ReverseDepMapEntry describes the package behind a hash in a reverse
+// dep map.
+type ReverseDepMapEntry struct {
+	DvcsImport string `json:"dvcsimport"`
+	Name       string `json:"name"`
+}
+
+func buildMapEntries(pkg *Package, pkgdir string, depth int, m map[string]*DepMapEntry) error {
+	return walkMapEntries(pkg, pkgdir, depth, m, make(map[string]ReverseDepMapEntry))
+}
+
+// walkMapEntries is buildMapEntries, recording the package of every hash
+// visited in `hashes`, including those without a dvcs import or whose
+// import is already mapped to another hash.
+func walkMapEntries(pkg *Package, pkgdir string, depth int, m map[string]*DepMapEntry, hashes map[string]ReverseDepMapEntry) error {
+	for _, dep := range pkg.Dependencies {
+		if _, ok := hashes[dep.Hash]; ok {
+			continue
+		}
+
+		ch, ok := cachedPackage(dep.Hash)
+		if !ok {
+			ch = new(Package)
+			err := gx.FindPackageInDir(ch, filepath.Join(pkgdir, dep.Hash))
+			if err != nil {
+				return err
+			}
+			recordPackageIn(dep.Hash, filepath.Join(pkgdir, dep.Hash), ch)
+		}
+		hashes[dep.Hash] = ReverseDepMapEntry{
+			DvcsImport: ch.Gx.DvcsImport,
+			Name:       ch.Name,
 		}
 
 		if ch.Gx.DvcsImport != "" {
-			e, ok := m[ch.Gx.DvcsImport]
-			if ok {
-				if e != dep.Hash {
-					Log("have two dep packages with same import path: ", ch.Gx.DvcsImport)
-					Log("  - ", e)
-					Log("  - ", dep.Hash)
+			if e, ok := m[ch.Gx.DvcsImport]; ok {
+				Log("have two dep packages with same import path: %s", ch.Gx.DvcsImport)
+				Log("  - %s", e.Hash)
+				Log("  - %s", dep.Hash)
+			} else {
+				m[ch.Gx.DvcsImport] = &DepMapEntry{
+					Hash:    dep.Hash,
+					Name:    ch.Name,
+					Version: ch.Version,
+					Depth:   depth,
+					Parent:  pkg.Name,
 				}
-				continue
 			}
-			m[ch.Gx.DvcsImport] = dep.Hash
 		}
 
-		err = buildMap(&ch, m)
+		err := walkMapEntries(ch, pkgdir, depth+1, m, hashes)
 		if err != nil {
 			return err
 		}
@@ -1285,6 +2424,11 @@ func loadMap(i interface{}, file string) error {
 }
 
 func tabPrintSortedMap(headers []string, m map[string]string) {
+	if jsonOutput {
+		printJSON(m)
+		return
+	}
+
 	var names []string
 	for k, _ := range m {
 		names = append(names, k)
@@ -1303,11 +2447,53 @@ func tabPrintSortedMap(headers []string, m map[string]string) {
 	w.Flush()
 }
 
+// getGoPath returns the first GOPATH entry, which is where packages get
+// installed.
 func getGoPath() (string, error) {
+	gps, err := getGoPaths()
+	if err != nil {
+		return "", err
+	}
+	return gps[0], nil
+}
+
+// getGoPaths returns every GOPATH entry, in order.
+func getGoPaths() ([]string, error) {
 	gp := os.Getenv("GOPATH")
 	if gp == "" {
-		return homedir.Expand("~/go")
+		def, err := homedir.Expand("~/go")
+		if err != nil {
+			return nil, err
+		}
+		return []string{def}, nil
+	}
+
+	var out []string
+	for _, p := range filepath.SplitList(gp) {
+		if p != "" {
+			out = append(out, p)
+		}
+	}
+	if len(out) == 0 {
+		return nil, fmt.Errorf("GOPATH has no entries")
+	}
+	return out, nil
+}
+
+// goPathSrc returns the directory of `rel` under the src dir of the first
+// GOPATH entry containing it, like the go tool resolves packages. If no
+// entry contains it, its location in the first entry is returned.
+func goPathSrc(rel string) string {
+	gps, err := getGoPaths()
+	if err != nil {
+		return ""
 	}
 
-	return filepath.SplitList(gp)[0], nil
+	for _, gp := range gps {
+		p := filepath.Join(gp, "src", rel)
+		if _, err := os.Stat(p); err == nil {
+			return p
+		}
+	}
+	return filepath.Join(gps[0], "src", rel)
 }
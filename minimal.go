@@ -0,0 +1,307 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"go/parser"
+	"go/token"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	gx "github.com/whyrusleeping/gx/gxutil"
+)
+
+// With minimal vendoring, the packages installed in vendor directories are
+// stripped of what building them doesn't need, to keep vendor trees that
+// are committed small. As that changes their content, the sha256 of each
+// removed file is recorded in the package, so the rest of it can still be
+// checked against the published package.
+
+// minimalDirs are the names of the directories stripped, unless imported.
+// The go tool ignores them, so no dependent can import their packages;
+// doc and example directories may hold packages and are kept.
+var minimalDirs = map[string]bool{
+	"testdata":  true,
+	"_example":  true,
+	"_examples": true,
+}
+
+// minimalManifest is the record of what was stripped from a package, kept
+// in .gx/minimal.json within it.
+type minimalManifest struct {
+	Hash string `json:"hash"`
+
+	// Removed maps the slash separated paths of the removed files to
+	// their sha256.
+	Removed map[string]string `json:"removed"`
+}
+
+// minimalVendor returns whether packages installed locally are stripped,
+// as set with GX_GO_MINIMAL or the config.
+func minimalVendor() (bool, error) {
+	if v := os.Getenv("GX_GO_MINIMAL"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return false, fmt.Errorf("invalid GX_GO_MINIMAL %q, must be a boolean", v)
+		}
+		return b, nil
+	}
+	return config.MinimalVendor, nil
+}
+
+// stripPackage removes the test files, test data and _examples of the
+// package installed in `pkgdir` (gx/ipfs/<hash>), recording them in its
+// manifest. Packages stripped already are left as they are.
+func stripPackage(pkgdir string) error {
+	var pkg Package
+	if err := gx.FindPackageInDir(&pkg, pkgdir); err != nil {
+		return err
+	}
+	dir := filepath.Join(pkgdir, pkg.Name)
+	manifestPath := filepath.Join(dir, ".gx", "minimal.json")
+	if _, err := os.Stat(manifestPath); err == nil {
+		return nil
+	}
+
+	hash := filepath.Base(pkgdir)
+	var candidates []string
+	var kept []string
+	err := filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+
+		switch {
+		case fi.IsDir() && minimalDirs[fi.Name()]:
+			candidates = append(candidates, rel)
+			return filepath.SkipDir
+		case fi.IsDir() && (fi.Name() == ".gx" || fi.Name() == ".git"):
+			return filepath.SkipDir
+		case fi.Mode().IsRegular() && strings.HasSuffix(rel, ".go") && !strings.HasSuffix(rel, "_test.go"):
+			kept = append(kept, p)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	imports, err := goFileImports(kept)
+	if err != nil {
+		return err
+	}
+
+	// whether the package at `rel` is imported by the kept files, by its
+	// gx or its dvcs path
+	imported := func(rel string) bool {
+		prefixes := []string{"gx/ipfs/" + hash + "/" + pkg.Name + "/" + rel}
+		if pkg.Gx.DvcsImport != "" {
+			prefixes = append(prefixes, pkg.Gx.DvcsImport+"/"+rel)
+		}
+		for imp := range imports {
+			for _, pre := range prefixes {
+				if imp == pre || strings.HasPrefix(imp, pre+"/") {
+					return true
+				}
+			}
+		}
+		return false
+	}
+
+	manifest := minimalManifest{Hash: hash, Removed: make(map[string]string)}
+	remove := func(p string) error {
+		sum, err := fileSha256(p)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		manifest.Removed[filepath.ToSlash(rel)] = sum
+		return os.Remove(p)
+	}
+
+	for _, rel := range candidates {
+		if imported(rel) {
+			VLog("keeping %s of %s, it is imported", rel, pkg.Name)
+			continue
+		}
+		cdir := filepath.Join(dir, filepath.FromSlash(rel))
+		err := filepath.Walk(cdir, func(p string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if fi.Mode().IsRegular() {
+				return remove(p)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if err := os.RemoveAll(cdir); err != nil {
+			return err
+		}
+	}
+
+	err = filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() && fi.Name() == ".gx" {
+			return filepath.SkipDir
+		}
+		if fi.Mode().IsRegular() && strings.HasSuffix(p, "_test.go") {
+			return remove(p)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(manifestPath), 0755); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(manifestPath, append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	VLog("stripped %d files from %s", len(manifest.Removed), pkg.Name)
+	return nil
+}
+
+// verifyStripped checks the package installed in `pkgdir`, if stripped,
+// against the published package, fetched into the store: each of its files
+// must either be installed or recorded as removed with its sha256. Installed
+// go files are rewritten, so only the content of the others is compared. It
+// returns the problems found.
+func verifyStripped(pkgdir string) ([]string, error) {
+	var pkg Package
+	if err := gx.FindPackageInDir(&pkg, pkgdir); err != nil {
+		return nil, err
+	}
+	dir := filepath.Join(pkgdir, pkg.Name)
+
+	var manifest minimalManifest
+	if err := loadMap(&manifest, filepath.Join(dir, ".gx", "minimal.json")); err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	hash := filepath.Base(pkgdir)
+	if manifest.Hash != hash {
+		return []string{fmt.Sprintf("%s: stripped from %s, not %s", pkg.Name, manifest.Hash, hash)}, nil
+	}
+
+	pub, err := storeFetch(hash)
+	if err != nil {
+		return nil, err
+	}
+	pubdir := filepath.Join(pub, pkg.Name)
+
+	var bad []string
+	recorded := make(map[string]bool)
+	err = filepath.Walk(pubdir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil || !fi.Mode().IsRegular() {
+			return err
+		}
+		rel, err := filepath.Rel(pubdir, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+
+		if sum, ok := manifest.Removed[rel]; ok {
+			recorded[rel] = true
+			if psum, err := fileSha256(p); err != nil {
+				return err
+			} else if psum != sum {
+				bad = append(bad, fmt.Sprintf("%s: %s was recorded as removed with another content", pkg.Name, rel))
+			}
+			return nil
+		}
+
+		installed := filepath.Join(dir, filepath.FromSlash(rel))
+		if _, err := os.Stat(installed); err != nil {
+			bad = append(bad, fmt.Sprintf("%s: %s is missing and not recorded as removed", pkg.Name, rel))
+			return nil
+		}
+		if strings.HasSuffix(rel, ".go") {
+			return nil
+		}
+		psum, err := fileSha256(p)
+		if err != nil {
+			return err
+		}
+		if isum, err := fileSha256(installed); err != nil {
+			return err
+		} else if isum != psum {
+			bad = append(bad, fmt.Sprintf("%s: %s differs from the published one", pkg.Name, rel))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for rel := range manifest.Removed {
+		if !recorded[rel] {
+			bad = append(bad, fmt.Sprintf("%s: %s is recorded as removed but isn't in the published package", pkg.Name, rel))
+		}
+	}
+	sort.Strings(bad)
+	return bad, nil
+}
+
+// goFileImports returns the set of the import paths of the go files
+// `files`.
+func goFileImports(files []string) (map[string]bool, error) {
+	imports := make(map[string]bool)
+	for _, f := range files {
+		file, err := parser.ParseFile(token.NewFileSet(), f, nil, parser.ImportsOnly)
+		if err != nil {
+			return nil, fmt.Errorf("parsing %s: %s", f, err)
+		}
+		for _, imp := range file.Imports {
+			p, err := strconv.Unquote(imp.Path.Value)
+			if err != nil {
+				continue
+			}
+			imports[p] = true
+		}
+	}
+	return imports, nil
+}
+
+// fileSha256 returns the hex sha256 of the content of the file `p`.
+func fileSha256(p string) (string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
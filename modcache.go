@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// useModCache is set by the global --modcache flag. When set, the source of
+// dvcs packages is fetched through the go module cache instead of through
+// `go get` into GOPATH/src.
+var useModCache bool
+
+// majorSuffixRE matches the last element of the path of a module for a
+// major version above 1.
+var majorSuffixRE = regexp.MustCompile(`^v([2-9]|[1-9][0-9]+)$`)
+
+// viaModCache returns whether the package `imppath` is fetched through the
+// module cache. Packages of v2+ modules always are, as in GOPATH their
+// major versions can't be told apart.
+func viaModCache(imppath string) bool {
+	imppath = strings.SplitN(imppath, "@", 2)[0]
+	return useModCache || majorSuffixRE.MatchString(path.Base(getBaseDVCS(imppath)))
+}
+
+type modDownload struct {
+	Path    string
+	Version string
+	Dir     string
+	Error   string
+}
+
+// downloadModule fetches the module providing the package `imppath` into
+// the module cache. As the module path may be any prefix of the import
+// path, the prefixes are tried from the longest to the shortest.
+func downloadModule(imppath string) (*modDownload, error) {
+	vers := "latest"
+	if i := strings.Index(imppath, "@"); i >= 0 {
+		imppath, vers = imppath[:i], imppath[i+1:]
+	}
+
+	var lastErr error
+	parts := strings.Split(imppath, "/")
+	for n := len(parts); n > 0; n-- {
+		mod := strings.Join(parts[:n], "/")
+
+		cmd := command("go", "mod", "download", "-json", mod+"@"+vers)
+		// run outside of any module so that the current go.mod, if any,
+		// doesn't get in the way
+		cmd.Dir = os.TempDir()
+		cmd.Env = append(os.Environ(), "GO111MODULE=on")
+		out, err := cmd.Output()
+
+		var md modDownload
+		if jerr := json.Unmarshal(out, &md); jerr != nil {
+			if err == nil {
+				err = jerr
+			}
+			lastErr = fmt.Errorf("go mod download %s: %s", mod, err)
+			continue
+		}
+		if md.Error != "" {
+			if authErrorRE.MatchString(md.Error) {
+				// the module exists, but we can't get at it
+				return nil, fetchError(mod, md.Error, err)
+			}
+			lastErr = fmt.Errorf("go mod download %s: %s", mod, md.Error)
+			continue
+		}
+
+		VLog("found %s in module %s %s", imppath, md.Path, md.Version)
+		return &md, nil
+	}
+
+	return nil, fmt.Errorf("no module provides %s: %s", imppath, lastErr)
+}
+
+// modCacheCopies is the directory, within a GOPATH/src, recording the
+// version of each module copied there from the module cache, by escaped
+// module path. The go tool ignores it, as its name starts with a dot.
+const modCacheCopies = ".gx-go-modcache"
+
+// fetchFromModCache makes sure the source of the package `imppath` is in
+// `srcdir`, copying the module providing it out of the module cache if
+// needed, and returns the directory of the package. A copy of another
+// version of the module is replaced.
+func fetchFromModCache(imppath, srcdir string) (string, error) {
+	md, err := downloadModule(imppath)
+	if err != nil {
+		return "", err
+	}
+
+	imppath = strings.SplitN(imppath, "@", 2)[0]
+	dst := filepath.Join(srcdir, md.Path)
+	marker := filepath.Join(srcdir, modCacheCopies, url.PathEscape(md.Path))
+
+	copied, err := ioutil.ReadFile(marker)
+	switch {
+	case err == nil && string(copied) == md.Version:
+		if _, err := os.Stat(dst); err != nil {
+			break
+		}
+		return filepath.Join(srcdir, imppath), nil
+	case err == nil:
+		VLog("replacing %s %s with %s", md.Path, copied, md.Version)
+		if err := os.RemoveAll(dst); err != nil {
+			return "", err
+		}
+	case !os.IsNotExist(err):
+		return "", err
+	default:
+		if _, err := os.Stat(dst); err == nil {
+			Warn("%s is already in %s, using it instead of %s from the module cache", md.Path, srcdir, md.Version)
+			return filepath.Join(srcdir, imppath), nil
+		}
+	}
+
+	Log("copying %s %s from the module cache", md.Path, md.Version)
+	if err := copyTree(md.Dir, dst); err != nil {
+		os.RemoveAll(dst)
+		return "", fmt.Errorf("copying %s: %s", md.Path, err)
+	}
+	if err := os.MkdirAll(filepath.Dir(marker), 0755); err != nil {
+		return "", err
+	}
+	if err := ioutil.WriteFile(marker, []byte(md.Version), 0644); err != nil {
+		return "", err
+	}
+
+	return filepath.Join(srcdir, imppath), nil
+}
+
+// copyTree copies the directory `src` to `dst`. Files in the module cache
+// are read-only, so the copies are made writable.
+func copyTree(src, dst string) error {
+	return filepath.Walk(src, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		if fi.IsDir() {
+			return os.MkdirAll(target, 0755)
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		return copyFile(p, target)
+	})
+}
+
+// copyFile copies the file `src` to `dst`, keeping its permissions but
+// making the copy writable.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	fi, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, fi.Mode().Perm()|0200)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
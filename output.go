@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// jsonOutput is set by the global --json flag. Commands check it to print
+// their results as json on stdout instead of human readable text.
+var jsonOutput bool
+
+// quiet is set by the global --quiet flag, and silences everything but
+// errors and the results of commands.
+var quiet bool
+
+// noColor is set by the global --no-color flag, or NO_COLOR.
+var noColor bool
+
+// chatterOut returns the writer for the stdout of subprocesses that only
+// report progress, such as go get and gx install.
+func chatterOut() io.Writer {
+	if quiet {
+		return ioutil.Discard
+	}
+	return barClearingWriter{}
+}
+
+// commandOut returns the writer for the stdout of the commands run on
+// behalf of the user, such as tests, which goes to stderr with --json to
+// leave stdout to the results.
+func commandOut() io.Writer {
+	if jsonOutput {
+		return os.Stderr
+	}
+	return os.Stdout
+}
+
+// stderrIsTerminal returns whether stderr, where logs go, is a terminal
+// rather than a file or a pipe.
+func stderrIsTerminal() bool {
+	if os.Getenv("TERM") == "dumb" {
+		return false
+	}
+	fi, err := os.Stderr.Stat()
+	if err != nil {
+		return false
+	}
+	return fi.Mode()&os.ModeCharDevice != 0
+}
+
+// progressBars returns whether the progress of long operations is shown
+// as bars, rather than logged.
+func progressBars() bool {
+	return logFormat == "text" && logMin <= levelInfo && stderrIsTerminal()
+}
+
+const (
+	colorRed    = "31"
+	colorGreen  = "32"
+	colorYellow = "33"
+)
+
+// colored returns `s` in `color` when stderr is a terminal and colors
+// aren't disabled.
+func colored(color, s string) string {
+	if noColor || s == "" || !stderrIsTerminal() {
+		return s
+	}
+	return "\x1b[" + color + "m" + s + "\x1b[0m"
+}
+
+func printJSON(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	// keep version constraints such as ">=1.12" readable
+	enc.SetEscapeHTML(false)
+	return enc.Encode(v)
+}
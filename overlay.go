@@ -0,0 +1,410 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	cli "github.com/urfave/cli"
+	rw "github.com/whyrusleeping/gx-go/rewrite"
+	gx "github.com/whyrusleeping/gx/gxutil"
+)
+
+var OverlayCommand = cli.Command{
+	Name:      "overlay",
+	Usage:     "build against the gx deps without rewriting the package",
+	ArgsUsage: "[go command and arguments]",
+	Description: `overlay lets the package keep its dvcs imports while building against the
+versions of its deps pinned by gx, instead of rewriting its files.
+
+It creates a GOPATH in .gx/overlay where the dvcs import path of each
+dependency is a symlink to a copy of it rewritten back to dvcs imports, and
+the one of the package a symlink to the package. The copies are made from
+the vendor directory, whose packages are left untouched, so the deps must be
+installed locally with 'gx install --local'.
+
+With arguments, the go command they make up is run in the package within
+the overlay, for example 'gx-go overlay build ./...'. Otherwise the GOPATH
+of the overlay is printed.
+
+With --modules the go command is run in module mode instead, with a
+throwaway go.mod in the package whose replace directives point the module
+of each dependency at a rewritten copy of it in a scratch directory. The
+go.mod and go.sum are removed, along with the copies, once the command
+exits. Packages that already have a go.mod are not supported.
+
+With --go-overlay the go command (go1.16 or later) builds the package with
+its imports rewritten to gx paths as usual, but from rewritten copies of
+its files passed to it with -overlay instead of the files themselves,
+which are left untouched. Without arguments, the path of the overlay file
+is printed.`,
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "clean",
+			Usage: "remove the overlay",
+		},
+		cli.BoolFlag{
+			Name:  "modules",
+			Usage: "run the go command in module mode with a throwaway go.mod",
+		},
+		cli.BoolFlag{
+			Name:  "go-overlay",
+			Usage: "build from rewritten copies of the files with go build -overlay",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		root, err := gx.GetPackageRoot()
+		if err != nil {
+			return err
+		}
+
+		overlay := filepath.Join(root, ".gx", "overlay")
+		if c.Bool("clean") {
+			if err := os.RemoveAll(goOverlayDir(root)); err != nil {
+				return err
+			}
+			return os.RemoveAll(overlay)
+		}
+
+		pkg, err := LoadPackageFile(filepath.Join(root, gx.PkgFileName))
+		if err != nil {
+			return err
+		}
+		if pkg.Gx.DvcsImport == "" {
+			return fmt.Errorf("package %s has no dvcs import set", pkg.Name)
+		}
+
+		if c.Bool("go-overlay") {
+			return runGoOverlay(root, pkg, c.Args())
+		}
+		if c.Bool("modules") {
+			if !c.Args().Present() {
+				return fmt.Errorf("must specify the go command to run with --modules")
+			}
+			return runModOverlay(root, pkg, c.Args())
+		}
+
+		if err := buildOverlay(overlay, root, pkg); err != nil {
+			return err
+		}
+
+		gopaths, err := getGoPaths()
+		if err != nil {
+			return err
+		}
+		gopath := strings.Join(append([]string{overlay}, gopaths...), string(filepath.ListSeparator))
+
+		if !c.Args().Present() {
+			if jsonOutput {
+				return printJSON(map[string]string{"gopath": gopath})
+			}
+			fmt.Println(gopath)
+			return nil
+		}
+
+		cmd := exec.Command("go", c.Args()...)
+		cmd.Dir = filepath.Join(overlay, "src", filepath.FromSlash(pkg.Gx.DvcsImport))
+		cmd.Env = withEnv(withEnv(os.Environ(), "GOPATH", gopath), "GO111MODULE", "off")
+		cmd.Stdin = os.Stdin
+		cmd.Stdout = commandOut()
+		cmd.Stderr = os.Stderr
+		return cmd.Run()
+	},
+}
+
+// buildOverlay (re)creates in `overlay` a GOPATH mapping the dvcs import of
+// the package `pkg` at `root` to it, and the ones of its deps to their
+// vendored copies.
+func buildOverlay(overlay, root string, pkg *Package) error {
+	if err := os.RemoveAll(overlay); err != nil {
+		return err
+	}
+
+	links, err := overlayDeps(root, pkg, filepath.Join(overlay, "deps"))
+	if err != nil {
+		return err
+	}
+	if prev, ok := links[pkg.Gx.DvcsImport]; ok {
+		VLog("%s is provided by both %s and %s, using the package", pkg.Gx.DvcsImport, root, prev)
+	}
+	links[pkg.Gx.DvcsImport] = root
+
+	var imports []string
+	for imp := range links {
+		imports = append(imports, imp)
+	}
+	sort.Strings(imports)
+
+	// a link within another would be created inside the package it points
+	// to, go resolves such imports through the outer one anyway
+	var linked []string
+	for _, imp := range imports {
+		var within string
+		for _, l := range linked {
+			if strings.HasPrefix(imp, l+"/") {
+				within = l
+			}
+		}
+		if within != "" {
+			Warn("%s is within %s, which it is resolved through", imp, within)
+			continue
+		}
+
+		p := filepath.Join(overlay, "src", filepath.FromSlash(imp))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			return err
+		}
+		if err := os.Symlink(links[imp], p); err != nil {
+			return err
+		}
+		linked = append(linked, imp)
+	}
+
+	VLog("overlay of %s: %d packages linked in %s", pkg.Name, len(linked), overlay)
+	return nil
+}
+
+// overlayDeps makes copies of the vendored deps of the package `pkg` at
+// `root` in `dir`, rewritten back to dvcs imports, and returns their
+// directories by dvcs import. The vendored packages are left untouched.
+func overlayDeps(root string, pkg *Package, dir string) (map[string]string, error) {
+	op, stop := startRewrites()
+	defer stop()
+
+	dirs := make(map[string]string)
+	vdir := filepath.Join(root, vendorDir)
+	done := make(map[string]bool)
+	var collect func(pkg *Package) error
+	collect = func(pkg *Package) error {
+		for _, dep := range pkg.Dependencies {
+			if done[dep.Hash] {
+				continue
+			}
+			done[dep.Hash] = true
+
+			var dpkg Package
+			if err := gx.FindPackageInDir(&dpkg, filepath.Join(vdir, dep.Hash)); err != nil {
+				return fmt.Errorf("%s (%s) is not installed locally, run 'gx install --local'", dep.Name, dep.Hash)
+			}
+			if dpkg.Gx.DvcsImport == "" {
+				Warn("package %s has no dvcs import set", dep.Name)
+				continue
+			}
+
+			// linked packages are copied from their checkouts
+			src, err := filepath.EvalSymlinks(filepath.Join(vdir, dep.Hash))
+			if err != nil {
+				return err
+			}
+			cp := filepath.Join(dir, dep.Hash)
+			if err := linkTree(src, cp); err != nil {
+				return fmt.Errorf("copying %s: %s", dep.Name, err)
+			}
+			pdir := filepath.Join(cp, dpkg.Name)
+			if err := rewritePackage(op, pdir, true); err != nil {
+				return fmt.Errorf("rewriting %s to dvcs imports: %s", dep.Name, err)
+			}
+
+			if prev, ok := dirs[dpkg.Gx.DvcsImport]; ok {
+				VLog("%s is provided by both %s and %s, using the first", dpkg.Gx.DvcsImport, prev, pdir)
+			} else {
+				dirs[dpkg.Gx.DvcsImport] = pdir
+			}
+
+			if err := collect(&dpkg); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := collect(pkg); err != nil {
+		return nil, err
+	}
+	return dirs, nil
+}
+
+// moduleRE matches the module directive of a go.mod file.
+var moduleRE = regexp.MustCompile(`(?m)^module\s+"?([^\s"]+)"?`)
+
+// runModOverlay runs the go command `args` in module mode in the package
+// `pkg` at `root`, with a go.mod replacing the modules of its deps with
+// rewritten copies of them, and removes the files it created afterwards.
+func runModOverlay(root string, pkg *Package, args []string) error {
+	gomod := filepath.Join(root, "go.mod")
+	if _, err := os.Stat(gomod); err == nil {
+		return fmt.Errorf("%s already exists, the package is a module already", gomod)
+	}
+
+	// the replacements need a go.mod, which is written in the copies of
+	// the deps rather than in their content addressed packages
+	scratch, err := ioutil.TempDir("", "gx-go-modoverlay")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(scratch)
+
+	dirs, err := overlayDeps(root, pkg, scratch)
+	if err != nil {
+		return err
+	}
+
+	created := []string{gomod}
+	defer func() {
+		for _, f := range created {
+			if err := os.Remove(f); err != nil && !os.IsNotExist(err) {
+				Warn("removing %s: %s", f, err)
+			}
+		}
+	}()
+	if _, err := os.Stat(filepath.Join(root, "go.sum")); os.IsNotExist(err) {
+		created = append(created, filepath.Join(root, "go.sum"))
+	}
+
+	// the module path of each dep is the one of its go.mod if it has one,
+	// else its dvcs import, which a go.mod is created for as replacement
+	// directories must have one
+	mods := make(map[string]string)
+	for dvcs, dir := range dirs {
+		mod := dvcs
+		depmod := filepath.Join(dir, "go.mod")
+		data, err := ioutil.ReadFile(depmod)
+		switch {
+		case err == nil:
+			if m := moduleRE.FindSubmatch(data); m != nil {
+				mod = string(m[1])
+			}
+		case os.IsNotExist(err):
+			if err := ioutil.WriteFile(depmod, []byte("module "+dvcs+"\n"), 0644); err != nil {
+				return err
+			}
+		default:
+			return err
+		}
+
+		if prev, ok := mods[mod]; ok && prev != dir {
+			VLog("module %s is provided by both %s and %s, using the first", mod, prev, dir)
+			continue
+		}
+		mods[mod] = dir
+	}
+
+	var paths []string
+	for mod := range mods {
+		paths = append(paths, mod)
+	}
+	sort.Strings(paths)
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "module %s\n", pkg.Gx.DvcsImport)
+	if len(paths) > 0 {
+		buf.WriteString("\nrequire (\n")
+		for _, mod := range paths {
+			fmt.Fprintf(&buf, "\t%s v0.0.0\n", mod)
+		}
+		buf.WriteString(")\n\nreplace (\n")
+		for _, mod := range paths {
+			fmt.Fprintf(&buf, "\t%s => %s\n", mod, mods[mod])
+		}
+		buf.WriteString(")\n")
+	}
+	if err := ioutil.WriteFile(gomod, buf.Bytes(), 0644); err != nil {
+		return err
+	}
+	VLog("replacing %d modules in %s", len(paths), gomod)
+
+	// the vendor directory of the package holds gx packages, not modules
+	goflags := strings.TrimSpace(os.Getenv("GOFLAGS") + " -mod=mod")
+
+	// an interrupt reaches the go command too, only wait for it to exit
+	// so the files are still removed
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt)
+	defer signal.Stop(sigs)
+
+	cmd := exec.Command("go", args...)
+	cmd.Dir = root
+	cmd.Env = withEnv(withEnv(os.Environ(), "GO111MODULE", "on"), "GOFLAGS", goflags)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = commandOut()
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+// goOverlayDir returns the directory the overlay file of the package at
+// `root` and the rewritten copies of its files are written to. It is out
+// of the package so the copies aren't taken for its own files.
+func goOverlayDir(root string) string {
+	sum := sha256.Sum256([]byte(root))
+	return filepath.Join(os.TempDir(), fmt.Sprintf("gx-go-overlay-%x", sum[:8]))
+}
+
+// runGoOverlay writes copies of the files of the package `pkg` at `root`
+// with their imports rewritten to gx paths, along with the go build overlay
+// file replacing the originals with them, and runs the go command `args`
+// with it. Without `args`, it prints the path of the overlay file.
+func runGoOverlay(root string, pkg *Package, args []string) error {
+	v, err := installedGoVersion()
+	if err != nil {
+		return err
+	}
+	if v != "devel" {
+		old, err := goVersionMatches(v, "<1.16")
+		if err != nil {
+			return err
+		}
+		if old {
+			return fmt.Errorf("go build -overlay needs go1.16 or later, go%s is installed", v)
+		}
+	}
+
+	mapping := make(map[string]string)
+	if err := buildPackageRewriteMapping(pkg, root, filepath.Join(root, vendorDir), mapping, false); err != nil {
+		return fmt.Errorf("build of rewrite mapping failed:\n%s", err)
+	}
+
+	dir := goOverlayDir(root)
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	replace, err := rw.OverlayImports(root, filepath.Join(dir, "src"), vendorRoot, rewriteMapper(mapping), rewriteFilter)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(map[string]interface{}{"Replace": replace}, "", "  ")
+	if err != nil {
+		return err
+	}
+	overlayFile := filepath.Join(dir, "overlay.json")
+	if err := ioutil.WriteFile(overlayFile, append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	VLog("overlay of %s: %d files rewritten", pkg.Name, len(replace))
+
+	if len(args) == 0 {
+		if jsonOutput {
+			return printJSON(map[string]string{"overlay": overlayFile})
+		}
+		fmt.Println(overlayFile)
+		return nil
+	}
+
+	goflags := strings.TrimSpace(os.Getenv("GOFLAGS") + " -overlay=" + overlayFile)
+
+	cmd := exec.Command("go", args...)
+	cmd.Dir = root
+	cmd.Env = withEnv(withEnv(os.Environ(), "GO111MODULE", "off"), "GOFLAGS", goflags)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = commandOut()
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	sh "github.com/ipfs/go-ipfs-api"
+	cli "github.com/urfave/cli"
+	gx "github.com/whyrusleeping/gx/gxutil"
+)
+
+var PinCommand = cli.Command{
+	Name:  "pin",
+	Usage: "pin every transitive dependency of the current package",
+	Description: `pin pins the hashes of all (transitive) dependencies of the current
+package, either on an ipfs node (the local one by default, or the one
+given with --api) or on a remote pinning service implementing the
+IPFS pinning service API (--service and --token).`,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "api",
+			Usage: "address of the ipfs api to pin on (default: local node)",
+		},
+		cli.StringFlag{
+			Name:  "service",
+			Usage: "url of a remote pinning service to use instead of an ipfs node",
+		},
+		cli.StringFlag{
+			Name:   "token",
+			Usage:  "access token for the remote pinning service",
+			EnvVar: "GX_PIN_TOKEN",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		root, err := gx.GetPackageRoot()
+		if err != nil {
+			return err
+		}
+
+		pkg, err := LoadPackageFile(filepath.Join(root, gx.PkgFileName))
+		if err != nil {
+			return err
+		}
+
+		deps, err := collectDeps(pkg, filepath.Join(root, vendorDir))
+		if err != nil {
+			return err
+		}
+
+		var hashes []string
+		for h := range deps {
+			hashes = append(hashes, h)
+		}
+		sort.Strings(hashes)
+
+		var pin func(hash string, dep *Package) error
+		if svc := c.String("service"); svc != "" {
+			token := c.String("token")
+			pin = func(hash string, dep *Package) error {
+				return remotePin(svc, token, hash, dep.Name+"@"+dep.Version)
+			}
+		} else {
+			var shell *sh.Shell
+			if api := c.String("api"); api != "" {
+				shell = sh.NewShell(api)
+			} else {
+				shell = gx.NewShell()
+			}
+			pin = func(hash string, dep *Package) error {
+				return shell.Pin(hash)
+			}
+		}
+
+		for n, h := range hashes {
+			dep := deps[h]
+			Log("pinning %s %s [%d / %d]", dep.Name, h, n+1, len(hashes))
+			if err := pin(h, dep); err != nil {
+				return fmt.Errorf("pinning %s (%s): %s", dep.Name, h, err)
+			}
+		}
+
+		return nil
+	},
+}
+
+// collectDeps returns the packages of every (transitive) dependency of
+// `pkg` keyed by hash, fetching packages that aren't available locally.
+func collectDeps(pkg *Package, pkgdir string) (map[string]*Package, error) {
+	out := make(map[string]*Package)
+
+	var walk func(pkg *Package) error
+	walk = func(pkg *Package) error {
+		for _, dep := range pkg.Dependencies {
+			if _, ok := out[dep.Hash]; ok {
+				continue
+			}
+
+			cpkg, err := loadDep(dep, pkgdir)
+			if err != nil {
+				return fmt.Errorf("package %q not found. (dependency of %s)", dep.Name, pkg.Name)
+			}
+			out[dep.Hash] = cpkg
+
+			if err := walk(cpkg); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	return out, walk(pkg)
+}
+
+// remotePin adds a pin request for `hash` to a pinning service implementing
+// the IPFS pinning service API.
+func remotePin(service, token, hash, name string) error {
+	body, err := json.Marshal(map[string]string{
+		"cid":  hash,
+		"name": name,
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", strings.TrimSuffix(service, "/")+"/pins", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("pinning service returned %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// pinReaders read the revisions an upstream project locks its dependencies
+// to, keyed by the import path of each dependency's repository.
+var pinReaders = []struct {
+	file string
+	read func(string) (map[string]string, error)
+}{
+	{"Gopkg.lock", readGopkgLock},
+	{"glide.lock", readGlideFile("name")},
+	{"glide.yaml", readGlideFile("package")},
+	{filepath.Join("Godeps", "Godeps.json"), readGodeps},
+}
+
+// readPins returns the revisions locked by the dependency manager files
+// found in `dir`.
+func readPins(dir string) (map[string]string, error) {
+	pins := make(map[string]string)
+	for _, pr := range pinReaders {
+		p := filepath.Join(dir, pr.file)
+		if _, err := os.Stat(p); err != nil {
+			continue
+		}
+
+		found, err := pr.read(p)
+		if err != nil {
+			return nil, err
+		}
+
+		VLog("read %d pins from %s", len(found), p)
+		for imp, rev := range found {
+			if _, ok := pins[imp]; !ok {
+				pins[imp] = rev
+			}
+		}
+	}
+	return pins, nil
+}
+
+// readGopkgLock reads the project revisions of a dep lock file. Only the
+// name and revision keys of the [[projects]] tables are needed, so rather
+// than a full toml parser this scans for those.
+func readGopkgLock(p string) (map[string]string, error) {
+	fi, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer fi.Close()
+
+	pins := make(map[string]string)
+	var name, rev string
+	flush := func() {
+		if name != "" && rev != "" {
+			pins[name] = rev
+		}
+		name, rev = "", ""
+	}
+
+	scan := bufio.NewScanner(fi)
+	for scan.Scan() {
+		line := strings.TrimSpace(scan.Text())
+		if strings.HasPrefix(line, "[") {
+			flush()
+			continue
+		}
+
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+
+		val, err := strconv.Unquote(strings.TrimSpace(kv[1]))
+		if err != nil {
+			continue
+		}
+
+		switch strings.TrimSpace(kv[0]) {
+		case "name":
+			name = val
+		case "revision":
+			rev = val
+		}
+	}
+	flush()
+
+	return pins, scan.Err()
+}
+
+// readGlideFile returns a reader for the versions of the dependency lists
+// of glide.lock and glide.yaml, where the import path of each entry is
+// given by `namekey`. As with Gopkg.lock, the yaml is scanned for just
+// those keys. Version ranges, which glide.yaml allows, are skipped.
+func readGlideFile(namekey string) func(string) (map[string]string, error) {
+	return func(p string) (map[string]string, error) {
+		fi, err := os.Open(p)
+		if err != nil {
+			return nil, err
+		}
+		defer fi.Close()
+
+		pins := make(map[string]string)
+		var name string
+		scan := bufio.NewScanner(fi)
+		for scan.Scan() {
+			line := strings.TrimSpace(scan.Text())
+			line = strings.TrimSpace(strings.TrimPrefix(line, "- "))
+
+			kv := strings.SplitN(line, ":", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			val := strings.Trim(strings.TrimSpace(kv[1]), `"'`)
+
+			switch strings.TrimSpace(kv[0]) {
+			case namekey:
+				name = val
+			case "version":
+				if name != "" && val != "" && !strings.ContainsAny(val, "^~<>=* ") {
+					pins[name] = val
+				}
+				name = ""
+			}
+		}
+		return pins, scan.Err()
+	}
+}
+
+// readGodeps reads the revisions recorded in Godeps/Godeps.json. Its
+// entries are packages, so they are keyed by the repository they are in.
+func readGodeps(p string) (map[string]string, error) {
+	var godeps struct {
+		Deps []struct {
+			ImportPath string
+			Rev        string
+		}
+	}
+	if err := loadMap(&godeps, p); err != nil {
+		return nil, err
+	}
+
+	pins := make(map[string]string)
+	for _, d := range godeps.Deps {
+		if d.Rev != "" {
+			pins[getBaseDVCS(d.ImportPath)] = d.Rev
+		}
+	}
+	return pins, nil
+}
+
+// addPins records the revisions locked by the package in `dir`. Pins that
+// are already known take precedence, so the versions locked by the package
+// being imported win over the ones of its dependencies.
+func (i *Importer) addPins(dir string) error {
+	pins, err := readPins(dir)
+	if err != nil {
+		return err
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	for imp, rev := range pins {
+		if _, ok := i.pins[imp]; !ok {
+			i.pins[imp] = rev
+		}
+	}
+	return nil
+}
+
+// pin pins `imppath` to the revision `rev`, overriding any pin read from
+// lock files.
+func (i *Importer) pin(imppath, rev string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.pins[getBaseDVCS(imppath)] = rev
+}
+
+// pinFor returns the revision `imppath` is pinned to, if any.
+func (i *Importer) pinFor(imppath string) string {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.pins[getBaseDVCS(imppath)]
+}
+
+// pinCheckout is the worktree a pinned repository is checked out in.
+type pinCheckout struct {
+	done chan struct{}
+	repo string
+	dir  string
+	err  error
+}
+
+// checkoutPin returns the directory of the source of `imppath`, found in
+// `dir`, at the revision it is pinned to. Unless the checkout is already at
+// that revision, it is checked out in a git worktree under the importer's
+// pin GOPATH, which is searched first, leaving the checkout itself alone.
+func (i *Importer) checkoutPin(imppath, dir string) (string, error) {
+	rev := i.pinFor(imppath)
+	if rev == "" {
+		return dir, nil
+	}
+
+	repo, err := gitOutput(dir, "rev-parse", "--show-toplevel")
+	if err != nil {
+		Warn("%s is pinned to %s but is not a git checkout, using it as is", imppath, rev)
+		return dir, nil
+	}
+	repo = strings.TrimSpace(repo)
+	sub, err := filepath.Rel(repo, dir)
+	if err != nil {
+		return "", err
+	}
+
+	base := getBaseDVCS(imppath)
+	i.mu.Lock()
+	pc, ok := i.worktrees[base]
+	if !ok {
+		pc = &pinCheckout{done: make(chan struct{}), repo: repo}
+		i.worktrees[base] = pc
+	}
+	i.mu.Unlock()
+
+	if !ok {
+		pc.dir, pc.err = i.addPinWorktree(base, repo, rev)
+		close(pc.done)
+	}
+	<-pc.done
+	if pc.err != nil {
+		return "", pc.err
+	}
+	return filepath.Join(pc.dir, sub), nil
+}
+
+// addPinWorktree checks out the revision `rev` of the repository `repo` of
+// `base` in a worktree, unless it is at that revision already, and returns
+// the directory of the checkout.
+func (i *Importer) addPinWorktree(base, repo, rev string) (string, error) {
+	commit, err := i.resolvePin(repo, rev)
+	if err != nil {
+		return "", err
+	}
+	if head, err := gitOutput(repo, "rev-parse", "HEAD"); err == nil && strings.TrimSpace(head) == commit {
+		return repo, nil
+	}
+
+	wt := filepath.Join(i.pinGopath, "src", filepath.FromSlash(base))
+	if err := os.MkdirAll(filepath.Dir(wt), 0755); err != nil {
+		return "", err
+	}
+
+	Log("checking out %s at %s", base, rev)
+	if _, err := gitOutput(repo, "worktree", "add", "-q", "--detach", wt, commit); err != nil {
+		return "", err
+	}
+	return wt, nil
+}
+
+// resolvePin returns the commit of the revision `rev` of the repository
+// `repo`, fetching it if needed.
+func (i *Importer) resolvePin(repo, rev string) (string, error) {
+	if c, err := gitOutput(repo, "rev-parse", "-q", "--verify", rev+"^{commit}"); err == nil {
+		return strings.TrimSpace(c), nil
+	}
+	if i.offline {
+		return "", fmt.Errorf("revision %s not in the local checkout, and --offline is set", rev)
+	}
+
+	// the revision may be newer than the checkout
+	args := []string{"fetch", "-q"}
+	if i.shallow {
+		args = append(args, "--depth", "1")
+	}
+	if _, err := gitOutput(repo, append(args, "origin", rev)...); err == nil {
+		if c, err := gitOutput(repo, "rev-parse", "-q", "--verify", "FETCH_HEAD^{commit}"); err == nil {
+			return strings.TrimSpace(c), nil
+		}
+	}
+
+	// not every server serves commits by hash, or the revision is a tag
+	// of another branch
+	if _, err := gitOutput(repo, "fetch", "-q", "--tags", "origin"); err != nil {
+		return "", err
+	}
+	c, err := gitOutput(repo, "rev-parse", "-q", "--verify", rev+"^{commit}")
+	if err != nil {
+		return "", fmt.Errorf("revision %s not found in %s", rev, repo)
+	}
+	return strings.TrimSpace(c), nil
+}
+
+// Close removes the worktrees pinned revisions were checked out in.
+func (i *Importer) Close() error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	var firstErr error
+	for base, pc := range i.worktrees {
+		<-pc.done
+		if pc.err != nil || pc.dir == pc.repo {
+			continue
+		}
+		if _, err := gitOutput(pc.repo, "worktree", "remove", "--force", pc.dir); err != nil {
+			Warn("removing the checkout of %s at its pinned revision: %s", base, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+		gitOutput(pc.repo, "worktree", "prune")
+	}
+	i.worktrees = make(map[string]*pinCheckout)
+
+	if err := os.RemoveAll(i.pinGopath); err != nil && firstErr == nil {
+		firstErr = err
+	}
+	return firstErr
+}
+
+// shallowClone fetches the repository of `imppath` with a depth 1 git
+// clone of its default branch or, if the package is pinned, of the pinned
+// revision only. An existing clone is kept, checkoutPin fetching the
+// pinned revision into it if it lacks it.
+func (i *Importer) shallowClone(imppath string) error {
+	base := getBaseDVCS(imppath)
+	dir := i.srcDir(base)
+	if _, err := os.Stat(dir); err == nil {
+		return nil
+	}
+
+	url := "https://" + base
+	if lookupImportMeta {
+		if meta, err := resolveImportMeta(base); err == nil && meta.VCS == "git" {
+			url = meta.RepoURL
+		}
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	rev := i.pinFor(base)
+	Log("shallow cloning %s %s", url, rev)
+
+	var err error
+	if rev == "" {
+		_, err = gitOutput(dir, "clone", "-q", "--depth", "1", "--single-branch", url, ".")
+	} else {
+		for _, args := range [][]string{
+			{"init", "-q"},
+			{"remote", "add", "origin", url},
+			{"fetch", "-q", "--depth", "1", "origin", rev},
+			{"checkout", "-q", "FETCH_HEAD"},
+		} {
+			if _, err = gitOutput(dir, args...); err != nil {
+				break
+			}
+		}
+	}
+
+	if err != nil {
+		os.RemoveAll(dir)
+		return fetchError(url, "", err)
+	}
+	return nil
+}
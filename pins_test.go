@@ -0,0 +1,140 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// readTestPins writes `data` to a file named `name` and reads it with `read`.
+func readTestPins(t *testing.T, name, data string, read func(string) (map[string]string, error)) map[string]string {
+	dir, err := ioutil.TempDir("", "gx-go-pins")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	p := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(p, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	pins, err := read(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pins
+}
+
+func TestReadGopkgLock(t *testing.T) {
+	pins := readTestPins(t, "Gopkg.lock", `# This file is autogenerated, do not edit; changes may be undone by the next 'dep ensure'.
+
+
+[[projects]]
+  digest = "1:abc"
+  name = "github.com/x/a"
+  packages = ["."]
+  revision = "1111111111111111111111111111111111111111"
+  version = "v1.2.0"
+
+[[projects]]
+  branch = "master"
+  name = "github.com/x/b"
+  packages = [
+    ".",
+    "sub",
+  ]
+  revision = "2222222222222222222222222222222222222222"
+
+[[projects]]
+  name = "github.com/x/norev"
+
+[solve-meta]
+  analyzer-name = "dep"
+  input-imports = ["github.com/x/a"]
+`, readGopkgLock)
+
+	exp := map[string]string{
+		"github.com/x/a": "1111111111111111111111111111111111111111",
+		"github.com/x/b": "2222222222222222222222222222222222222222",
+	}
+	if !reflect.DeepEqual(pins, exp) {
+		t.Fatalf("got %v, expected %v", pins, exp)
+	}
+}
+
+func TestReadGlideFiles(t *testing.T) {
+	lock := readTestPins(t, "glide.lock", `hash: 0123456789abcdef
+updated: 2018-01-01T00:00:00Z
+imports:
+- name: github.com/x/a
+  version: 1111111111111111111111111111111111111111
+  subpackages:
+  - sub
+- name: github.com/x/b
+  version: "2222222222222222222222222222222222222222"
+testImports:
+- name: github.com/x/c
+  version: 3333333333333333333333333333333333333333
+`, readGlideFile("name"))
+
+	exp := map[string]string{
+		"github.com/x/a": "1111111111111111111111111111111111111111",
+		"github.com/x/b": "2222222222222222222222222222222222222222",
+		"github.com/x/c": "3333333333333333333333333333333333333333",
+	}
+	if !reflect.DeepEqual(lock, exp) {
+		t.Fatalf("glide.lock: got %v, expected %v", lock, exp)
+	}
+
+	// ranges aren't pins
+	yaml := readTestPins(t, "glide.yaml", `package: github.com/x/main
+import:
+- package: github.com/x/a
+  version: v1.2.0
+- package: github.com/x/b
+  version: ^1.0.0
+- package: github.com/x/c
+  version: '>= 1.0, < 2.0'
+- package: github.com/x/d
+`, readGlideFile("package"))
+
+	exp = map[string]string{"github.com/x/a": "v1.2.0"}
+	if !reflect.DeepEqual(yaml, exp) {
+		t.Fatalf("glide.yaml: got %v, expected %v", yaml, exp)
+	}
+}
+
+func TestReadGodeps(t *testing.T) {
+	pins := readTestPins(t, "Godeps.json", `{
+	"ImportPath": "github.com/x/main",
+	"GoVersion": "go1.9",
+	"Deps": [
+		{
+			"ImportPath": "github.com/x/a",
+			"Rev": "1111111111111111111111111111111111111111"
+		},
+		{
+			"ImportPath": "github.com/x/a/sub",
+			"Rev": "1111111111111111111111111111111111111111"
+		},
+		{
+			"ImportPath": "golang.org/x/net/context",
+			"Comment": "v0.1.0",
+			"Rev": "2222222222222222222222222222222222222222"
+		},
+		{
+			"ImportPath": "github.com/x/norev"
+		}
+	]
+}`, readGodeps)
+
+	exp := map[string]string{
+		"github.com/x/a":   "1111111111111111111111111111111111111111",
+		"golang.org/x/net": "2222222222222222222222222222222222222222",
+	}
+	if !reflect.DeepEqual(pins, exp) {
+		t.Fatalf("got %v, expected %v", pins, exp)
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	homedir "github.com/mitchellh/go-homedir"
+	cli "github.com/urfave/cli"
+	gx "github.com/whyrusleeping/gx/gxutil"
+)
+
+// Commands modifying a package take an advisory lock on it, so that two of
+// them running at once (say an editor hook and a rewrite in a terminal)
+// don't corrupt its tree. The lock is held by the gx-go process the command
+// was run as, and passed down to the gx and gx-go processes it spawns.
+
+// The lock files are kept out of the packages, where they would otherwise
+// end up committed or published, in a directory of the user's cache, named
+// after the hash of the root of the package they lock.
+const pkgLockDir = "~/.cache/gx-go/locks"
+
+// pkgLockEnv is set to the root of the package locked, for subprocesses.
+const pkgLockEnv = "GX_GO_PACKAGE_LOCK"
+
+// waitLock makes commands wait for the lock of a package held by another,
+// rather than fail.
+var waitLock bool
+
+// errLocked is returned by lockFile when the file is locked already.
+var errLocked = errors.New("locked")
+
+// withPackageLock makes `cmd` hold the lock of the current package while it
+// runs.
+func withPackageLock(cmd cli.Command) cli.Command {
+	action := cmd.Action.(func(*cli.Context) error)
+	cmd.Action = func(c *cli.Context) error {
+		root, err := gx.GetPackageRoot()
+		if err != nil {
+			// not in a package, nothing to lock
+			return action(c)
+		}
+
+		unlock, err := lockPackage(root, cmd.Name)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+		return action(c)
+	}
+	return cmd
+}
+
+// lockPackage takes the lock of the package at `root` for the command `op`,
+// and returns the function releasing it. It doesn't lock again a package
+// an ancestor process holds the lock of.
+func lockPackage(root, op string) (func(), error) {
+	if held := os.Getenv(pkgLockEnv); held != "" && sameDir(held, root) {
+		return func() {}, nil
+	}
+
+	p, err := pkgLockPath(root)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(p, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	err = lockFile(f, false)
+	if err == errLocked {
+		holder := lockHolder(p)
+		if !waitLock {
+			f.Close()
+			return nil, fmt.Errorf("%s is being modified by %s, try again once it is done (or pass --wait-lock)", root, holder)
+		}
+		Log("waiting for %s to finish with %s", holder, root)
+		err = lockFile(f, true)
+	}
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("locking %s: %s", root, err)
+	}
+
+	// the holder is recorded for the error of the commands it blocks
+	if err := f.Truncate(0); err == nil {
+		fmt.Fprintf(f, "%d gx-go %s\n", os.Getpid(), op)
+	}
+
+	prev, hadPrev := os.LookupEnv(pkgLockEnv)
+	os.Setenv(pkgLockEnv, root)
+	return func() {
+		if hadPrev {
+			os.Setenv(pkgLockEnv, prev)
+		} else {
+			os.Unsetenv(pkgLockEnv)
+		}
+		f.Truncate(0)
+		unlockFile(f)
+		f.Close()
+	}, nil
+}
+
+// pkgLockPath returns the lock file of the package at `root`.
+func pkgLockPath(root string) (string, error) {
+	dir, err := homedir.Expand(pkgLockDir)
+	if err != nil {
+		return "", err
+	}
+	abs, err := filepath.Abs(root)
+	if err != nil {
+		return "", err
+	}
+	if real, err := filepath.EvalSymlinks(abs); err == nil {
+		abs = real
+	}
+	sum := sha256.Sum256([]byte(abs))
+	return filepath.Join(dir, hex.EncodeToString(sum[:16])+".lock"), nil
+}
+
+// lockHolder describes the process holding the lock file `p`.
+func lockHolder(p string) string {
+	data, _ := ioutil.ReadFile(p)
+	var pid int
+	var op string
+	if _, err := fmt.Sscanf(string(data), "%d gx-go %s", &pid, &op); err != nil {
+		return "another gx-go command"
+	}
+	return fmt.Sprintf("gx-go %s (pid %d)", op, pid)
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+var (
+	kernel32         = syscall.NewLazyDLL("kernel32.dll")
+	procLockFileEx   = kernel32.NewProc("LockFileEx")
+	procUnlockFileEx = kernel32.NewProc("UnlockFileEx")
+)
+
+const (
+	lockfileFailImmediately = 0x1
+	lockfileExclusiveLock   = 0x2
+
+	errorLockViolation syscall.Errno = 33
+)
+
+// lockFile takes an exclusive lock on `f`, waiting for it if `wait` is set
+// and failing with errLocked otherwise.
+func lockFile(f *os.File, wait bool) error {
+	flags := uintptr(lockfileExclusiveLock)
+	if !wait {
+		flags |= lockfileFailImmediately
+	}
+	var ol syscall.Overlapped
+	r, _, err := procLockFileEx.Call(f.Fd(), flags, 0, 1, 0, uintptr(unsafe.Pointer(&ol)))
+	if r != 0 {
+		return nil
+	}
+	if err == errorLockViolation {
+		return errLocked
+	}
+	return err
+}
+
+// unlockFile releases the lock on `f`.
+func unlockFile(f *os.File) error {
+	var ol syscall.Overlapped
+	r, _, err := procUnlockFileEx.Call(f.Fd(), 0, 1, 0, uintptr(unsafe.Pointer(&ol)))
+	if r != 0 {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"fmt"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	cli "github.com/urfave/cli"
+	gx "github.com/whyrusleeping/gx/gxutil"
+)
+
+var prePublishHookCommand = cli.Command{
+	Name:  "pre-publish",
+	Usage: "check that the package is ready to be published",
+	Description: `pre-publish refuses to publish the package unless it builds with its
+imports rewritten, its own imports are all dvcs paths, its version differs
+from the last one published and, in a git checkout, it has no uncommitted
+changes other than to package.json and .gx.`,
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:   "allow-dirty",
+			Usage:  "allow publishing with uncommitted changes",
+			EnvVar: "GX_GO_ALLOW_DIRTY",
+		},
+		cli.BoolFlag{
+			Name:   "no-build",
+			Usage:  "do not check that the package builds",
+			EnvVar: "GX_GO_PUBLISH_NO_BUILD",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		root, err := gx.GetPackageRoot()
+		if err != nil {
+			return err
+		}
+
+		pkg, err := LoadPackageFile(filepath.Join(root, gx.PkgFileName))
+		if err != nil {
+			return err
+		}
+
+		var problems []string
+		check := func(err error) {
+			if err != nil {
+				problems = append(problems, err.Error())
+			}
+		}
+
+		check(checkVersionBumped(root, pkg))
+		check(checkDvcsImports(root))
+		if !c.Bool("allow-dirty") {
+			check(checkCommitted(root))
+		}
+		if !c.Bool("no-build") {
+			check(checkBuilds())
+		}
+
+		if len(problems) > 0 {
+			for _, p := range problems {
+				Error("%s", p)
+			}
+			return fmt.Errorf("refusing to publish %s", pkg.Name)
+		}
+		return nil
+	},
+}
+
+// checkVersionBumped checks that the version of `pkg` is not the one last
+// published.
+func checkVersionBumped(root string, pkg *Package) error {
+	data, err := ioutil.ReadFile(filepath.Join(root, ".gx", "lastpubver"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	parts := strings.SplitN(string(data), ":", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("unrecognized .gx/lastpubver")
+	}
+	if strings.TrimSpace(parts[0]) == pkg.Version {
+		return fmt.Errorf("version %s was already published as %s, bump it first (gx version or gx-go release)", pkg.Version, strings.TrimSpace(parts[1]))
+	}
+	return nil
+}
+
+// checkDvcsImports checks that the package imports its dependencies by
+// their dvcs paths, as packages are published with their imports undone.
+func checkDvcsImports(root string) error {
+	files, err := gxImportingFiles(root)
+	if err != nil {
+		return err
+	}
+
+	if len(files) > 0 {
+		return fmt.Errorf("%d files import gx paths, run 'gx-go rewrite --undo': %s", len(files), strings.Join(files, ", "))
+	}
+	return nil
+}
+
+// gxImportingFiles returns the go files of the package at `root` importing
+// gx paths, relative to it.
+func gxImportingFiles(root string) ([]string, error) {
+	var files []string
+	err := filepath.Walk(root, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+
+		if fi.IsDir() {
+			if p != root && (skipDir(fi.Name()) || rel == vendorRoot) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if !strings.HasSuffix(p, ".go") || rewriteExcluded(rel) {
+			return nil
+		}
+
+		file, err := parser.ParseFile(token.NewFileSet(), p, nil, parser.ImportsOnly)
+		if err != nil {
+			return fmt.Errorf("failed to parse %s: %s", rel, err)
+		}
+
+		for _, imp := range file.Imports {
+			ip, err := strconv.Unquote(imp.Path.Value)
+			if err == nil && strings.HasPrefix(ip, "gx/ipfs/") {
+				files = append(files, rel)
+				break
+			}
+		}
+		return nil
+	})
+	return files, err
+}
+
+// checkCommitted checks that the package has no uncommitted changes, if it
+// is in a git checkout. The version bump in package.json and the gx metadata
+// are committed after publishing, and so are allowed.
+func checkCommitted(root string) error {
+	if _, err := gitOutput(root, "rev-parse", "--is-inside-work-tree"); err != nil {
+		return nil
+	}
+
+	prefix, err := gitOutput(root, "rev-parse", "--show-prefix")
+	if err != nil {
+		return err
+	}
+	prefix = strings.TrimSpace(prefix)
+
+	out, err := gitOutput(root, "status", "--porcelain", "--", ".")
+	if err != nil {
+		return err
+	}
+
+	var changed []string
+	for _, line := range strings.Split(out, "\n") {
+		if len(line) < 4 {
+			continue
+		}
+		p := line[3:]
+		if i := strings.Index(p, " -> "); i >= 0 {
+			p = p[i+4:]
+		}
+		p = strings.TrimPrefix(strings.Trim(p, `"`), prefix)
+
+		if p == gx.PkgFileName || strings.HasPrefix(p, ".gx/") {
+			continue
+		}
+		changed = append(changed, p)
+	}
+
+	if len(changed) > 0 {
+		return fmt.Errorf("%d files have uncommitted changes: %s", len(changed), strings.Join(changed, ", "))
+	}
+	return nil
+}
+
+// checkBuilds checks that the package builds with its imports rewritten,
+// on a copy of it as the test hooks do.
+func checkBuilds() error {
+	if err := preTest(); err != nil {
+		return err
+	}
+	defer postTest()
+
+	dir, gopath, err := testDir()
+	if err != nil {
+		return err
+	}
+
+	cmd := command("go", "build", "./...")
+	cmd.Dir = dir
+	cmd.Env = withEnv(os.Environ(), "GOPATH", gopath)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("the package does not build: %s\n%s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
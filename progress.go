@@ -0,0 +1,235 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// discover records that `imppath` is going to be published, growing the
+// known frontier of the import. It must be called with i.mu held.
+func (i *Importer) discover(imppath string) {
+	if _, ok := i.pkgs[imppath]; ok {
+		return
+	}
+	if _, ok := i.preMap[imppath]; ok {
+		return
+	}
+	if i.started.IsZero() {
+		i.started = time.Now()
+	}
+	i.known[imppath] = true
+}
+
+// logProgress logs how many packages were published out of the ones known
+// so far, and an estimate of the time left, or updates the progress bar of
+// the import. It must be called with i.mu held.
+func (i *Importer) logProgress() {
+	done := len(i.published)
+	total := len(i.known)
+	if i.progressTotal > total {
+		total = i.progressTotal
+	}
+
+	if i.bar != nil {
+		i.bar.Set(done, total)
+		return
+	}
+
+	elapsed := time.Since(i.started).Round(time.Second)
+	msg := fmt.Sprintf("published %d of ~%d packages, %s elapsed", done, total, elapsed)
+	if done > 0 && total > done {
+		eta := time.Duration(int64(elapsed) / int64(done) * int64(total-done)).Round(time.Second)
+		msg += fmt.Sprintf(", about %s left", eta)
+	}
+	Log("%s", msg)
+}
+
+// progressInterval is how often the progress of long operations is logged
+// when stderr isn't a terminal a bar can be drawn on.
+const progressInterval = 10 * time.Second
+
+// barRefresh is how often progress bars are redrawn.
+const barRefresh = 200 * time.Millisecond
+
+// barWidth is the number of cells of progress bars.
+const barWidth = 25
+
+// progress reports the progress of an operation on a number of items,
+// as a bar redrawn on stderr when it is a terminal, or else as periodic
+// log lines. It counts the files of rewrites as a rw.Counter.
+type progress struct {
+	what string
+	unit string
+
+	mu    sync.Mutex
+	done  int
+	total int
+	start time.Time
+
+	outer   bool
+	bar     bool
+	stop    chan struct{}
+	stopped sync.Once
+	wg      sync.WaitGroup
+}
+
+// newProgress starts reporting the progress of `what`, done on `total`
+// items (of `unit`), which may grow as they are found. It must be ended
+// with Done. Only the outermost of nested operations reports its progress.
+func newProgress(what, unit string, total int) *progress {
+	p := &progress{
+		what:  what,
+		unit:  unit,
+		total: total,
+		start: time.Now(),
+		bar:   progressBars(),
+		stop:  make(chan struct{}),
+	}
+	termMu.Lock()
+	if progressActive {
+		termMu.Unlock()
+		return p
+	}
+	progressActive, p.outer = true, true
+	termMu.Unlock()
+	if logMin > levelInfo {
+		return p
+	}
+
+	interval := progressInterval
+	if p.bar {
+		interval = barRefresh
+	}
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				p.report()
+			case <-p.stop:
+				return
+			}
+		}
+	}()
+	return p
+}
+
+// Add counts `n` more items done.
+func (p *progress) Add(n int) {
+	p.mu.Lock()
+	p.done += n
+	p.mu.Unlock()
+}
+
+// Grow counts `n` more items to do.
+func (p *progress) Grow(n int) {
+	p.mu.Lock()
+	p.total += n
+	p.mu.Unlock()
+}
+
+// Set sets the number of items done and to do.
+func (p *progress) Set(done, total int) {
+	p.mu.Lock()
+	p.done, p.total = done, total
+	p.mu.Unlock()
+}
+
+// Found counts a file found to rewrite.
+func (p *progress) Found() { p.Grow(1) }
+
+// Processed counts a file rewritten.
+func (p *progress) Processed() { p.Add(1) }
+
+// Done stops reporting progress, removing the bar.
+func (p *progress) Done() {
+	p.stopped.Do(func() {
+		close(p.stop)
+		p.wg.Wait()
+		if p.outer {
+			termMu.Lock()
+			if p.bar {
+				clearBar()
+			}
+			progressActive = false
+			termMu.Unlock()
+		}
+	})
+}
+
+// report draws the bar, or logs the progress.
+func (p *progress) report() {
+	p.mu.Lock()
+	done, total := p.done, p.total
+	p.mu.Unlock()
+
+	elapsed := time.Since(p.start)
+	rate := float64(done) / elapsed.Seconds()
+	count := fmt.Sprintf("%d/%d %s", done, total, p.unit)
+	stats := fmt.Sprintf("%.1f/s, %s", rate, elapsed.Round(time.Second))
+	if total > done && rate > 0 {
+		eta := time.Duration(float64(total-done) / rate * float64(time.Second))
+		stats += fmt.Sprintf(", %s left", eta.Round(time.Second))
+	}
+
+	if !p.bar {
+		Log("%s: %s (%s)", p.what, count, stats)
+		return
+	}
+
+	filled := 0
+	if total > 0 {
+		filled = barWidth * done / total
+	}
+	if filled > barWidth {
+		filled = barWidth
+	}
+	cells := colored(colorGreen, strings.Repeat("=", filled)) + strings.Repeat(" ", barWidth-filled)
+
+	termMu.Lock()
+	fmt.Fprintf(logOut, "\r%s [%s] %s (%s)\x1b[K", p.what, cells, count, stats)
+	barShown = true
+	termMu.Unlock()
+}
+
+// termMu serializes the writes to stderr that may be interleaved with a
+// progress bar.
+var termMu sync.Mutex
+
+// barShown is set while a progress bar is drawn on the last line of
+// stderr, and progressActive while an operation reports its progress.
+// They are guarded by termMu.
+var barShown, progressActive bool
+
+// clearBar erases the progress bar drawn, if any, for other output to
+// replace it. It must be called with termMu held.
+func clearBar() {
+	if barShown {
+		fmt.Fprint(logOut, "\r\x1b[K")
+		barShown = false
+	}
+}
+
+// clearProgress erases the progress bar drawn, if any, before printing
+// to stdout.
+func clearProgress() {
+	termMu.Lock()
+	clearBar()
+	termMu.Unlock()
+}
+
+// barClearingWriter writes to stderr once the progress bar is cleared.
+type barClearingWriter struct{}
+
+func (barClearingWriter) Write(b []byte) (int, error) {
+	termMu.Lock()
+	defer termMu.Unlock()
+	clearBar()
+	return os.Stderr.Write(b)
+}
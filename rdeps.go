@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"go/parser"
+	"go/token"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	cli "github.com/urfave/cli"
+	gx "github.com/whyrusleeping/gx/gxutil"
+)
+
+var RdepsCommand = cli.Command{
+	Name:      "rdeps",
+	Usage:     "find local packages depending on the given package",
+	ArgsUsage: "[hash or dvcs import]",
+	Description: `rdeps scans the local checkouts in every GOPATH entry (or the repos of the
+workspace in the current directory, with --workspace) for packages that
+reference the given package, either in their package.json or in the
+imports of their go files.`,
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "workspace",
+			Usage: "only scan the repos of the current workspace",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		if !c.Args().Present() {
+			return fmt.Errorf("must specify a package hash or dvcs import path")
+		}
+		target := c.Args().First()
+
+		var roots []string
+		if c.Bool("workspace") {
+			ws, err := loadWorkspace()
+			if err != nil {
+				return err
+			}
+
+			repos, err := ws.load()
+			if err != nil {
+				return err
+			}
+
+			for _, r := range repos {
+				roots = append(roots, r.dir)
+			}
+		} else {
+			var err error
+			roots, err = findGoPathProjects()
+			if err != nil {
+				return err
+			}
+		}
+
+		results := make(map[string][]string)
+		for _, root := range roots {
+			pkg, err := LoadPackageFile(filepath.Join(root, gx.PkgFileName))
+			if err != nil {
+				VLog("skipping %s: %s", root, err)
+				continue
+			}
+
+			var reasons []string
+			vdir := filepath.Join(root, packageVendorRoot(root), "gx", "ipfs")
+			if dep := depReferencing(pkg, vdir, target); dep != nil {
+				reasons = append(reasons, fmt.Sprintf("package.json (%s %s)", dep.Name, dep.Hash))
+			}
+
+			imp, err := importReferencing(root, target)
+			if err != nil {
+				return err
+			}
+			if imp != "" {
+				reasons = append(reasons, "imports "+imp)
+			}
+
+			if len(reasons) > 0 {
+				results[root] = reasons
+				if !jsonOutput {
+					fmt.Printf("%s\t%s\n", root, strings.Join(reasons, ", "))
+				}
+			}
+		}
+
+		if jsonOutput {
+			return printJSON(results)
+		}
+		return nil
+	},
+}
+
+// depReferencing returns the direct dependency of `pkg` matching `target`,
+// either by hash or by the dvcs import of the dependency, looked up in
+// `pkgDir` (the vendor directory of `pkg`) or else globally.
+func depReferencing(pkg *Package, pkgDir, target string) *gx.Dependency {
+	for _, dep := range pkg.Dependencies {
+		if sameHash(dep.Hash, target) {
+			return dep
+		}
+
+		cpkg, err := findOrFetchDep(dep, pkgDir)
+		if err != nil {
+			VLog("reading dependency %s: %s", dep.Hash, err)
+			continue
+		}
+		if cpkg.Gx.DvcsImport == target {
+			return dep
+		}
+	}
+	return nil
+}
+
+// importReferencing returns the first import in the go files under `root`
+// referencing `target`, which is either a dvcs import path or a gx hash.
+func importReferencing(root, target string) (string, error) {
+	match := func(imp string) bool {
+		if isHash(target) {
+			return strings.HasPrefix(imp, "gx/ipfs/"+target+"/")
+		}
+		return imp == target || strings.HasPrefix(imp, target+"/")
+	}
+
+	var found string
+	err := filepath.Walk(root, func(p string, fi os.FileInfo, err error) error {
+		if err != nil || found != "" {
+			return err
+		}
+
+		if fi.IsDir() {
+			if p != root && skipDir(fi.Name()) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if !strings.HasSuffix(p, ".go") {
+			return nil
+		}
+
+		file, err := parser.ParseFile(token.NewFileSet(), p, nil, parser.ImportsOnly)
+		if err != nil {
+			VLog("failed to parse %s: %s", p, err)
+			return nil
+		}
+
+		for _, imp := range file.Imports {
+			ip, err := strconv.Unquote(imp.Path.Value)
+			if err == nil && match(ip) {
+				found = ip
+				return nil
+			}
+		}
+		return nil
+	})
+	return found, err
+}
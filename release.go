@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	cli "github.com/urfave/cli"
+	gx "github.com/whyrusleeping/gx/gxutil"
+)
+
+var ReleaseCommand = cli.Command{
+	Name:      "release",
+	Usage:     "bump the version of the current package and publish it",
+	ArgsUsage: "[major|minor|patch]",
+	Description: `release bumps the version in package.json, rewrites imports back to
+their dvcs paths while it publishes the package with gx (hashed with the
+hashFunction of the config, if set), commits and tags the release in git
+and, with --downstream, rolls the new hash into the workspace repos
+depending on the package. If publishing fails, package.json is restored.`,
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "no-git",
+			Usage: "do not commit or tag the release",
+		},
+		cli.BoolFlag{
+			Name:  "downstream",
+			Usage: "update the workspace repos depending on this package",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		severity := c.Args().First()
+		if severity == "" {
+			severity = "patch"
+		}
+
+		root, err := gx.GetPackageRoot()
+		if err != nil {
+			return err
+		}
+
+		pkgfile := filepath.Join(root, gx.PkgFileName)
+		pkg, err := LoadPackageFile(pkgfile)
+		if err != nil {
+			return err
+		}
+
+		nvers, err := bumpVersion(pkg.Version, severity)
+		if err != nil {
+			return err
+		}
+		Log("releasing %s %s -> %s", pkg.Name, pkg.Version, nvers)
+
+		orig, err := ioutil.ReadFile(pkgfile)
+		if err != nil {
+			return err
+		}
+		restore := func() {
+			if err := ioutil.WriteFile(pkgfile, orig, 0644); err != nil {
+				Error("restoring %s: %s", pkgfile, err)
+			}
+		}
+
+		// imports rewritten to gx paths are rewritten back once published
+		gxfiles, err := gxImportingFiles(root)
+		if err != nil {
+			return err
+		}
+		rewritten := len(gxfiles) > 0
+
+		pkg.Version = nvers
+		if err := gx.SavePackageFile(pkg, pkgfile); err != nil {
+			return err
+		}
+
+		if rewritten {
+			op, done := startRewrites()
+			err := rewritePackage(op, root, true)
+			done()
+			if err != nil {
+				restore()
+				return fmt.Errorf("rewriting imports to dvcs paths: %s", err)
+			}
+		}
+
+		if fn := config.HashFunction; fn != "" && fn != "sha2-256" {
+			if err = checkHashFunction(fn); err == nil {
+				_, err = publishWithHash(root, pkg, fn)
+			}
+		} else if err = runIn(root, "gx", "publish"); err != nil {
+			err = fmt.Errorf("publishing: %s", err)
+		}
+		if rewritten {
+			// not interruptible, for the package to be left as it was
+			if rerr := rewritePackage(nil, root, false); rerr != nil {
+				Error("rewriting imports back to gx paths: %s", rerr)
+			}
+		}
+		if err != nil {
+			restore()
+			return err
+		}
+
+		hash, err := lastPublished(root)
+		if err != nil {
+			return err
+		}
+		Log("published %s %s as %s", pkg.Name, nvers, hash)
+
+		if !c.Bool("no-git") {
+			if err := runIn(root, "git", "add", gx.PkgFileName, filepath.Join(".gx", "lastpubver")); err != nil {
+				return err
+			}
+			if err := runIn(root, "git", "commit", "-m", "gx publish "+nvers); err != nil {
+				return err
+			}
+			if err := runIn(root, "git", "tag", "v"+nvers); err != nil {
+				return err
+			}
+		}
+
+		if c.Bool("downstream") {
+			ws, err := loadWorkspace()
+			if err != nil {
+				return err
+			}
+
+			repos, err := ws.load()
+			if err != nil {
+				return err
+			}
+
+			for _, r := range repos {
+				if r.pkg.FindDep(pkg.Name) == nil {
+					continue
+				}
+
+				Log("updating %s in %s", pkg.Name, r.pkg.Name)
+				if err := runIn(r.dir, "gx", "update", pkg.Name, hash); err != nil {
+					return fmt.Errorf("updating %s: %s", r.pkg.Name, err)
+				}
+			}
+		}
+
+		return nil
+	},
+}
+
+// bumpVersion increments the given part of a semver version string,
+// resetting the parts after it.
+func bumpVersion(vers, severity string) (string, error) {
+	parts := strings.Split(vers, ".")
+	if len(parts) != 3 {
+		return "", fmt.Errorf("unrecognized version %q", vers)
+	}
+
+	var nums [3]int
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil {
+			return "", fmt.Errorf("unrecognized version %q", vers)
+		}
+		nums[i] = n
+	}
+
+	switch severity {
+	case "major":
+		nums = [3]int{nums[0] + 1, 0, 0}
+	case "minor":
+		nums = [3]int{nums[0], nums[1] + 1, 0}
+	case "patch":
+		nums[2]++
+	default:
+		return "", fmt.Errorf("release type must be one of major, minor or patch")
+	}
+
+	return fmt.Sprintf("%d.%d.%d", nums[0], nums[1], nums[2]), nil
+}
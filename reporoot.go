@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// hostRootDepths is the number of path elements of the repository roots on
+// well known hosts.
+var hostRootDepths = map[string]int{
+	"github.com":        3,
+	"bitbucket.org":     3,
+	"gitlab.com":        3,
+	"golang.org":        3,
+	"honnef.co":         3,
+	"k8s.io":            2,
+	"sigs.k8s.io":       2,
+	"google.golang.org": 2,
+	"cloud.google.com":  2,
+	"go.uber.org":       2,
+	"go.etcd.io":        2,
+	"go.opencensus.io":  1,
+}
+
+// lookupImportMeta enables resolving the repository roots of unknown hosts
+// from their go-import meta tags, which needs network access.
+var lookupImportMeta bool
+
+// repoRootDepth returns the number of elements of `imppath` making up the
+// import path of its repository. In order, it uses the repoRoots of the
+// config, rules for known hosts, the go-import meta tags of the host (if
+// enabled), and otherwise defaults to 3 as for github.
+func repoRootDepth(imppath string) int {
+	parts := strings.Split(imppath, "/")
+
+	var best string
+	for prefix := range config.RepoRoots {
+		if (imppath == prefix || strings.HasPrefix(imppath, prefix+"/")) && len(prefix) > len(best) {
+			best = prefix
+		}
+	}
+	if best != "" {
+		return config.RepoRoots[best]
+	}
+
+	host := parts[0]
+	if host == "gopkg.in" {
+		// gopkg.in/pkg.v1 or gopkg.in/user/pkg.v1
+		if len(parts) > 1 && strings.Contains(parts[1], ".v") {
+			return 2
+		}
+		return 3
+	}
+
+	if d, ok := hostRootDepths[host]; ok {
+		return d
+	}
+
+	if lookupImportMeta && strings.Contains(host, ".") {
+		meta, err := resolveImportMeta(imppath)
+		if err == nil {
+			return len(strings.Split(meta.Prefix, "/"))
+		}
+		VLog("resolving the repository of %s: %s", imppath, err)
+	}
+
+	return 3
+}
+
+// importMeta is the content of a go-import meta tag.
+type importMeta struct {
+	Prefix  string
+	VCS     string
+	RepoURL string
+}
+
+var (
+	importMetaMu    sync.Mutex
+	importMetaCache = make(map[string]*importMeta)
+
+	// the lookups that failed, by import path, or by host when the host
+	// couldn't be reached
+	importMetaErrs = make(map[string]error)
+)
+
+var (
+	metaTagRE     = regexp.MustCompile(`(?is)<meta\s[^>]*>`)
+	metaNameRE    = regexp.MustCompile(`(?is)\sname\s*=\s*["']?go-import["']?`)
+	metaContentRE = regexp.MustCompile(`(?is)\scontent\s*=\s*["']([^"']*)["']`)
+)
+
+// resolveImportMeta fetches the go-import meta tag for `imppath`, as
+// `go get` does, caching the result for every path under its prefix. Failed
+// lookups are cached too, so they aren't retried by every package.
+func resolveImportMeta(imppath string) (*importMeta, error) {
+	host := strings.Split(imppath, "/")[0]
+	importMetaMu.Lock()
+	for prefix, m := range importMetaCache {
+		if imppath == prefix || strings.HasPrefix(imppath, prefix+"/") {
+			importMetaMu.Unlock()
+			return m, nil
+		}
+	}
+	for _, key := range []string{imppath, host} {
+		if err, ok := importMetaErrs[key]; ok {
+			importMetaMu.Unlock()
+			return nil, err
+		}
+	}
+	importMetaMu.Unlock()
+
+	m, err := fetchImportMeta(imppath)
+	if err != nil {
+		key := imppath
+		if _, ok := err.(*url.Error); ok {
+			key = host
+		}
+		importMetaMu.Lock()
+		importMetaErrs[key] = err
+		importMetaMu.Unlock()
+	}
+	return m, err
+}
+
+// fetchImportMeta fetches the go-import meta tag for `imppath`.
+func fetchImportMeta(imppath string) (*importMeta, error) {
+	req, err := http.NewRequest("GET", "https://"+imppath+"?go-get=1", nil)
+	if err != nil {
+		return nil, err
+	}
+	if login, password, ok := netrcAuth(req.URL.Hostname()); ok {
+		req.SetBasicAuth(login, password)
+	}
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		return nil, fmt.Errorf("authentication failed fetching %s: %s (set up credentials in ~/.netrc)", req.URL.Host, resp.Status)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, tag := range metaTagRE.FindAllString(string(body), -1) {
+		if !metaNameRE.MatchString(tag) {
+			continue
+		}
+		c := metaContentRE.FindStringSubmatch(tag)
+		if c == nil {
+			continue
+		}
+
+		fields := strings.Fields(c[1])
+		if len(fields) != 3 {
+			continue
+		}
+		m := &importMeta{Prefix: fields[0], VCS: fields[1], RepoURL: fields[2]}
+		if imppath != m.Prefix && !strings.HasPrefix(imppath, m.Prefix+"/") {
+			continue
+		}
+
+		importMetaMu.Lock()
+		importMetaCache[m.Prefix] = m
+		importMetaMu.Unlock()
+		return m, nil
+	}
+
+	return nil, fmt.Errorf("no go-import meta tag found for %s", imppath)
+}
@@ -0,0 +1,45 @@
+package main
+
+import "testing"
+
+func TestRepoRootDepth(t *testing.T) {
+	defer func(roots map[string]int) { config.RepoRoots = roots }(config.RepoRoots)
+	config.RepoRoots = map[string]int{
+		"example.com/org":       3,
+		"example.com/org/mono":  2,
+		"github.com/x/monorepo": 4,
+	}
+
+	cases := map[string]int{
+		"github.com/x/y/sub":          3,
+		"golang.org/x/net/context":    3,
+		"k8s.io/client-go/rest":       2,
+		"go.opencensus.io/trace":      1,
+		"gopkg.in/yaml.v2":            2,
+		"gopkg.in/user/pkg.v1/sub":    3,
+		"unknown.host/a/b/c":          3,
+		"example.com/org/repo/sub":    3,
+		"example.com/org/mono/sub":    2,
+		"example.com/organization/x":  3,
+		"github.com/x/monorepo/a/sub": 4,
+	}
+	for imp, want := range cases {
+		if got := repoRootDepth(imp); got != want {
+			t.Errorf("repoRootDepth(%q) = %d, want %d", imp, got, want)
+		}
+	}
+
+	bases := map[string]string{
+		"github.com/x/y/sub":     "github.com/x/y",
+		"github.com/x/y/v2/sub":  "github.com/x/y/v2",
+		"github.com/x/y/v1/sub":  "github.com/x/y",
+		"k8s.io/client-go/rest":  "k8s.io/client-go",
+		"gopkg.in/yaml.v2":       "gopkg.in/yaml.v2",
+		"example.com/org/mono/x": "example.com/org",
+	}
+	for imp, want := range bases {
+		if got := getBaseDVCS(imp); got != want {
+			t.Errorf("getBaseDVCS(%q) = %q, want %q", imp, got, want)
+		}
+	}
+}
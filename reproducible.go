@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	gx "github.com/whyrusleeping/gx/gxutil"
+)
+
+// In reproducible mode, the packages installed locally are normalized so
+// that vendor trees are identical bit for bit wherever they are installed,
+// as packagers verifying builds (Nix, Guix) need: files get canonical modes
+// and all get the same modification time.
+
+// reproducible returns whether installed packages are normalized, as set
+// with GX_GO_REPRODUCIBLE, SOURCE_DATE_EPOCH or the config.
+func reproducible() (bool, error) {
+	if v := os.Getenv("GX_GO_REPRODUCIBLE"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return false, fmt.Errorf("invalid GX_GO_REPRODUCIBLE %q, must be a boolean", v)
+		}
+		return b, nil
+	}
+	if os.Getenv("SOURCE_DATE_EPOCH") != "" {
+		return true, nil
+	}
+	return config.Reproducible, nil
+}
+
+// reproducibleTime returns the modification time given to normalized
+// files: SOURCE_DATE_EPOCH, or else one second after the epoch as Nix does.
+func reproducibleTime() time.Time {
+	if v := os.Getenv("SOURCE_DATE_EPOCH"); v != "" {
+		if sec, err := strconv.ParseInt(v, 10, 64); err == nil {
+			return time.Unix(sec, 0).UTC()
+		}
+		Warn("ignoring invalid SOURCE_DATE_EPOCH %q", v)
+	}
+	return time.Unix(1, 0).UTC()
+}
+
+// canonicalMode returns the permissions of the file `fi` once normalized:
+// read-only, executable or not, and writable for directories so that
+// packages can still be rewritten.
+func canonicalMode(fi os.FileInfo) os.FileMode {
+	switch {
+	case fi.IsDir():
+		return 0755
+	case fi.Mode()&0111 != 0:
+		return 0555
+	default:
+		return 0444
+	}
+}
+
+// normalizeTree gives everything under `dir` its canonical mode and the
+// reproducible modification time.
+func normalizeTree(dir string) error {
+	mtime := reproducibleTime()
+	return filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fi.IsDir() && !fi.Mode().IsRegular() {
+			return nil
+		}
+		if fi.Mode().Perm() != canonicalMode(fi) {
+			if err := os.Chmod(p, canonicalMode(fi)); err != nil {
+				return err
+			}
+		}
+		return os.Chtimes(p, mtime, mtime)
+	})
+}
+
+// savePackageFile saves `pkg` to `fname` as gx does, but with its keys
+// always sorted, which gx only does when the file exists already.
+func savePackageFile(pkg interface{}, fname string) error {
+	if err := gx.SavePackageFile(pkg, fname); err != nil {
+		return err
+	}
+
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return err
+	}
+
+	buf := new(bytes.Buffer)
+	enc := json.NewEncoder(buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		return err
+	}
+	if bytes.Equal(buf.Bytes(), data) {
+		return nil
+	}
+	return ioutil.WriteFile(fname, buf.Bytes(), 0644)
+}
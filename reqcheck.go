@@ -0,0 +1,247 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"regexp"
+	"runtime"
+	"strings"
+)
+
+// reqResult is the outcome of checking one requirement of a package.
+type reqResult struct {
+	// Requirement describes what is required, e.g. "go >=1.12"
+	Requirement string `json:"requirement"`
+
+	// Found is what the local environment has
+	Found string `json:"found"`
+
+	Satisfied bool   `json:"satisfied"`
+	Message   string `json:"message,omitempty"`
+}
+
+// checkGoVersionReq checks that both the installed go and the one gx-go was
+// built with satisfy the goversion of `npkg`.
+func checkGoVersionReq(npkg *Package) ([]reqResult, error) {
+	if npkg.Gx.GoVersion == "" {
+		return nil, nil
+	}
+
+	havevers, err := installedGoVersion()
+	if err != nil {
+		return nil, err
+	}
+
+	reqvers := npkg.Gx.GoVersion
+	req := "go " + reqvers
+
+	var results []reqResult
+	if havevers == "devel" {
+		Log("warning: using unknown development version of go, proceed with caution")
+		results = append(results, reqResult{Requirement: req, Found: "devel", Satisfied: true})
+	} else {
+		ok, err := goVersionMatches(havevers, reqvers)
+		if err != nil {
+			return nil, err
+		}
+
+		r := reqResult{Requirement: req, Found: havevers, Satisfied: ok}
+		if !ok {
+			r.Message = fmt.Sprintf("package '%s' requires go version %s, you have %s installed.", npkg.Name, reqvers, havevers)
+		}
+		results = append(results, r)
+	}
+
+	gxgocompvers := runtime.Version()
+	req = "gx-go built with go " + reqvers
+	switch {
+	case strings.HasPrefix(gxgocompvers, "devel"):
+	case strings.HasPrefix(gxgocompvers, "go"):
+		ok, err := goVersionMatches(gxgocompvers[2:], reqvers)
+		if err != nil {
+			return nil, err
+		}
+
+		r := reqResult{Requirement: req, Found: gxgocompvers[2:], Satisfied: ok}
+		if !ok {
+			r.Message = fmt.Sprintf("package '%s' requires go version %s.\nhowever, your gx-go binary was compiled with %s.\nPlease update gx-go (or recompile with your current go compiler)", npkg.Name, reqvers, gxgocompvers)
+		}
+		results = append(results, r)
+	default:
+		Log("gx-go was compiled with an unrecognized version of go. (%s)", gxgocompvers)
+		Log("If you encounter any strange issues during its usage, try rebuilding gx-go with a go version matching %s", reqvers)
+	}
+	return results, nil
+}
+
+// installedGoVersion returns the version of the installed go tool, such as
+// "1.12.3", or "devel" for a development build.
+func installedGoVersion() (string, error) {
+	out, err := exec.Command("go", "version").CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("no go compiler installed")
+	}
+
+	parts := strings.Split(string(out), " ")
+	if len(parts) < 4 {
+		return "", fmt.Errorf("unrecognized output from go compiler")
+	}
+	if parts[2] == "devel" {
+		return "devel", nil
+	}
+	return strings.TrimPrefix(parts[2], "go"), nil
+}
+
+// goEnv returns the values of the go env variables `vars`, as the go tool
+// sees them, so that GOOS and GOARCH set for cross compiling are honored.
+func goEnv(vars ...string) (map[string]string, error) {
+	out, err := exec.Command("go", append([]string{"env"}, vars...)...).Output()
+	if err != nil {
+		return nil, fmt.Errorf("no go compiler installed")
+	}
+
+	vals := strings.Split(strings.TrimRight(string(out), "\n"), "\n")
+	if len(vals) != len(vars) {
+		return nil, fmt.Errorf("unrecognized output from go env")
+	}
+
+	env := make(map[string]string)
+	for i, v := range vars {
+		env[v] = strings.TrimSpace(vals[i])
+	}
+	return env, nil
+}
+
+// checkPlatformReqs checks that the platform being built for is one
+// `npkg` supports and, if it requires cgo, that cgo is enabled and the C
+// compiler is installed.
+func checkPlatformReqs(npkg *Package) ([]reqResult, error) {
+	gi := npkg.Gx
+	if len(gi.SupportedOS) == 0 && len(gi.SupportedArch) == 0 && !gi.RequiresCgo {
+		return nil, nil
+	}
+
+	env, err := goEnv("GOOS", "GOARCH", "CGO_ENABLED", "CC")
+	if err != nil {
+		return nil, err
+	}
+
+	var results []reqResult
+	if len(gi.SupportedOS) > 0 {
+		r := reqResult{
+			Requirement: "os " + strings.Join(gi.SupportedOS, "|"),
+			Found:       env["GOOS"],
+			Satisfied:   containsString(gi.SupportedOS, env["GOOS"]),
+		}
+		if !r.Satisfied {
+			r.Message = fmt.Sprintf("package '%s' only supports %s, not %s", npkg.Name, strings.Join(gi.SupportedOS, ", "), env["GOOS"])
+		}
+		results = append(results, r)
+	}
+	if len(gi.SupportedArch) > 0 {
+		r := reqResult{
+			Requirement: "arch " + strings.Join(gi.SupportedArch, "|"),
+			Found:       env["GOARCH"],
+			Satisfied:   containsString(gi.SupportedArch, env["GOARCH"]),
+		}
+		if !r.Satisfied {
+			r.Message = fmt.Sprintf("package '%s' only supports %s, not %s", npkg.Name, strings.Join(gi.SupportedArch, ", "), env["GOARCH"])
+		}
+		results = append(results, r)
+	}
+
+	if gi.RequiresCgo {
+		r := reqResult{Requirement: "cgo", Found: "CGO_ENABLED=" + env["CGO_ENABLED"], Satisfied: true}
+		cc := strings.Fields(env["CC"])
+		if len(cc) == 0 {
+			cc = []string{"gcc"}
+		}
+
+		if env["CGO_ENABLED"] != "1" {
+			r.Satisfied = false
+			r.Message = fmt.Sprintf("package '%s' requires cgo, which is disabled (CGO_ENABLED=%s)", npkg.Name, env["CGO_ENABLED"])
+		} else if _, err := exec.LookPath(cc[0]); err != nil {
+			r.Satisfied = false
+			r.Found = "no " + cc[0]
+			r.Message = fmt.Sprintf("package '%s' requires cgo, but the C compiler %s is not installed", npkg.Name, cc[0])
+		}
+		results = append(results, r)
+	}
+	return results, nil
+}
+
+var toolVersionRE = regexp.MustCompile(`\d+(\.\d+)+`)
+
+// checkToolReqs checks that the external tools needed by `npkg` are
+// installed, at their minimum versions if given.
+func checkToolReqs(npkg *Package) ([]reqResult, error) {
+	var results []reqResult
+	for _, t := range npkg.Gx.Tools {
+		r := reqResult{Requirement: t.Name, Satisfied: true}
+		if t.MinVersion != "" {
+			r.Requirement += " >=" + t.MinVersion
+		}
+
+		if _, err := exec.LookPath(t.Name); err != nil {
+			r.Satisfied = false
+			r.Message = fmt.Sprintf("package '%s' requires %s, which is not installed", npkg.Name, t.Name)
+			results = append(results, r)
+			continue
+		}
+		r.Found = "installed"
+		if t.MinVersion == "" {
+			results = append(results, r)
+			continue
+		}
+
+		have, err := toolVersion(t)
+		if err != nil {
+			return nil, err
+		}
+		r.Found = have
+
+		hv, err := parseGoVersion(have)
+		if err != nil {
+			return nil, err
+		}
+		rv, err := parseGoVersion(t.MinVersion)
+		if err != nil {
+			return nil, fmt.Errorf("package '%s': invalid minimum version of %s: %s", npkg.Name, t.Name, err)
+		}
+		if compareVersions(hv, rv) < 0 {
+			r.Satisfied = false
+			r.Message = fmt.Sprintf("package '%s' requires %s version %s or later, you have %s installed", npkg.Name, t.Name, t.MinVersion, have)
+		}
+		results = append(results, r)
+	}
+	return results, nil
+}
+
+// toolVersion runs the tool `t` to find out its version, taken as the
+// first dotted number it prints.
+func toolVersion(t ToolReq) (string, error) {
+	flag := t.VersionFlag
+	if flag == "" {
+		flag = "--version"
+	}
+
+	out, err := exec.Command(t.Name, flag).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("checking the version of %s: %s", t.Name, err)
+	}
+
+	v := toolVersionRE.FindString(string(out))
+	if v == "" {
+		return "", fmt.Errorf("could not find the version of %s in the output of %s %s", t.Name, t.Name, flag)
+	}
+	return v, nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	homedir "github.com/mitchellh/go-homedir"
+	cli "github.com/urfave/cli"
+	gx "github.com/whyrusleeping/gx/gxutil"
+)
+
+// Every package read by hash is recorded in a cache shared by all gx-go
+// processes, with what resolving gx imports needs: its name, version, dvcs
+// import and dependencies. Packages are content addressed, so entries never
+// go stale; the operations mapping gx imports back to dvcs imports (fix,
+// undo, unlink, dep-map) read them there instead of reading package.json
+// files or fetching the packages again.
+
+const defaultResolveCache = "~/.cache/gx-go/resolve.json"
+
+// resolvedPackage is the entry of a package in the cache.
+type resolvedPackage struct {
+	Name       string           `json:"name"`
+	Version    string           `json:"version,omitempty"`
+	DvcsImport string           `json:"dvcsimport,omitempty"`
+	Deps       []*gx.Dependency `json:"deps,omitempty"`
+}
+
+var resolveCache struct {
+	sync.Mutex
+	loaded  bool
+	entries map[string]*resolvedPackage
+
+	// the entries recorded by this process, to be saved
+	added map[string]*resolvedPackage
+}
+
+// resolveCachePath returns the file of the cache, taken from
+// GX_GO_RESOLVE_CACHE if set.
+func resolveCachePath() (string, error) {
+	p := os.Getenv("GX_GO_RESOLVE_CACHE")
+	if p == "" {
+		p = defaultResolveCache
+	}
+	return homedir.Expand(p)
+}
+
+// readResolveCache reads the entries of the cache file.
+func readResolveCache() map[string]*resolvedPackage {
+	entries := make(map[string]*resolvedPackage)
+	p, err := resolveCachePath()
+	if err != nil {
+		return entries
+	}
+	data, err := ioutil.ReadFile(p)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			VLog("reading the resolve cache: %s", err)
+		}
+		return entries
+	}
+	if err := json.Unmarshal(data, &entries); err != nil {
+		Warn("ignoring the corrupted resolve cache %s: %s", p, err)
+		return make(map[string]*resolvedPackage)
+	}
+	return entries
+}
+
+// loadResolveCache reads the cache the first time it is needed. It must be
+// called with resolveCache held.
+func loadResolveCache() {
+	if resolveCache.loaded {
+		return
+	}
+	resolveCache.loaded = true
+	resolveCache.entries = readResolveCache()
+	resolveCache.added = make(map[string]*resolvedPackage)
+}
+
+// cachedPackage returns the package `hash` as recorded in the cache, under
+// either form of its hash, with only its name, version, dvcs import and
+// dependencies set.
+func cachedPackage(hash string) (*Package, bool) {
+	resolveCache.Lock()
+	defer resolveCache.Unlock()
+	loadResolveCache()
+
+	var e *resolvedPackage
+	for _, form := range hashForms(hash) {
+		if e = resolveCache.entries[form]; e != nil {
+			break
+		}
+	}
+	if e == nil {
+		return nil, false
+	}
+	pkg := new(Package)
+	pkg.Name = e.Name
+	pkg.Version = e.Version
+	pkg.Gx.DvcsImport = e.DvcsImport
+	pkg.Dependencies = e.Deps
+	return pkg, true
+}
+
+// recordPackage records the package `pkg` read as `hash` in the cache.
+func recordPackage(hash string, pkg *Package) {
+	resolveCache.Lock()
+	defer resolveCache.Unlock()
+	loadResolveCache()
+
+	if _, ok := resolveCache.entries[hash]; ok {
+		return
+	}
+	e := &resolvedPackage{
+		Name:       pkg.Name,
+		Version:    pkg.Version,
+		DvcsImport: pkg.Gx.DvcsImport,
+	}
+	for _, dep := range pkg.Dependencies {
+		e.Deps = append(e.Deps, &gx.Dependency{Name: dep.Name, Hash: dep.Hash, Version: dep.Version})
+	}
+	resolveCache.entries[hash] = e
+	resolveCache.added[hash] = e
+}
+
+// recordPackageIn records the package `pkg` read as `hash` from `dir` in
+// the cache, unless it was read through a link to a development checkout,
+// whose package.json need not be the published one.
+func recordPackageIn(hash, dir string, pkg *Package) {
+	if linkedDir(dir) {
+		VLog("not caching %s, linked at %s", hash, dir)
+		return
+	}
+	recordPackage(hash, pkg)
+}
+
+// linkedDir returns whether the package directory `dir`, or the package
+// within it, is a symlink, as `gx-go link` makes them.
+func linkedDir(dir string) bool {
+	fi, err := os.Lstat(dir)
+	if err != nil {
+		return false
+	}
+	if fi.Mode()&os.ModeSymlink != 0 {
+		return true
+	}
+	if !fi.IsDir() {
+		return false
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return false
+	}
+	for _, e := range entries {
+		if e.Mode()&os.ModeSymlink != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// saveResolveCache adds the packages recorded by this process to the cache
+// file, along with the ones other processes saved meanwhile.
+func saveResolveCache() error {
+	resolveCache.Lock()
+	defer resolveCache.Unlock()
+	if len(resolveCache.added) == 0 {
+		return nil
+	}
+
+	err := updateResolveCache(func(entries map[string]*resolvedPackage) {
+		for hash, e := range resolveCache.added {
+			entries[hash] = e
+		}
+	})
+	if err != nil {
+		return err
+	}
+	resolveCache.added = make(map[string]*resolvedPackage)
+	return nil
+}
+
+// dropResolveCache removes the packages `hashes` from the cache file, or
+// every package if `hashes` is empty, and returns how many were removed.
+func dropResolveCache(hashes []string) (int, error) {
+	resolveCache.Lock()
+	defer resolveCache.Unlock()
+
+	var n int
+	err := updateResolveCache(func(entries map[string]*resolvedPackage) {
+		if len(hashes) == 0 {
+			n = len(entries)
+			for hash := range entries {
+				delete(entries, hash)
+			}
+		}
+		for _, hash := range hashes {
+			if _, ok := entries[hash]; ok {
+				delete(entries, hash)
+				n++
+			}
+		}
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	for _, hash := range hashes {
+		delete(resolveCache.added, hash)
+		delete(resolveCache.entries, hash)
+	}
+	if len(hashes) == 0 {
+		resolveCache.added = make(map[string]*resolvedPackage)
+		resolveCache.entries = make(map[string]*resolvedPackage)
+	}
+	return n, nil
+}
+
+// updateResolveCache rewrites the cache file with the changes `fn` makes
+// to its entries, holding a lock on it so that concurrent updates from other
+// processes aren't lost.
+func updateResolveCache(fn func(map[string]*resolvedPackage)) error {
+	p, err := resolveCachePath()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+
+	lf, err := os.OpenFile(p+".lock", os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer lf.Close()
+	if err := lockFile(lf, true); err != nil {
+		return fmt.Errorf("locking the resolve cache: %s", err)
+	}
+	defer unlockFile(lf)
+
+	entries := readResolveCache()
+	fn(entries)
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+
+	// write then rename, as other processes may be reading it
+	tmp, err := ioutil.TempFile(filepath.Dir(p), ".resolve-")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), p); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
+
+var ResolveCacheCommand = cli.Command{
+	Name:  "resolve-cache",
+	Usage: "manage the cache of the dvcs imports and dependencies of gx hashes",
+	Subcommands: []cli.Command{
+		{
+			Name:  "path",
+			Usage: "print the path of the cache file",
+			Action: func(c *cli.Context) error {
+				p, err := resolveCachePath()
+				if err != nil {
+					return err
+				}
+				if jsonOutput {
+					return printJSON(map[string]string{"path": p})
+				}
+				fmt.Println(p)
+				return nil
+			},
+		},
+		{
+			Name:      "drop",
+			Usage:     "remove packages from the cache",
+			ArgsUsage: "<hash>...",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "all",
+					Usage: "remove every package",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				hashes := []string(c.Args())
+				if len(hashes) == 0 && !c.Bool("all") {
+					return fmt.Errorf("must specify the hashes to drop, or --all")
+				}
+				if len(hashes) > 0 && c.Bool("all") {
+					return fmt.Errorf("--all takes no hashes")
+				}
+				for _, hash := range hashes {
+					if !isHash(hash) {
+						return fmt.Errorf("invalid hash %q", hash)
+					}
+				}
+
+				n, err := dropResolveCache(hashes)
+				if err != nil {
+					return err
+				}
+				Log("dropped %d packages from the resolve cache", n)
+				return nil
+			},
+		},
+	},
+}
+
+// resolveDep returns the package of `dep` for resolving imports, from the
+// cache, or else as loadDep does.
+func resolveDep(dep *gx.Dependency, pkgDir string) (*Package, error) {
+	if pkg, ok := cachedPackage(dep.Hash); ok {
+		return pkg, nil
+	}
+	return loadDep(dep, pkgDir)
+}
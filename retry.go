@@ -0,0 +1,29 @@
+package main
+
+import (
+	"time"
+)
+
+// retries is the number of times network operations are retried after
+// failing, set by the global --retries flag.
+var retries int
+
+// retryDelay is the wait before the first retry, doubled on every attempt.
+const retryDelay = 2 * time.Second
+
+// withRetries runs `f`, retrying it with exponential backoff when it fails.
+// Authentication failures won't go away by themselves and interruptions
+// are meant to stop it, so they are not retried.
+func withRetries(what string, f func() error) error {
+	delay := retryDelay
+	for n := 0; ; n++ {
+		err := f()
+		if err == nil || n >= retries || isInterrupted() || authErrorRE.MatchString(err.Error()) {
+			return err
+		}
+
+		Warn("%s failed (attempt %d of %d), retrying in %s: %s", what, n+1, retries+1, delay, err)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
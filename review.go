@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	gx "github.com/whyrusleeping/gx/gxutil"
+)
+
+// reviewTree is the dependency tree of an import, as found by review.
+type reviewTree struct {
+	root     string
+	children map[string][]string
+
+	// packages that are new to gx, in the order they were found
+	order []string
+	// number of packages the import will publish
+	fetched int
+	// why packages are not imported as new gx packages
+	status map[string]string
+}
+
+// review fetches the dependency tree of `root` up front, prints it, and
+// lets the user confirm, rename or skip each package that will be published
+// as a new gx package. Renames are recorded as overrides and skipped
+// packages as excludes, so the import that follows needs no more prompts.
+func (i *Importer) review(root string) error {
+	if nonInteractive {
+		return fmt.Errorf("--review needs to prompt, it cannot be used with --yes")
+	}
+	if err := checkInteractive("review"); err != nil {
+		return err
+	}
+
+	t, err := i.findTree(getBaseDVCS(root))
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "\n%s\n", t.root)
+	t.print(t.root, 1, make(map[string]bool))
+	fmt.Fprintf(os.Stderr, "\n%d packages to import, answer [y]es, [r]ename or [s]kip for each\n\n", len(t.order))
+
+	i.progressTotal = t.fetched
+	scan := bufio.NewScanner(os.Stdin)
+	for n, imp := range t.order {
+		name := i.defaultName(imp)
+		for {
+			fmt.Fprintf(os.Stderr, "[%d/%d] %s as '%s'? [y/r/s] (default: y) ", n+1, len(t.order), imp, name)
+			if !scan.Scan() {
+				if err := scan.Err(); err != nil {
+					return err
+				}
+				return fmt.Errorf("unexpected termination of stdin")
+			}
+
+			switch strings.ToLower(strings.TrimSpace(scan.Text())) {
+			case "", "y", "yes":
+				i.setOverrideName(imp, name)
+			case "r", "rename":
+				fmt.Fprintf(os.Stderr, "  new name for %s: ", imp)
+				if !scan.Scan() {
+					return fmt.Errorf("unexpected termination of stdin")
+				}
+				if nname := strings.TrimSpace(scan.Text()); nname != "" {
+					name = nname
+				}
+				continue
+			case "s", "skip":
+				if imp == t.root {
+					fmt.Fprintln(os.Stderr, "  the package being imported cannot be skipped")
+					continue
+				}
+				i.excludes = append(i.excludes, imp)
+				i.progressTotal--
+			default:
+				continue
+			}
+			break
+		}
+	}
+	return nil
+}
+
+// findTree fetches every package in the dependency tree of `root`.
+func (i *Importer) findTree(root string) (*reviewTree, error) {
+	t := &reviewTree{
+		root:     root,
+		children: make(map[string][]string),
+		status:   make(map[string]string),
+	}
+
+	Log("fetching the dependency tree of %s for review", root)
+	seen := map[string]bool{root: true}
+	queue := []string{root}
+	for len(queue) > 0 {
+		imp := queue[0]
+		queue = queue[1:]
+
+		if _, ok := i.preMap[imp]; ok {
+			t.status[imp] = "mapped"
+			continue
+		}
+		if _, ok := i.pkgs[imp]; ok {
+			t.status[imp] = "published"
+			continue
+		}
+
+		dir, err := i.fetchPackage(imp)
+		if err != nil {
+			return nil, err
+		}
+		t.fetched++
+		if err := i.addPins(dir); err != nil {
+			return nil, fmt.Errorf("reading the pinned dependencies of %s: %s", imp, err)
+		}
+
+		if _, err := os.Stat(filepath.Join(dir, gx.PkgFileName)); err == nil {
+			t.status[imp] = "gx package"
+		} else {
+			t.order = append(t.order, imp)
+		}
+
+		deps, err := i.DepsToVendorForPackage(imp)
+		if err != nil {
+			return nil, fmt.Errorf("error fetching deps for %s: %s", imp, err)
+		}
+		sort.Strings(deps)
+
+		for _, d := range deps {
+			if strings.HasPrefix(d, imp) || i.excluded(d) {
+				continue
+			}
+			d = getBaseDVCS(d)
+			if i.brokenEdge(imp, d) {
+				continue
+			}
+
+			cs := t.children[imp]
+			if len(cs) == 0 || cs[len(cs)-1] != d {
+				t.children[imp] = append(cs, d)
+			}
+			if !seen[d] {
+				seen[d] = true
+				queue = append(queue, d)
+			}
+		}
+	}
+	return t, nil
+}
+
+func (t *reviewTree) print(imp string, depth int, shown map[string]bool) {
+	for _, c := range t.children[imp] {
+		line := strings.Repeat("  ", depth) + c
+		if s, ok := t.status[c]; ok {
+			line += " (" + s + ")"
+		}
+		if shown[c] && len(t.children[c]) > 0 {
+			fmt.Fprintln(os.Stderr, line+" (*)")
+			continue
+		}
+		shown[c] = true
+
+		fmt.Fprintln(os.Stderr, line)
+		t.print(c, depth+1, shown)
+	}
+}
+
+// defaultName is the name `imppath` would be published under.
+func (i *Importer) defaultName(imppath string) string {
+	if ov := i.overrides[imppath]; ov != nil && ov.Name != "" {
+		return ov.Name
+	}
+	return defaultPackageName(imppath)
+}
@@ -0,0 +1,108 @@
+package rewrite
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+)
+
+// journal keeps the originals of the files a rewrite replaces in a
+// temporary directory outside the tree, so that an interrupted rewrite can
+// be undone.
+type journal struct {
+	mu  sync.Mutex
+	dir string
+
+	// the paths of the originals kept, by file
+	files map[string]string
+}
+
+// keep saves the file `p` before it is replaced, as a hardlink where
+// possible.
+func (j *journal) keep(p string) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.dir == "" {
+		dir, err := ioutil.TempDir("", "gx-go-journal")
+		if err != nil {
+			return err
+		}
+		j.dir = dir
+		j.files = make(map[string]string)
+	}
+	if _, ok := j.files[p]; ok {
+		return nil
+	}
+
+	orig := filepath.Join(j.dir, strconv.Itoa(len(j.files)))
+	if err := os.Link(p, orig); err != nil {
+		if err := copyFile(p, orig); err != nil {
+			return err
+		}
+	}
+	j.files[p] = orig
+	return nil
+}
+
+// rollback puts the files kept back in place.
+func (j *journal) rollback() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	var firstErr error
+	for p, orig := range j.files {
+		if err := os.Rename(orig, p); err != nil {
+			// the temporary directory may be on another filesystem
+			if err := copyFile(orig, p); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	if firstErr == nil {
+		j.clear()
+	}
+	return firstErr
+}
+
+// commit removes the files kept.
+func (j *journal) commit() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.clear()
+}
+
+func (j *journal) clear() error {
+	j.files = nil
+	if j.dir == "" {
+		return nil
+	}
+	err := os.RemoveAll(j.dir)
+	j.dir = ""
+	return err
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	fi, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, fi.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
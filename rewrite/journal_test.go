@@ -0,0 +1,89 @@
+package rewrite
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// rewriteKept keeps and then replaces the file `p`, as a rewrite does.
+func rewriteKept(t *testing.T, j *journal, p, data string) {
+	if err := j.keep(p); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(p+".temp", []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(p+".temp", p); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestJournalRollback(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "gx-go-journal-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	p := filepath.Join(tmp, "a.go")
+	if err := ioutil.WriteFile(p, []byte("original"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	j := new(journal)
+	rewriteKept(t, j, p, "first")
+	// a file rewritten twice is restored as it was before the first rewrite
+	rewriteKept(t, j, p, "second")
+	dir := j.dir
+
+	if err := j.rollback(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "original" {
+		t.Fatalf("rolled back to %q, want %q", data, "original")
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Fatalf("journal directory %s left behind", dir)
+	}
+}
+
+func TestJournalCommit(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "gx-go-journal-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	p := filepath.Join(tmp, "a.go")
+	if err := ioutil.WriteFile(p, []byte("original"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	j := new(journal)
+	rewriteKept(t, j, p, "rewritten")
+	dir := j.dir
+
+	if err := j.commit(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Fatalf("journal directory %s left behind", dir)
+	}
+	// nothing is left to roll back
+	if err := j.rollback(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "rewritten" {
+		t.Fatalf("committed file is %q, want %q", data, "rewritten")
+	}
+}
@@ -3,6 +3,7 @@ package rewrite
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"fmt"
 	"go/ast"
 	"go/parser"
@@ -29,12 +30,27 @@ var bufpool = &sync.Pool{
 var cfg = &printer.Config{Mode: printer.UseSpaces | printer.TabIndent, Tabwidth: 8}
 
 func RewriteImports(ipath string, rw func(string) string, filter func(string) bool) error {
+	return RewriteImportsContext(context.Background(), ipath, "vendor", rw, filter, nil)
+}
+
+// Counter counts the files of a rewrite as they are found and processed.
+type Counter interface {
+	Found()
+	Processed()
+}
+
+// RewriteImportsContext is RewriteImports, stopping when `ctx` is done. The
+// files rewritten until then are restored as they were, and the error of
+// `ctx` is returned. The files are counted with `c`, if set. The vendor
+// directory `vendor`, relative to `ipath`, is skipped.
+func RewriteImportsContext(ctx context.Context, ipath, vendor string, rw func(string) string, filter func(string) bool, c Counter) error {
 	path, err := filepath.EvalSymlinks(ipath)
 	if err != nil {
 		return err
 	}
 
 	var rwLock sync.Mutex
+	j := new(journal)
 
 	var wg sync.WaitGroup
 	torewrite := make(chan string)
@@ -43,14 +59,170 @@ func RewriteImports(ipath string, rw func(string) string, filter func(string) bo
 		go func() {
 			defer wg.Done()
 			for path := range torewrite {
-				err := rewriteImportsInFile(path, rw, &rwLock)
+				_, err := rewriteImportsInFile(path, path, rw, &rwLock, j)
 				if err != nil {
 					fmt.Println("rewrite error: ", err)
 				}
+				if c != nil {
+					c.Processed()
+				}
 			}
 		}()
 	}
 
+	// listed first, for the total to be known early
+	var files []string
+	walkGoFiles(path, vendor, filter, func(p string) bool {
+		if c != nil {
+			c.Found()
+		}
+		files = append(files, p)
+		return ctx.Err() == nil
+	})
+
+feed:
+	for _, p := range files {
+		select {
+		case torewrite <- p:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(torewrite)
+	wg.Wait()
+
+	if ctx.Err() != nil {
+		if err := j.rollback(); err != nil {
+			return fmt.Errorf("%s, and restoring the files rewritten failed: %s", ctx.Err(), err)
+		}
+		return ctx.Err()
+	}
+	return j.commit()
+}
+
+// OverlayImports writes the go files under `ipath` whose imports `rw`
+// changes, rewritten, to the same relative paths under `dir`, leaving the
+// originals untouched. It returns the paths of the rewritten copies by the
+// ones of the originals, as go build -overlay takes them. The vendor
+// directory `vendor`, relative to `ipath`, is skipped.
+func OverlayImports(ipath, dir, vendor string, rw func(string) string, filter func(string) bool) (map[string]string, error) {
+	path, err := filepath.EvalSymlinks(ipath)
+	if err != nil {
+		return nil, err
+	}
+
+	var rwLock sync.Mutex
+	replace := make(map[string]string)
+	var firstErr error
+	walkGoFiles(path, vendor, filter, func(p string) bool {
+		if firstErr != nil {
+			return false
+		}
+
+		out := filepath.Join(dir, p[len(path):])
+		if err := os.MkdirAll(filepath.Dir(out), 0755); err != nil {
+			firstErr = err
+			return false
+		}
+
+		changed, err := rewriteImportsInFile(p, out, rw, &rwLock, nil)
+		if err != nil {
+			firstErr = fmt.Errorf("%s: %s", p, err)
+			return false
+		}
+		if changed {
+			replace[p] = out
+		}
+		return true
+	})
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return replace, nil
+}
+
+// ImportChange describes an import that would be rewritten.
+type ImportChange struct {
+	File string `json:"file"`
+	Line int    `json:"line"`
+	Old  string `json:"old"`
+	New  string `json:"new"`
+}
+
+// FindImportChanges returns the changes RewriteImports would make with the
+// same arguments, without modifying any files.
+func FindImportChanges(ipath, vendor string, rw func(string) string, filter func(string) bool) ([]ImportChange, error) {
+	path, err := filepath.EvalSymlinks(ipath)
+	if err != nil {
+		return nil, err
+	}
+
+	var changes []ImportChange
+	walkGoFiles(path, vendor, filter, func(p string) bool {
+		fset := token.NewFileSet()
+		file, err := parser.ParseFile(fset, p, nil, parser.ImportsOnly)
+		if err != nil {
+			fmt.Println("rewrite error: ", err)
+			return true
+		}
+
+		for _, imp := range file.Imports {
+			ip, err := strconv.Unquote(imp.Path.Value)
+			if err != nil {
+				continue
+			}
+
+			if np := rw(ip); np != ip {
+				changes = append(changes, ImportChange{
+					File: p,
+					Line: fset.Position(imp.Pos()).Line,
+					Old:  ip,
+					New:  np,
+				})
+			}
+		}
+		return true
+	})
+
+	return changes, nil
+}
+
+// ListImports returns the import paths of the files RewriteImports would
+// rewrite with the same arguments, with the files importing each of them
+// (relative to `ipath`).
+func ListImports(ipath, vendor string, filter func(string) bool) (map[string][]string, error) {
+	path, err := filepath.EvalSymlinks(ipath)
+	if err != nil {
+		return nil, err
+	}
+
+	imports := make(map[string][]string)
+	walkGoFiles(path, vendor, filter, func(p string) bool {
+		file, err := parser.ParseFile(token.NewFileSet(), p, nil, parser.ImportsOnly)
+		if err != nil {
+			fmt.Println("rewrite error: ", err)
+			return true
+		}
+
+		rel, err := filepath.Rel(path, p)
+		if err != nil {
+			rel = p
+		}
+		for _, imp := range file.Imports {
+			if ip, err := strconv.Unquote(imp.Path.Value); err == nil {
+				imports[ip] = append(imports[ip], rel)
+			}
+		}
+		return true
+	})
+
+	return imports, nil
+}
+
+// walkGoFiles calls `fn` on the go files under `path` that `filter`
+// accepts, until it returns false. The vendor directory `vendor`, relative
+// to `path`, is skipped.
+func walkGoFiles(path, vendor string, filter func(string) bool, fn func(string) bool) {
 	w := fs.Walk(path)
 	for w.Step() {
 		rel := w.Path()[len(path):]
@@ -59,7 +231,7 @@ func RewriteImports(ipath string, rw func(string) string, filter func(string) bo
 		}
 		rel = rel[1:]
 
-		if strings.HasPrefix(rel, ".git") || strings.HasPrefix(rel, "vendor") {
+		if strings.HasPrefix(rel, ".git") || rel == vendor {
 			w.SkipDir()
 			continue
 		}
@@ -71,23 +243,24 @@ func RewriteImports(ipath string, rw func(string) string, filter func(string) bo
 		if !filter(rel) {
 			continue
 		}
-		torewrite <- w.Path()
+		if !fn(w.Path()) {
+			return
+		}
 	}
-	close(torewrite)
-	wg.Wait()
-	return nil
 }
 
-// inspired by godeps rewrite, rewrites import paths with gx vendored names
-func rewriteImportsInFile(fi string, rw func(string) string, rwLock *sync.Mutex) error {
+// inspired by godeps rewrite, rewrites import paths with gx vendored names.
+// The result is written to `out`, which may be `fi` itself, if any import
+// changed. The file replaced is kept in `j`, if set.
+func rewriteImportsInFile(fi, out string, rw func(string) string, rwLock *sync.Mutex, j *journal) (bool, error) {
 	// 1. Rewrite the imports (if we have any)
 	fset := token.NewFileSet()
 	file, err := parser.ParseFile(fset, fi, nil, parser.ParseComments|parser.ImportsOnly)
 	if err != nil {
-		return err
+		return false, err
 	}
 	if len(file.Imports) == 0 {
-		return nil
+		return false, nil
 	}
 
 	oldImportsEnd := fset.Position(file.Imports[len(file.Imports)-1].End()).Offset
@@ -98,7 +271,7 @@ func rewriteImportsInFile(fi string, rw func(string) string, rwLock *sync.Mutex)
 		p, err := strconv.Unquote(imp.Path.Value)
 		if err != nil {
 			rwLock.Unlock()
-			return err
+			return false, err
 		}
 
 		np := rw(p)
@@ -111,7 +284,7 @@ func rewriteImportsInFile(fi string, rw func(string) string, rwLock *sync.Mutex)
 	rwLock.Unlock()
 
 	if !changed {
-		return nil
+		return false, nil
 	}
 
 	buf := bufpool.Get().(*bytes.Buffer)
@@ -123,7 +296,7 @@ func rewriteImportsInFile(fi string, rw func(string) string, rwLock *sync.Mutex)
 
 	buf.Reset()
 	if err = cfg.Fprint(buf, fset, file); err != nil {
-		return err
+		return false, err
 	}
 
 	// 2. Read the imports back in to sort them.
@@ -131,7 +304,7 @@ func rewriteImportsInFile(fi string, rw func(string) string, rwLock *sync.Mutex)
 	fset = token.NewFileSet()
 	file, err = parser.ParseFile(fset, fi, buf, parser.ParseComments|parser.ImportsOnly)
 	if err != nil {
-		return err
+		return false, err
 	}
 
 	ast.SortImports(fset, file)
@@ -140,7 +313,7 @@ func rewriteImportsInFile(fi string, rw func(string) string, rwLock *sync.Mutex)
 
 	buf.Reset()
 	if err = cfg.Fprint(buf, fset, file); err != nil {
-		return err
+		return false, err
 	}
 
 	// 3. Read them back in to find the new end of the imports.
@@ -148,7 +321,7 @@ func rewriteImportsInFile(fi string, rw func(string) string, rwLock *sync.Mutex)
 	fset = token.NewFileSet()
 	file, err = parser.ParseFile(fset, fi, buf, parser.ParseComments|parser.ImportsOnly)
 	if err != nil {
-		return err
+		return false, err
 	}
 
 	newImportsEnd := fset.Position(file.Imports[len(file.Imports)-1].End()).Offset
@@ -156,51 +329,64 @@ func rewriteImportsInFile(fi string, rw func(string) string, rwLock *sync.Mutex)
 	// Write them back to the buffer and truncate.
 	buf.Reset()
 	if err = cfg.Fprint(buf, fset, file); err != nil {
-		return err
+		return false, err
 	}
 	buf.Truncate(newImportsEnd)
 
 	// Finally, build the file.
 
-	tmppath := fi + ".temp"
+	tmppath := out + ".temp"
 	tmp, err := os.Create(tmppath)
 	if err != nil {
-		return err
+		return false, err
 	}
 
 	// Write the imports
 	_, err = buf.WriteTo(tmp)
 	if err != nil {
-		return err
+		return false, err
 	}
 
 	// Copy the rest
 	src, err := os.Open(fi)
 	if err != nil {
-		return err
+		return false, err
 	}
 
 	_, err = src.Seek(int64(oldImportsEnd), io.SeekStart)
 	if err != nil {
 		src.Close()
-		return err
+		return false, err
 	}
 
 	_, err = io.Copy(tmp, src)
 	if err != nil {
 		src.Close()
-		return err
+		return false, err
 	}
 
 	// Ignore any errors, we didn't modify this file.
 	src.Close()
 
-	// Update the file
+	// Update the file, keeping its mode
 	if err = tmp.Close(); err != nil {
-		return err
+		return false, err
+	}
+	st, err := os.Stat(fi)
+	if err != nil {
+		return false, err
+	}
+	if err = os.Chmod(tmppath, st.Mode().Perm()); err != nil {
+		return false, err
 	}
 
-	return os.Rename(tmppath, fi)
+	if j != nil {
+		if err := j.keep(out); err != nil {
+			os.Remove(tmppath)
+			return false, err
+		}
+	}
+	return true, os.Rename(tmppath, out)
 }
 
 func fixCanonicalImports(buf []byte) (bool, error) {
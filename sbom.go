@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"time"
+
+	cli "github.com/urfave/cli"
+	gx "github.com/whyrusleeping/gx/gxutil"
+)
+
+var SbomCommand = cli.Command{
+	Name:  "sbom",
+	Usage: "print a software bill of materials for the current package",
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "format",
+			Usage: "output format, one of 'spdx' or 'cyclonedx'",
+			Value: "spdx",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		root, err := gx.GetPackageRoot()
+		if err != nil {
+			return err
+		}
+
+		pkg, err := LoadPackageFile(filepath.Join(root, gx.PkgFileName))
+		if err != nil {
+			return err
+		}
+
+		deps, err := collectDeps(pkg, filepath.Join(root, vendorDir))
+		if err != nil {
+			return err
+		}
+
+		var hashes []string
+		for h := range deps {
+			hashes = append(hashes, h)
+		}
+		sort.Strings(hashes)
+
+		var doc interface{}
+		switch c.String("format") {
+		case "spdx":
+			doc = spdxDocument(pkg, hashes, deps)
+		case "cyclonedx":
+			doc = cycloneDXDocument(pkg, hashes, deps)
+		default:
+			return fmt.Errorf("unrecognized sbom format: %s", c.String("format"))
+		}
+
+		out, err := json.MarshalIndent(doc, "", "  ")
+		if err != nil {
+			return err
+		}
+
+		_, err = os.Stdout.Write(append(out, '\n'))
+		return err
+	},
+}
+
+var spdxIDChars = regexp.MustCompile(`[^a-zA-Z0-9.-]`)
+
+func sbomLicense(pkg *Package) string {
+	if pkg.License != "" {
+		return pkg.License
+	}
+	return "NOASSERTION"
+}
+
+func sbomDownloadLocation(pkg *Package) string {
+	if pkg.Gx.DvcsRepo != "" {
+		return pkg.Gx.DvcsRepo
+	}
+	if pkg.Gx.DvcsImport == "" {
+		return "NOASSERTION"
+	}
+	return "https://" + pkg.Gx.DvcsImport
+}
+
+func spdxDocument(pkg *Package, hashes []string, deps map[string]*Package) map[string]interface{} {
+	rootID := "SPDXRef-Package-" + spdxIDChars.ReplaceAllString(pkg.Name, "-")
+	packages := []map[string]interface{}{
+		spdxPackage(rootID, pkg),
+	}
+	relationships := []map[string]string{{
+		"spdxElementId":      "SPDXRef-DOCUMENT",
+		"relationshipType":   "DESCRIBES",
+		"relatedSpdxElement": rootID,
+	}}
+
+	for _, h := range hashes {
+		id := "SPDXRef-Package-" + h
+		p := spdxPackage(id, deps[h])
+		p["externalRefs"] = []map[string]string{{
+			"referenceCategory": "OTHER",
+			"referenceType":     "gx",
+			"referenceLocator":  "/ipfs/" + h,
+		}}
+		packages = append(packages, p)
+		relationships = append(relationships, map[string]string{
+			"spdxElementId":      rootID,
+			"relationshipType":   "DEPENDS_ON",
+			"relatedSpdxElement": id,
+		})
+	}
+
+	return map[string]interface{}{
+		"spdxVersion":       "SPDX-2.2",
+		"dataLicense":       "CC0-1.0",
+		"SPDXID":            "SPDXRef-DOCUMENT",
+		"name":              pkg.Name,
+		"documentNamespace": fmt.Sprintf("https://spdx.org/spdxdocs/%s-%s", pkg.Name, pkg.Version),
+		"creationInfo": map[string]interface{}{
+			"created":  time.Now().UTC().Format(time.RFC3339),
+			"creators": []string{"Tool: gx-go"},
+		},
+		"packages":      packages,
+		"relationships": relationships,
+	}
+}
+
+func spdxPackage(id string, pkg *Package) map[string]interface{} {
+	return map[string]interface{}{
+		"SPDXID":           id,
+		"name":             pkg.Name,
+		"versionInfo":      pkg.Version,
+		"downloadLocation": sbomDownloadLocation(pkg),
+		"licenseConcluded": "NOASSERTION",
+		"licenseDeclared":  sbomLicense(pkg),
+		"copyrightText":    "NOASSERTION",
+		"filesAnalyzed":    false,
+	}
+}
+
+func cycloneDXDocument(pkg *Package, hashes []string, deps map[string]*Package) map[string]interface{} {
+	var components []map[string]interface{}
+	var refs []string
+	for _, h := range hashes {
+		comp := cycloneDXComponent(deps[h])
+		comp["bom-ref"] = h
+		comp["properties"] = []map[string]string{{
+			"name":  "gx:hash",
+			"value": h,
+		}}
+		components = append(components, comp)
+		refs = append(refs, h)
+	}
+
+	root := cycloneDXComponent(pkg)
+	root["bom-ref"] = pkg.Name
+
+	return map[string]interface{}{
+		"bomFormat":   "CycloneDX",
+		"specVersion": "1.4",
+		"version":     1,
+		"metadata": map[string]interface{}{
+			"timestamp": time.Now().UTC().Format(time.RFC3339),
+			"tools":     []map[string]string{{"name": "gx-go"}},
+			"component": root,
+		},
+		"components": components,
+		"dependencies": []map[string]interface{}{{
+			"ref":       pkg.Name,
+			"dependsOn": refs,
+		}},
+	}
+}
+
+func cycloneDXComponent(pkg *Package) map[string]interface{} {
+	comp := map[string]interface{}{
+		"type":    "library",
+		"name":    pkg.Name,
+		"version": pkg.Version,
+	}
+
+	if pkg.Gx.DvcsImport != "" {
+		comp["purl"] = fmt.Sprintf("pkg:golang/%s@%s", pkg.Gx.DvcsImport, pkg.Version)
+		comp["externalReferences"] = []map[string]string{{
+			"type": "vcs",
+			"url":  sbomDownloadLocation(pkg),
+		}}
+	}
+
+	if pkg.License != "" {
+		comp["licenses"] = []map[string]interface{}{{
+			"expression": pkg.License,
+		}}
+	}
+
+	return comp
+}
@@ -0,0 +1,401 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	homedir "github.com/mitchellh/go-homedir"
+	cli "github.com/urfave/cli"
+	gx "github.com/whyrusleeping/gx/gxutil"
+)
+
+// Packages are fetched once into a store shared by all projects, where
+// they are kept read-only and unmodified, as published, under their hash.
+// The install directories gx and gx-go use, vendor directories and the
+// global gx/ipfs, are materialized from it with hardlinks, which the
+// post-install rewrite replaces rather than modifies. A package in the
+// store is never fetched again, so projects whose deps are all stored
+// install offline.
+
+const defaultPackageStore = "~/.cache/gx-go/store"
+
+// storeFilesDir is the directory of the store dedup links the files of
+// installed packages to, by content.
+const storeFilesDir = "files"
+
+// packageStore returns the directory of the package store, taken from
+// GX_GO_PACKAGE_STORE, or else the config.
+func packageStore() (string, error) {
+	store := os.Getenv("GX_GO_PACKAGE_STORE")
+	if store == "" {
+		store = config.PackageStore
+	}
+	if store == "" {
+		store = defaultPackageStore
+	}
+	return homedir.Expand(store)
+}
+
+// storeFetch returns the directory of the package `hash` in the store,
+// fetching it first if it isn't there yet.
+func storeFetch(hash string) (string, error) {
+	store, err := packageStore()
+	if err != nil {
+		return "", err
+	}
+
+	dir := filepath.Join(store, hash)
+	var pkg Package
+	if err := gx.FindPackageInDir(&pkg, dir); err == nil {
+		VLog("found %s in the package store", hash)
+		recordPackage(hash, &pkg)
+		return dir, nil
+	}
+
+	if err := os.MkdirAll(store, 0755); err != nil {
+		return "", err
+	}
+	// fetch next to the entry, so it only appears once complete
+	tmp, err := ioutil.TempDir(store, ".fetch-"+hash)
+	if err != nil {
+		return "", err
+	}
+	defer removeStoreEntry(tmp)
+
+	err = withGatewayFallback(hash, tmp, func() error {
+		return withRetries("gx get "+hash, func() error {
+			return gxFetch(hash, tmp)
+		})
+	})
+	if err != nil {
+		return "", err
+	}
+
+	if err := makeReadOnly(tmp); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp, dir); err != nil {
+		// stored concurrently by another process
+		if err := gx.FindPackageInDir(&pkg, dir); err == nil {
+			return dir, nil
+		}
+		return "", err
+	}
+	if err := gx.FindPackageInDir(&pkg, dir); err == nil {
+		recordPackage(hash, &pkg)
+	}
+	return dir, nil
+}
+
+// materialize installs the package `hash` in `dst`, from the store,
+// unless it is there already.
+func materialize(hash, dst string) error {
+	var pkg Package
+	if err := gx.FindPackageInDir(&pkg, dst); err == nil {
+		return nil
+	}
+
+	src, err := storeFetch(hash)
+	if err != nil {
+		return err
+	}
+
+	if err := os.RemoveAll(dst); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+
+	tmp := dst + ".gx-go-materialize"
+	if err := os.RemoveAll(tmp); err != nil {
+		return err
+	}
+	if err := linkTree(src, tmp); err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+	return os.Rename(tmp, dst)
+}
+
+// linkTree recreates the tree `src` in `dst`, with hardlinks to its files
+// (or copies across filesystems). Files must be replaced, not written to,
+// in the copy.
+func linkTree(src, dst string) error {
+	return filepath.Walk(src, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		switch {
+		case fi.IsDir():
+			return os.MkdirAll(target, 0755)
+		case fi.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		case fi.Mode().IsRegular():
+			// across filesystems, copy instead
+			if err := os.Link(p, target); err != nil {
+				return copyFile(p, target)
+			}
+		}
+		return nil
+	})
+}
+
+// materializeDeps installs the dependencies `deps` in the install
+// directory `ipath`, recursively, from the store.
+func materializeDeps(deps []*gx.Dependency, ipath string, done map[string]bool) error {
+	for _, dep := range deps {
+		if done[dep.Hash] {
+			continue
+		}
+		done[dep.Hash] = true
+
+		dst := filepath.Join(ipath, "gx", "ipfs", dep.Hash)
+		if err := materialize(dep.Hash, dst); err != nil {
+			return fmt.Errorf("installing %s (%s): %s", dep.Name, dep.Hash, err)
+		}
+
+		var dpkg Package
+		if err := gx.FindPackageInDir(&dpkg, dst); err != nil {
+			return err
+		}
+		if err := materializeDeps(dpkg.Dependencies, ipath, done); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// makeReadOnly removes the write permissions of everything under `dir`,
+// giving files their canonical mode.
+func makeReadOnly(dir string) error {
+	var dirs []string
+	err := filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		switch {
+		case fi.IsDir():
+			dirs = append(dirs, p)
+		case fi.Mode().IsRegular():
+			return os.Chmod(p, canonicalMode(fi))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// deepest first, while their parents are still writable
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := os.Chmod(dirs[i], 0555); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeStoreEntry removes the read-only directory `dir` from the store.
+func removeStoreEntry(dir string) error {
+	filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err == nil && fi.IsDir() {
+			os.Chmod(p, 0755)
+		}
+		return nil
+	})
+	return os.RemoveAll(dir)
+}
+
+var StoreCommand = cli.Command{
+	Name:  "store",
+	Usage: "manage the store packages are installed from",
+	Description: `The package store holds every package fetched by gx-go, read-only and
+as published, so that each is only downloaded once. Vendor directories and
+the global gx/ipfs are filled from it with hardlinks when installing, and
+rewrites and link read the packages they need the metadata of there. Its
+files directory holds the files dedup links installed packages to.
+
+It is ~/.cache/gx-go/store unless set with GX_GO_PACKAGE_STORE or the
+packageStore field of the config. It should be on the same filesystem as
+GOPATH and the packages for hardlinks to work, otherwise files are copied.`,
+	Subcommands: []cli.Command{
+		storePathCommand,
+		storeFetchCommand,
+		storeLsCommand,
+		storeRmCommand,
+	},
+}
+
+var storePathCommand = cli.Command{
+	Name:  "path",
+	Usage: "print the directory of the store",
+	Action: func(c *cli.Context) error {
+		store, err := packageStore()
+		if err != nil {
+			return err
+		}
+		if jsonOutput {
+			return printJSON(map[string]string{"path": store})
+		}
+		fmt.Println(store)
+		return nil
+	},
+}
+
+var storeFetchCommand = cli.Command{
+	Name:      "fetch",
+	Usage:     "fetch packages into the store, to install them offline later",
+	ArgsUsage: "[hash]...",
+	Description: `fetch stores the given packages, or without arguments every dependency
+of the current package, recursively.`,
+	Action: func(c *cli.Context) error {
+		hashes := []string(c.Args())
+		if len(hashes) == 0 {
+			root, err := gx.GetPackageRoot()
+			if err != nil {
+				return err
+			}
+			pkg, err := LoadPackageFile(filepath.Join(root, gx.PkgFileName))
+			if err != nil {
+				return err
+			}
+			n, err := storeDeps(pkg, make(map[string]bool))
+			if err != nil {
+				return err
+			}
+			Log("stored the %d dependencies of %s", n, pkg.Name)
+			return nil
+		}
+
+		for _, hash := range hashes {
+			if !isHash(hash) {
+				return fmt.Errorf("invalid hash %q", hash)
+			}
+			dir, err := storeFetch(hash)
+			if err != nil {
+				return err
+			}
+			VLog("stored %s in %s", hash, dir)
+		}
+		return nil
+	},
+}
+
+// storeDeps fetches the dependencies of `pkg` into the store, recursively,
+// and returns their number.
+func storeDeps(pkg *Package, done map[string]bool) (int, error) {
+	n := 0
+	for _, dep := range pkg.Dependencies {
+		if done[dep.Hash] {
+			continue
+		}
+		done[dep.Hash] = true
+
+		dir, err := storeFetch(dep.Hash)
+		if err != nil {
+			return n, fmt.Errorf("storing %s (%s): %s", dep.Name, dep.Hash, err)
+		}
+		n++
+
+		var dpkg Package
+		if err := gx.FindPackageInDir(&dpkg, dir); err != nil {
+			return n, err
+		}
+		dn, err := storeDeps(&dpkg, done)
+		n += dn
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+var storeLsCommand = cli.Command{
+	Name:  "ls",
+	Usage: "list the packages in the store",
+	Action: func(c *cli.Context) error {
+		store, err := packageStore()
+		if err != nil {
+			return err
+		}
+
+		entries, err := ioutil.ReadDir(store)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		type storedPackage struct {
+			Hash    string `json:"hash"`
+			Name    string `json:"name"`
+			Version string `json:"version"`
+		}
+		var pkgs []storedPackage
+		for _, e := range entries {
+			if !e.IsDir() || !isHash(e.Name()) {
+				continue
+			}
+			var pkg Package
+			if err := gx.FindPackageInDir(&pkg, filepath.Join(store, e.Name())); err != nil {
+				Warn("%s: %s", e.Name(), err)
+				continue
+			}
+			pkgs = append(pkgs, storedPackage{e.Name(), pkg.Name, pkg.Version})
+		}
+		sort.Slice(pkgs, func(i, j int) bool {
+			if pkgs[i].Name != pkgs[j].Name {
+				return pkgs[i].Name < pkgs[j].Name
+			}
+			return pkgs[i].Version < pkgs[j].Version
+		})
+
+		if jsonOutput {
+			return printJSON(pkgs)
+		}
+		for _, p := range pkgs {
+			fmt.Printf("%s %s %s\n", p.Hash, p.Name, p.Version)
+		}
+		return nil
+	},
+}
+
+var storeRmCommand = cli.Command{
+	Name:      "rm",
+	Usage:     "remove packages from the store",
+	ArgsUsage: "<hash>...",
+	Description: `rm removes the given packages from the store. Installed copies are left
+as they are, and the packages are fetched again the next time they are
+installed.`,
+	Action: func(c *cli.Context) error {
+		if !c.Args().Present() {
+			return fmt.Errorf("must specify the hashes of the packages to remove")
+		}
+
+		store, err := packageStore()
+		if err != nil {
+			return err
+		}
+		for _, hash := range c.Args() {
+			if !isHash(hash) {
+				return fmt.Errorf("invalid hash %q", hash)
+			}
+			if err := removeStoreEntry(filepath.Join(store, hash)); err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+}
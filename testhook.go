@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// testValueFlags are the go test flags that take a value, which may be given
+// as the next argument.
+var testValueFlags = map[string]bool{
+	"asmflags": true, "bench": true, "benchtime": true, "blockprofile": true,
+	"blockprofilerate": true, "buildmode": true, "compiler": true,
+	"count": true, "covermode": true, "coverpkg": true, "coverprofile": true,
+	"cpu": true, "cpuprofile": true, "exec": true, "fuzz": true,
+	"fuzzminimizetime": true, "fuzztime": true, "gccgoflags": true,
+	"gcflags": true, "installsuffix": true, "ldflags": true, "list": true,
+	"memprofile": true, "memprofilerate": true, "mod": true, "modfile": true,
+	"mutexprofile": true, "mutexprofilefraction": true, "o": true,
+	"outputdir": true, "overlay": true, "p": true, "parallel": true,
+	"pgo": true, "pkgdir": true, "run": true, "shuffle": true, "skip": true,
+	"tags": true, "timeout": true, "toolexec": true, "trace": true,
+	"vet": true,
+}
+
+// testPathFlags are the go test flags naming files or directories. The tests
+// run in a copy of the package, so relative paths given to them are made
+// absolute to still refer to the working tree.
+var testPathFlags = map[string]bool{
+	"blockprofile": true, "coverprofile": true, "cpuprofile": true,
+	"memprofile": true, "modfile": true, "mutexprofile": true, "o": true,
+	"outputdir": true, "overlay": true, "trace": true,
+}
+
+// testArgs are the arguments of a go test run, split into flags and the
+// package patterns to test.
+type testArgs struct {
+	flags []string
+	pkgs  []string
+	// arguments following -args, passed as is to the test binaries
+	binArgs []string
+
+	// coverprofile is the absolute path of the coverage profile requested,
+	// if any
+	coverprofile string
+}
+
+// parseTestArgs parses the arguments given to the test hook, which are
+// those of go test.
+func parseTestArgs(args []string) (*testArgs, error) {
+	ta := new(testArgs)
+	for n := 0; n < len(args); n++ {
+		a := args[n]
+		if a == "-args" || a == "--args" {
+			ta.binArgs = args[n+1:]
+			break
+		}
+		if !strings.HasPrefix(a, "-") || a == "-" {
+			ta.pkgs = append(ta.pkgs, a)
+			continue
+		}
+
+		name := strings.TrimLeft(a, "-")
+		var val string
+		hasVal := false
+		if eq := strings.Index(name, "="); eq >= 0 {
+			name, val, hasVal = name[:eq], name[eq+1:], true
+		} else if testValueFlags[name] {
+			if n+1 >= len(args) {
+				return nil, fmt.Errorf("flag -%s needs a value", name)
+			}
+			n++
+			val, hasVal = args[n], true
+		}
+
+		if !hasVal {
+			ta.flags = append(ta.flags, "-"+name)
+			continue
+		}
+
+		if testPathFlags[name] && val != "" && !filepath.IsAbs(val) {
+			val = filepath.Join(cwd, val)
+		}
+		if name == "coverprofile" {
+			ta.coverprofile = val
+		}
+		ta.flags = append(ta.flags, "-"+name+"="+val)
+	}
+	return ta, nil
+}
+
+// args returns the go test arguments to test `pkgs`, writing the coverage
+// profile to `coverprofile`.
+func (ta *testArgs) args(pkgs []string, coverprofile string) []string {
+	args := []string{"test"}
+	for _, f := range ta.flags {
+		if strings.HasPrefix(f, "-coverprofile=") {
+			f = "-coverprofile=" + coverprofile
+		}
+		args = append(args, f)
+	}
+	args = append(args, pkgs...)
+	if ta.binArgs != nil {
+		args = append(args, "-args")
+		args = append(args, ta.binArgs...)
+	}
+	return args
+}
+
+// runTests runs go test with `args` on the copy of the current package made
+// by pre-test. Only the output of go test goes to stdout, so that -json
+// output can be consumed as is.
+func runTests(args []string) error {
+	dir, gopath, err := testDir()
+	if err != nil {
+		return err
+	}
+	env := withEnv(os.Environ(), "GOPATH", gopath)
+
+	ta, err := parseTestArgs(args)
+	if err != nil {
+		return err
+	}
+
+	if ta.coverprofile != "" {
+		merge, err := needCoverMerge()
+		if err != nil {
+			return err
+		}
+		if merge {
+			pkgs, err := listTestPackages(dir, env, ta.pkgs)
+			if err != nil {
+				return err
+			}
+			if len(pkgs) > 1 {
+				return runCoverTests(dir, env, ta, pkgs)
+			}
+		}
+	}
+
+	return goTest(dir, env, ta.args(ta.pkgs, ta.coverprofile))
+}
+
+func goTest(dir string, env []string, args []string) error {
+	cmd := exec.Command("go", args...)
+	cmd.Dir = dir
+	cmd.Env = env
+	cmd.Stderr = os.Stderr
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	return cmd.Run()
+}
+
+// needCoverMerge returns whether coverage profiles of multiple packages
+// have to be merged by us, as go test only writes them itself since go1.10.
+func needCoverMerge() (bool, error) {
+	v, err := installedGoVersion()
+	if err != nil {
+		return false, err
+	}
+	if v == "devel" {
+		return false, nil
+	}
+	return goVersionMatches(v, "<1.10")
+}
+
+// listTestPackages returns the import paths of the packages matched by
+// `patterns`.
+func listTestPackages(dir string, env []string, patterns []string) ([]string, error) {
+	cmd := exec.Command("go", append([]string{"list"}, patterns...)...)
+	cmd.Dir = dir
+	cmd.Env = env
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("listing packages to test: %s", err)
+	}
+	return strings.Fields(string(out)), nil
+}
+
+// runCoverTests tests each of `pkgs` on its own and merges their coverage
+// profiles into the one requested. Like go test, it goes on testing after a
+// package fails.
+func runCoverTests(dir string, env []string, ta *testArgs, pkgs []string) error {
+	tmpdir, err := ioutil.TempDir("", "gx-go-cover")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpdir)
+
+	var profiles []string
+	var failed int
+	for n, pkg := range pkgs {
+		p := filepath.Join(tmpdir, fmt.Sprintf("%d.out", n))
+		if err := goTest(dir, env, ta.args([]string{pkg}, p)); err != nil {
+			failed++
+		}
+		if _, err := os.Stat(p); err == nil {
+			profiles = append(profiles, p)
+		}
+	}
+
+	if err := mergeCoverProfiles(ta.coverprofile, profiles); err != nil {
+		return fmt.Errorf("merging coverage profiles: %s", err)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d packages failed their tests", failed, len(pkgs))
+	}
+	return nil
+}
+
+// mergeCoverProfiles writes the coverage profiles `profiles` into a single
+// one at `out`. Blocks found in more than one profile, as with -coverpkg,
+// have their counts summed, or or'ed in set mode.
+func mergeCoverProfiles(out string, profiles []string) error {
+	mode := ""
+	var blocks []string
+	counts := make(map[string]int)
+	for _, p := range profiles {
+		fi, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+
+		scan := bufio.NewScanner(fi)
+		for scan.Scan() {
+			line := scan.Text()
+			if strings.HasPrefix(line, "mode: ") {
+				mode = strings.TrimPrefix(line, "mode: ")
+				continue
+			}
+
+			sp := strings.LastIndex(line, " ")
+			if sp < 0 {
+				continue
+			}
+			var count int
+			if _, err := fmt.Sscan(line[sp+1:], &count); err != nil {
+				fi.Close()
+				return fmt.Errorf("invalid line in %s: %q", p, line)
+			}
+
+			block := line[:sp]
+			prev, ok := counts[block]
+			if !ok {
+				blocks = append(blocks, block)
+			}
+			if mode == "set" {
+				if count > 0 {
+					counts[block] = 1
+				} else {
+					counts[block] = prev
+				}
+			} else {
+				counts[block] = prev + count
+			}
+		}
+		fi.Close()
+		if err := scan.Err(); err != nil {
+			return err
+		}
+	}
+
+	if mode == "" {
+		mode = "set"
+	}
+
+	f, err := os.Create(out)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	fmt.Fprintf(w, "mode: %s\n", mode)
+	for _, b := range blocks {
+		fmt.Fprintf(w, "%s %d\n", b, counts[b])
+	}
+	return w.Flush()
+}
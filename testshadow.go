@@ -0,0 +1,242 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	homedir "github.com/mitchellh/go-homedir"
+	gx "github.com/whyrusleeping/gx/gxutil"
+)
+
+// The test hooks never touch the working tree: pre-test makes a copy of the
+// package with its imports rewritten in a GOPATH of its own (the shadow),
+// test runs the tests there and post-test deletes it. An interrupted run
+// leaves at most a stale shadow behind, replaced by the next one.
+//
+// The shadow is a fresh temporary directory, recorded for the hooks that
+// follow in a file of testShadowDir named after the hash of the package
+// root. Packages outside GOPATH without a dvcsimport have no import path to
+// be copied under, and are rewritten in place for the tests, then back.
+
+// testShadowDir records the shadow GOPATH of each package being tested.
+const testShadowDir = "~/.cache/gx-go/test"
+
+// testShadowRecord returns the file recording the shadow GOPATH of the
+// package at `root`.
+func testShadowRecord(root string) (string, error) {
+	dir, err := homedir.Expand(testShadowDir)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256([]byte(root))
+	return filepath.Join(dir, hex.EncodeToString(sum[:16])), nil
+}
+
+// testShadow returns the GOPATH the tests of the package at `root` are
+// run in, or an empty string if pre-test made none.
+func testShadow(root string) (string, error) {
+	rec, err := testShadowRecord(root)
+	if err != nil {
+		return "", err
+	}
+	data, err := ioutil.ReadFile(rec)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", err
+	}
+	return string(data), nil
+}
+
+// removeTestShadow deletes the shadow GOPATH of the package at `root`, if
+// any, and its record.
+func removeTestShadow(root string) error {
+	shadow, err := testShadow(root)
+	if err != nil || shadow == "" {
+		return err
+	}
+	if err := os.RemoveAll(shadow); err != nil {
+		return err
+	}
+	rec, err := testShadowRecord(root)
+	if err != nil {
+		return err
+	}
+	return os.Remove(rec)
+}
+
+// testImportPath returns the import path the package at `root` is copied
+// under in its shadow, or an empty string if it has none.
+func testImportPath(root string, pkg *Package) string {
+	if pkg.Gx.DvcsImport != "" {
+		return pkg.Gx.DvcsImport
+	}
+	imp, err := packagesGoImport(root)
+	if err != nil {
+		return ""
+	}
+	return imp
+}
+
+// preTest creates the shadow of the current package, or rewrites it in
+// place if it has no import path.
+func preTest() error {
+	root, err := gx.GetPackageRoot()
+	if err != nil {
+		return err
+	}
+
+	pkg, err := LoadPackageFile(filepath.Join(root, gx.PkgFileName))
+	if err != nil {
+		return err
+	}
+
+	if err := removeTestShadow(root); err != nil {
+		return err
+	}
+
+	op, done := startRewrites()
+	defer done()
+
+	imp := testImportPath(root, pkg)
+	if imp == "" {
+		VLog("no dvcsimport set for %s and not in GOPATH, rewriting it in place for testing", pkg.Name)
+		return rewritePackage(op, root, false)
+	}
+
+	shadow, err := ioutil.TempDir("", "gx-go-test")
+	if err != nil {
+		return err
+	}
+	rec, err := testShadowRecord(root)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(rec), 0755); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(rec, []byte(shadow), 0644); err != nil {
+		os.RemoveAll(shadow)
+		return err
+	}
+
+	dst := filepath.Join(shadow, "src", filepath.FromSlash(imp))
+	VLog("copying %s to %s", root, dst)
+	if err := copyPackageSource(root, dst); err != nil {
+		return fmt.Errorf("copying the package for testing: %s", err)
+	}
+
+	mapping := make(map[string]string)
+	err = buildPackageRewriteMapping(pkg, root, filepath.Join(root, vendorDir), mapping, false)
+	if err != nil {
+		return fmt.Errorf("build of rewrite mapping failed:\n%s", err)
+	}
+
+	return doRewrite(op, pkg, dst, mapping)
+}
+
+// copyPackageSource copies the package at `root` to `dst`, leaving out its
+// vcs metadata. Installed dependencies are linked rather than copied, as
+// they are not rewritten.
+func copyPackageSource(root, dst string) error {
+	return filepath.Walk(root, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		switch {
+		case rel == ".git" || rel == ".hg":
+			return filepath.SkipDir
+		case rel == vendorRoot:
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			if err := os.Symlink(p, target); err != nil {
+				return err
+			}
+			return filepath.SkipDir
+		case fi.IsDir():
+			return os.MkdirAll(target, 0755)
+		case !fi.Mode().IsRegular():
+			return nil
+		default:
+			return copyFile(p, target)
+		}
+	})
+}
+
+// testDir returns the directory to run the tests of the current package in,
+// and the GOPATH to run them with. Without a shadow, that's the working
+// tree as is.
+func testDir() (string, string, error) {
+	root, err := gx.GetPackageRoot()
+	if err != nil {
+		return "", "", err
+	}
+
+	pkg, err := LoadPackageFile(filepath.Join(root, gx.PkgFileName))
+	if err != nil {
+		return "", "", err
+	}
+
+	imp := testImportPath(root, pkg)
+	if imp == "" {
+		// rewritten in place by pre-test
+		return cwd, os.Getenv("GOPATH"), nil
+	}
+
+	shadow, err := testShadow(root)
+	if err != nil {
+		return "", "", err
+	}
+	dst := filepath.Join(shadow, "src", filepath.FromSlash(imp))
+	if _, err := os.Stat(dst); shadow == "" || err != nil {
+		Warn("no test copy of %s found (pre-test not run?), testing the working tree", pkg.Name)
+		return cwd, os.Getenv("GOPATH"), nil
+	}
+
+	gopaths, err := getGoPaths()
+	if err != nil {
+		return "", "", err
+	}
+
+	rel, err := filepath.Rel(root, cwd)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		rel = "."
+	}
+
+	gopath := append([]string{shadow}, gopaths...)
+	return filepath.Join(dst, rel), strings.Join(gopath, string(filepath.ListSeparator)), nil
+}
+
+// postTest deletes the shadow of the current package, or rewrites it back
+// if pre-test rewrote it in place.
+func postTest() error {
+	root, err := gx.GetPackageRoot()
+	if err != nil {
+		return err
+	}
+
+	pkg, err := LoadPackageFile(filepath.Join(root, gx.PkgFileName))
+	if err != nil {
+		return err
+	}
+	if testImportPath(root, pkg) == "" {
+		op, done := startRewrites()
+		defer done()
+		return rewritePackage(op, root, true)
+	}
+	return removeTestShadow(root)
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	cli "github.com/urfave/cli"
+	gx "github.com/whyrusleeping/gx/gxutil"
+)
+
+var TreeCommand = cli.Command{
+	Name:  "tree",
+	Usage: "print the transitive dependency tree of the current package",
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "collapse",
+			Usage: "only expand each package the first time it is seen",
+		},
+		cli.IntFlag{
+			Name:  "depth",
+			Usage: "limit the depth of the printed tree (0 means no limit)",
+		},
+		cli.BoolFlag{
+			Name:  "conflicts",
+			Usage: "highlight packages imported at more than one version",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		root, err := gx.GetPackageRoot()
+		if err != nil {
+			return err
+		}
+
+		pkg, err := LoadPackageFile(filepath.Join(root, gx.PkgFileName))
+		if err != nil {
+			return err
+		}
+
+		t := &treePrinter{
+			pkgdir:   filepath.Join(root, vendorDir),
+			collapse: c.Bool("collapse"),
+			maxDepth: c.Int("depth"),
+			pkgs:     make(map[string]*Package),
+			seen:     make(map[string]bool),
+		}
+
+		var conflicts map[string]bool
+		if c.Bool("conflicts") {
+			conflicts, err = t.findConflicts(pkg)
+			if err != nil {
+				return err
+			}
+		}
+		t.conflicts = conflicts
+
+		deps, err := t.build(pkg, 1)
+		if err != nil {
+			return err
+		}
+
+		if jsonOutput {
+			return printJSON(&treeNode{Name: pkg.Name, Version: pkg.Version, Deps: deps})
+		}
+
+		fmt.Printf("%s %s\n", pkg.Name, pkg.Version)
+		printTree(deps, 1)
+		return nil
+	},
+}
+
+// treeNode is a package of the dependency tree, as printed with --json.
+type treeNode struct {
+	Name     string `json:"name"`
+	Version  string `json:"version"`
+	Hash     string `json:"hash,omitempty"`
+	Conflict bool   `json:"conflict,omitempty"`
+
+	// Collapsed is set on the packages seen before with --collapse, whose
+	// dependencies are left out.
+	Collapsed bool        `json:"collapsed,omitempty"`
+	Deps      []*treeNode `json:"deps,omitempty"`
+}
+
+func printTree(nodes []*treeNode, depth int) {
+	for _, n := range nodes {
+		line := fmt.Sprintf("%s%s %s %s", strings.Repeat("  ", depth), n.Name, n.Version, n.Hash)
+		if n.Conflict {
+			line += " [CONFLICT]"
+		}
+		if n.Collapsed {
+			line += " (*)"
+		}
+		fmt.Println(line)
+		printTree(n.Deps, depth+1)
+	}
+}
+
+type treePrinter struct {
+	pkgdir    string
+	collapse  bool
+	maxDepth  int
+	conflicts map[string]bool
+
+	pkgs map[string]*Package
+	seen map[string]bool
+}
+
+func (t *treePrinter) load(dep *gx.Dependency) (*Package, error) {
+	if pkg, ok := t.pkgs[dep.Hash]; ok {
+		return pkg, nil
+	}
+
+	dir, err := findDepDir(dep.Hash, t.pkgdir)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", dep.Name, err)
+	}
+
+	var pkg Package
+	if err := gx.FindPackageInDir(&pkg, dir); err != nil {
+		return nil, err
+	}
+
+	t.pkgs[dep.Hash] = &pkg
+	return &pkg, nil
+}
+
+func (t *treePrinter) build(pkg *Package, depth int) ([]*treeNode, error) {
+	if t.maxDepth > 0 && depth > t.maxDepth {
+		return nil, nil
+	}
+
+	var nodes []*treeNode
+	for _, dep := range pkg.Dependencies {
+		cpkg, err := t.load(dep)
+		if err != nil {
+			return nil, err
+		}
+
+		n := &treeNode{
+			Name:     dep.Name,
+			Version:  dep.Version,
+			Hash:     dep.Hash,
+			Conflict: t.conflicts[treeKey(cpkg)],
+		}
+		nodes = append(nodes, n)
+
+		if t.collapse && t.seen[dep.Hash] {
+			n.Collapsed = true
+			continue
+		}
+		t.seen[dep.Hash] = true
+
+		if n.Deps, err = t.build(cpkg, depth+1); err != nil {
+			return nil, err
+		}
+	}
+	return nodes, nil
+}
+
+// findConflicts returns the set of packages (keyed by dvcs import, or name
+// if none is set) that appear under more than one hash in the tree.
+func (t *treePrinter) findConflicts(pkg *Package) (map[string]bool, error) {
+	versions := make(map[string]map[string]bool)
+	done := make(map[string]bool)
+
+	var walk func(pkg *Package) error
+	walk = func(pkg *Package) error {
+		for _, dep := range pkg.Dependencies {
+			if done[dep.Hash] {
+				continue
+			}
+			done[dep.Hash] = true
+
+			cpkg, err := t.load(dep)
+			if err != nil {
+				return err
+			}
+
+			k := treeKey(cpkg)
+			if versions[k] == nil {
+				versions[k] = make(map[string]bool)
+			}
+			versions[k][dep.Hash] = true
+
+			if err := walk(cpkg); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if err := walk(pkg); err != nil {
+		return nil, err
+	}
+
+	out := make(map[string]bool)
+	for k, hashes := range versions {
+		if len(hashes) > 1 {
+			out[k] = true
+		}
+	}
+	return out, nil
+}
+
+func treeKey(pkg *Package) string {
+	if pkg.Gx.DvcsImport != "" {
+		return pkg.Gx.DvcsImport
+	}
+	return pkg.Name
+}
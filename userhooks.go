@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+
+	cli "github.com/urfave/cli"
+	gx "github.com/whyrusleeping/gx/gxutil"
+)
+
+// hookEvent is the description of a hook event user hooks get on stdin.
+type hookEvent struct {
+	Event string   `json:"event"`
+	Args  []string `json:"args"`
+
+	// PackageRoot and Package are the root and package.json of the
+	// package the hook runs for, if found.
+	PackageRoot string   `json:"packageRoot,omitempty"`
+	Package     *Package `json:"package,omitempty"`
+}
+
+// withUserHooks makes the hook `cmd` run the user hooks configured for its
+// event once it succeeded.
+func withUserHooks(cmd cli.Command) cli.Command {
+	action := cmd.Action.(func(*cli.Context) error)
+	cmd.Action = func(c *cli.Context) error {
+		if err := action(c); err != nil {
+			return err
+		}
+		return runUserHooks(cmd.Name, c.Args())
+	}
+	return cmd
+}
+
+// runUserHooks runs the commands configured for `event` in the hooks of the
+// config, in order, with the event as json on their stdin. Their output goes
+// to stderr, as the stdout of some hooks is read by gx.
+func runUserHooks(event string, args []string) error {
+	cmds := config.Hooks[event]
+	if len(cmds) == 0 {
+		return nil
+	}
+
+	ev := hookEvent{Event: event, Args: args}
+	if ev.Args == nil {
+		ev.Args = []string{}
+	}
+	if root, err := gx.GetPackageRoot(); err == nil {
+		if pkg, err := LoadPackageFile(filepath.Join(root, gx.PkgFileName)); err == nil {
+			ev.PackageRoot = root
+			ev.Package = pkg
+		}
+	}
+
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+
+	for _, hc := range cmds {
+		VLog("running %s hook: %s", event, hc)
+
+		var cmd *exec.Cmd
+		if runtime.GOOS == "windows" {
+			cmd = exec.Command("cmd", "/C", hc)
+		} else {
+			cmd = exec.Command("sh", "-c", hc)
+		}
+		cmd.Env = withEnv(os.Environ(), "GX_GO_HOOK", event)
+		cmd.Stdin = bytes.NewReader(data)
+		cmd.Stdout = os.Stderr
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("%s hook %q failed: %s", event, hc, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	cli "github.com/urfave/cli"
+	gx "github.com/whyrusleeping/gx/gxutil"
+)
+
+var VerifyCommand = cli.Command{
+	Name:  "verify",
+	Usage: "check that the dependency hashes of the package are valid",
+	Description: `verify checks that every dependency hash in package.json, in the lock
+file if any, and in the package.json of each installed dependency parses
+as a valid cid, to catch truncated or corrupted hashes before fetching them
+fails in confusing ways.
+
+The packages installed in the vendor directory stripped by minimal
+vendoring are also checked against the published packages, fetched into the
+store: every file they lack must be recorded in their .gx/minimal.json with
+its sha256.`,
+	Action: func(c *cli.Context) error {
+		root, err := gx.GetPackageRoot()
+		if err != nil {
+			return err
+		}
+
+		var pkg Package
+		if err := gx.LoadPackageFile(&pkg, filepath.Join(root, gx.PkgFileName)); err != nil {
+			return err
+		}
+
+		bad, checked := verifyDepHashes(&pkg, filepath.Join(root, vendorDir), make(map[string]bool))
+
+		var lck gx.LockFile
+		err = gx.LoadLockFile(&lck, filepath.Join(root, gx.LckFileName))
+		switch {
+		case err == nil:
+			bad = append(bad, invalidLockHashes(&lck)...)
+		case !os.IsNotExist(err):
+			return err
+		}
+
+		stripped, err := verifyStrippedDeps(filepath.Join(root, vendorDir))
+		if err != nil {
+			return err
+		}
+		bad = append(bad, stripped...)
+
+		if len(bad) > 0 {
+			for _, b := range bad {
+				Error("%s", b)
+			}
+			return fmt.Errorf("%d problems found", len(bad))
+		}
+		Log("the hashes of %d dependencies are valid", checked)
+		return nil
+	},
+}
+
+// verifyDepHashes checks the dependency hashes of `pkg` and, through the
+// ones installed in `pkgdir` or globally, of its dependencies. It returns
+// the invalid ones and the number checked.
+func verifyDepHashes(pkg *Package, pkgdir string, done map[string]bool) ([]string, int) {
+	bad := invalidDepHashes(pkg)
+	checked := len(pkg.Dependencies)
+	for _, dep := range pkg.Dependencies {
+		if done[dep.Hash] || !isHash(dep.Hash) {
+			continue
+		}
+		done[dep.Hash] = true
+
+		var dpkg Package
+		if err := gx.FindPackageInDir(&dpkg, hashDir(pkgdir, dep.Hash)); err != nil {
+			if err := gx.FindPackageInDir(&dpkg, globalPkgDir(dep.Hash)); err != nil {
+				VLog("%s (%s) is not installed, not checking its dependencies", dep.Name, dep.Hash)
+				continue
+			}
+		}
+
+		dbad, dchecked := verifyDepHashes(&dpkg, pkgdir, done)
+		bad = append(bad, dbad...)
+		checked += dchecked
+	}
+	return bad, checked
+}
+
+// verifyStrippedDeps checks the stripped packages installed in `vdir`
+// against the published ones.
+func verifyStrippedDeps(vdir string) ([]string, error) {
+	entries, err := ioutil.ReadDir(vdir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var bad []string
+	for _, e := range entries {
+		if !e.IsDir() || !isHash(e.Name()) {
+			continue
+		}
+		b, err := verifyStripped(filepath.Join(vdir, e.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("checking %s: %s", e.Name(), err)
+		}
+		bad = append(bad, b...)
+	}
+	return bad, nil
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	cli "github.com/urfave/cli"
+	gx "github.com/whyrusleeping/gx/gxutil"
+)
+
+const workspaceFileName = "gx-workspace.json"
+
+// Workspace is a set of related packages that are updated together.
+// Repos are dvcs import paths, relative to GOPATH/src.
+type Workspace struct {
+	Repos []string `json:"repos"`
+}
+
+type workspaceRepo struct {
+	dir string
+	pkg *Package
+}
+
+var WorkspaceCommand = cli.Command{
+	Name:  "workspace",
+	Usage: "manage a set of related packages",
+	Description: `workspace manages the set of repos listed in gx-workspace.json (in the
+current directory) and bubbles dependency updates through all of them
+in dependency order.`,
+	Subcommands: []cli.Command{
+		workspaceAddCommand,
+		workspaceOrderCommand,
+		workspaceUpdateCommand,
+	},
+}
+
+var workspaceAddCommand = cli.Command{
+	Name:      "add",
+	Usage:     "add repos to the workspace",
+	ArgsUsage: "[dvcs import...]",
+	Action: func(c *cli.Context) error {
+		ws, err := loadWorkspace()
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		sort.Strings(ws.Repos)
+		for _, r := range c.Args() {
+			if !contains(ws.Repos, r) {
+				ws.Repos = append(ws.Repos, r)
+				sort.Strings(ws.Repos)
+			}
+		}
+
+		return saveWorkspace(ws)
+	},
+}
+
+var workspaceOrderCommand = cli.Command{
+	Name:  "order",
+	Usage: "print the workspace repos in dependency order",
+	Action: func(c *cli.Context) error {
+		ws, err := loadWorkspace()
+		if err != nil {
+			return err
+		}
+
+		repos, err := ws.load()
+		if err != nil {
+			return err
+		}
+
+		order, err := workspaceOrder(repos)
+		if err != nil {
+			return err
+		}
+
+		if jsonOutput {
+			var out []map[string]string
+			for _, r := range order {
+				out = append(out, map[string]string{"name": r.pkg.Name, "dir": r.dir})
+			}
+			return printJSON(out)
+		}
+
+		for _, r := range order {
+			fmt.Printf("%s\t%s\n", r.pkg.Name, r.dir)
+		}
+		return nil
+	},
+}
+
+var workspaceUpdateCommand = cli.Command{
+	Name:      "update",
+	Usage:     "update a dependency in every workspace repo that uses it",
+	ArgsUsage: "[package name] [new hash]",
+	Description: `update visits the workspace repos in dependency order. Each repo that
+depends on the updated package (or on a repo that was re-released
+because of it) gets the new hash with 'gx update', is tested with
+'gx test' and released with 'gx release', and its new hash is then
+rolled into the repos depending on it.`,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "release",
+			Usage: "release severity passed to 'gx release'",
+			Value: "patch",
+		},
+		cli.BoolFlag{
+			Name:  "skip-tests",
+			Usage: "do not run 'gx test' before releasing",
+		},
+		cli.BoolFlag{
+			Name:  "dry-run",
+			Usage: "print out the repos that would be updated",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		if len(c.Args()) < 2 {
+			return fmt.Errorf("must specify a package name and its new hash")
+		}
+
+		ws, err := loadWorkspace()
+		if err != nil {
+			return err
+		}
+
+		repos, err := ws.load()
+		if err != nil {
+			return err
+		}
+
+		order, err := workspaceOrder(repos)
+		if err != nil {
+			return err
+		}
+
+		updates := map[string]string{c.Args()[0]: c.Args()[1]}
+		released := []*workspaceRelease{}
+		for _, r := range order {
+			var todo []*gx.Dependency
+			for _, dep := range r.pkg.Dependencies {
+				if h, ok := updates[dep.Name]; ok && h != dep.Hash {
+					todo = append(todo, dep)
+				}
+			}
+
+			if len(todo) == 0 {
+				continue
+			}
+
+			rel := &workspaceRelease{Repo: r.pkg.Name}
+			for _, dep := range todo {
+				rel.Updates = append(rel.Updates, workspaceUpdate{Dependency: dep.Name, From: dep.Hash, To: updates[dep.Name]})
+			}
+			released = append(released, rel)
+
+			if c.Bool("dry-run") {
+				if !jsonOutput {
+					for _, dep := range todo {
+						fmt.Printf("%s: %s %s -> %s\n", r.pkg.Name, dep.Name, dep.Hash, updates[dep.Name])
+					}
+				}
+				updates[r.pkg.Name] = "<new>"
+				continue
+			}
+
+			for _, dep := range todo {
+				Log("updating %s in %s", dep.Name, r.pkg.Name)
+				if err := runIn(r.dir, "gx", "update", dep.Name, updates[dep.Name]); err != nil {
+					return fmt.Errorf("updating %s in %s: %s", dep.Name, r.pkg.Name, err)
+				}
+			}
+
+			if !c.Bool("skip-tests") {
+				Log("testing %s", r.pkg.Name)
+				if err := runIn(r.dir, "gx", "test", "./..."); err != nil {
+					return fmt.Errorf("tests failed in %s: %s", r.pkg.Name, err)
+				}
+			}
+
+			Log("releasing %s", r.pkg.Name)
+			if err := runIn(r.dir, "gx", "release", c.String("release")); err != nil {
+				return fmt.Errorf("releasing %s: %s", r.pkg.Name, err)
+			}
+
+			hash, err := lastPublished(r.dir)
+			if err != nil {
+				return err
+			}
+			Log("released %s as %s", r.pkg.Name, hash)
+			updates[r.pkg.Name] = hash
+			rel.Hash = hash
+		}
+
+		if jsonOutput {
+			return printJSON(released)
+		}
+		return nil
+	},
+}
+
+// workspaceRelease is a repo updated by workspace update, as printed with
+// --json.
+type workspaceRelease struct {
+	Repo    string            `json:"repo"`
+	Updates []workspaceUpdate `json:"updates"`
+
+	// Hash is the hash the repo was released as, unset with --dry-run.
+	Hash string `json:"hash,omitempty"`
+}
+
+type workspaceUpdate struct {
+	Dependency string `json:"dependency"`
+	From       string `json:"from"`
+	To         string `json:"to"`
+}
+
+func loadWorkspace() (*Workspace, error) {
+	var ws Workspace
+	err := loadMap(&ws, filepath.Join(cwd, workspaceFileName))
+	return &ws, err
+}
+
+func saveWorkspace(ws *Workspace) error {
+	data, err := json.MarshalIndent(ws, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(cwd, workspaceFileName), append(data, '\n'), 0644)
+}
+
+func (ws *Workspace) load() ([]*workspaceRepo, error) {
+	var out []*workspaceRepo
+	for _, r := range ws.Repos {
+		dir := goPathSrc(r)
+		pkg, err := LoadPackageFile(filepath.Join(dir, gx.PkgFileName))
+		if err != nil {
+			return nil, fmt.Errorf("loading workspace repo %s: %s", r, err)
+		}
+		out = append(out, &workspaceRepo{dir: dir, pkg: pkg})
+	}
+	return out, nil
+}
+
+// workspaceOrder sorts the repos so that every repo comes after the
+// workspace repos it depends on. Dependencies are matched by package name.
+func workspaceOrder(repos []*workspaceRepo) ([]*workspaceRepo, error) {
+	byName := make(map[string]*workspaceRepo)
+	for _, r := range repos {
+		byName[r.pkg.Name] = r
+	}
+
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	state := make(map[string]int)
+
+	var out []*workspaceRepo
+	var visit func(r *workspaceRepo, path []string) error
+	visit = func(r *workspaceRepo, path []string) error {
+		switch state[r.pkg.Name] {
+		case visited:
+			return nil
+		case visiting:
+			return fmt.Errorf("dependency cycle in workspace: %s", strings.Join(append(path, r.pkg.Name), " -> "))
+		}
+		state[r.pkg.Name] = visiting
+
+		for _, dep := range r.pkg.Dependencies {
+			if dr, ok := byName[dep.Name]; ok {
+				if err := visit(dr, append(path, r.pkg.Name)); err != nil {
+					return err
+				}
+			}
+		}
+
+		state[r.pkg.Name] = visited
+		out = append(out, r)
+		return nil
+	}
+
+	for _, r := range repos {
+		if err := visit(r, nil); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+// lastPublished returns the hash of the last version of the package in
+// `dir` published by gx.
+func lastPublished(dir string) (string, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, ".gx", "lastpubver"))
+	if err != nil {
+		return "", err
+	}
+
+	parts := strings.SplitN(string(data), ":", 2)
+	if len(parts) != 2 {
+		return "", fmt.Errorf("unrecognized .gx/lastpubver in %s", dir)
+	}
+	return strings.TrimSpace(parts[1]), nil
+}
+
+// runIn runs `name` in `dir`, passing the gx-go commands it may spawn the
+// settings of this one.
+func runIn(dir, name string, args ...string) error {
+	cmd := exec.Command(name, args...)
+	cmd.Dir = dir
+	cmd.Env = childEnv()
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = commandOut()
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}